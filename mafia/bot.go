@@ -0,0 +1,368 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gosuda/portal-toys/mafia/jobs"
+)
+
+// Bots are server-side players. A bot is a *Client without a connection
+// that sits in Room.players like anyone else; a Strategy makes its choices
+// and the room submits them through handleMessage, so night actions go
+// through jobs.Job.NightAction and votes through handleVote exactly as a
+// player's would. Bots learn only what a player in their seat would: the
+// events pushed to them and the public state in a BotView.
+
+// Strategy decides for one bot. Each bot gets its own instance, so a
+// strategy may remember what it has observed. Methods run on the room
+// goroutine.
+type Strategy interface {
+	// NightTarget returns whom to use the bot's ability on, or "" to pass.
+	NightTarget(v *BotView) string
+	// Vote returns whom to nominate during the vote, or "" to abstain.
+	Vote(v *BotView) string
+	// Execute answers the execution vote on v.Nominee.
+	Execute(v *BotView) bool
+	// Chat returns a line to say in the current phase, or "".
+	Chat(v *BotView) string
+	// Observe sees every event pushed to the bot.
+	Observe(ev ServerEvent)
+}
+
+// BotView is what a bot may know when it is asked to decide.
+type BotView struct {
+	Self  string
+	Role  string
+	Team  jobs.Team
+	Phase GamePhase
+	Day   int
+	// Alive lists the living players, Self included, in name order.
+	Alive []string
+	// Teammates are the living players a bot knows share its team; mafia
+	// and sect members know each other.
+	Teammates []string
+	// Candidates restricts a runoff vote; empty means anyone alive.
+	Candidates []string
+	Votes      map[string]int
+	Nominee    string
+	Rand       *rand.Rand
+}
+
+// others returns the living players other than the bot and its teammates.
+func (v *BotView) others() []string {
+	out := make([]string, 0, len(v.Alive))
+	for _, name := range v.Alive {
+		if name != v.Self && !contains(v.Teammates, name) {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+func (v *BotView) pick(names []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	return names[v.Rand.Intn(len(names))]
+}
+
+// strategies are the bot kinds hosts and the simulator can choose from.
+var strategies = map[string]func() Strategy{
+	"random":    func() Strategy { return randomStrategy{} },
+	"heuristic": func() Strategy { return &heuristicStrategy{known: make(map[string]bool)} },
+}
+
+const defaultStrategy = "heuristic"
+
+func strategyNames() []string {
+	names := make([]string, 0, len(strategies))
+	for name := range strategies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// randomStrategy picks uniformly among legal choices and never talks. It is
+// the baseline the heuristic is measured against.
+type randomStrategy struct{}
+
+func (randomStrategy) NightTarget(v *BotView) string { return v.pick(v.others()) }
+func (randomStrategy) Vote(v *BotView) string {
+	if len(v.Candidates) > 0 {
+		return v.pick(v.Candidates)
+	}
+	return v.pick(v.others())
+}
+func (randomStrategy) Execute(v *BotView) bool { return v.Rand.Intn(2) == 0 }
+func (randomStrategy) Chat(*BotView) string    { return "" }
+func (randomStrategy) Observe(ServerEvent)     {}
+
+// heuristicStrategy plays its role: mafia and sect spare their own, the
+// doctor sometimes guards itself, the police remembers what it found and
+// pushes for confirmed mafia, the jester courts the rope, and everyone
+// else follows the leading candidate more often than not.
+type heuristicStrategy struct {
+	investigated string
+	known        map[string]bool // police results: true means mafia
+}
+
+var (
+	dayLines = []string{
+		"음... 아직 잘 모르겠네요.",
+		"%s 님 어젯밤에 뭐 하셨어요?",
+		"저는 시민입니다. 믿어 주세요.",
+		"%s 님이 좀 수상한데요.",
+		"다들 의견 좀 말해 주세요.",
+	}
+	defenseLines = []string{
+		"저 아니에요! 억울합니다.",
+		"저를 처형하면 시민 팀이 손해입니다.",
+		"한 번만 믿어 주세요.",
+	}
+)
+
+func (s *heuristicStrategy) NightTarget(v *BotView) string {
+	switch v.Role {
+	case "마피아", "교주":
+		return v.pick(v.others())
+	case "의사":
+		if v.Rand.Intn(3) == 0 {
+			return v.Self
+		}
+		return v.pick(v.others())
+	case "경찰":
+		var fresh []string
+		for _, name := range v.others() {
+			if _, seen := s.known[name]; !seen {
+				fresh = append(fresh, name)
+			}
+		}
+		s.investigated = v.pick(fresh)
+		return s.investigated
+	}
+	return ""
+}
+
+func (s *heuristicStrategy) Vote(v *BotView) string {
+	choices := v.Candidates
+	if len(choices) == 0 {
+		choices = v.Alive
+	}
+	if v.Role == "광대" && contains(choices, v.Self) {
+		return v.Self
+	}
+	var pool []string
+	for _, name := range choices {
+		if name == v.Self || contains(v.Teammates, name) {
+			continue
+		}
+		if mafia, seen := s.known[name]; seen {
+			if mafia {
+				return name
+			}
+			continue
+		}
+		pool = append(pool, name)
+	}
+	if len(pool) == 0 {
+		return ""
+	}
+	if leader := leading(v.Votes, pool); leader != "" && v.Rand.Intn(5) < 3 {
+		return leader
+	}
+	return v.pick(pool)
+}
+
+func (s *heuristicStrategy) Execute(v *BotView) bool {
+	switch {
+	case v.Nominee == v.Self:
+		return v.Role == "광대"
+	case contains(v.Teammates, v.Nominee):
+		return false
+	}
+	if mafia, seen := s.known[v.Nominee]; seen {
+		return mafia
+	}
+	return v.Rand.Intn(10) < 7
+}
+
+func (s *heuristicStrategy) Chat(v *BotView) string {
+	switch v.Phase {
+	case PhaseDay:
+		if v.Rand.Intn(3) != 0 {
+			return ""
+		}
+		for name, mafia := range s.known {
+			if mafia && contains(v.Alive, name) {
+				return fmt.Sprintf("제가 경찰입니다. %s 님은 마피아예요!", name)
+			}
+		}
+		line := dayLines[v.Rand.Intn(len(dayLines))]
+		if strings.Contains(line, "%s") {
+			target := v.pick(v.others())
+			if target == "" {
+				return ""
+			}
+			line = fmt.Sprintf(line, target)
+		}
+		return line
+	case PhaseDefense:
+		if v.Nominee == v.Self {
+			return defenseLines[v.Rand.Intn(len(defenseLines))]
+		}
+	}
+	return ""
+}
+
+func (s *heuristicStrategy) Observe(ev ServerEvent) {
+	if s.investigated == "" || ev.Type != EventTypeLog {
+		return
+	}
+	switch ev.Body {
+	case "마피아 입니다.":
+		s.known[s.investigated] = true
+	case "마피아가 아닙니다.":
+		s.known[s.investigated] = false
+	default:
+		return
+	}
+	s.investigated = ""
+}
+
+// leading returns the name in pool with the most votes, if anyone has one.
+func leading(votes map[string]int, pool []string) string {
+	best, most := "", 0
+	for _, name := range pool {
+		if votes[name] > most {
+			best, most = name, votes[name]
+		}
+	}
+	return best
+}
+
+// newBotClient returns a connectionless client driven by s.
+func newBotClient(name string, mgr *RoomManager, s Strategy) *Client {
+	return &Client{name: name, mgr: mgr, bot: s, send: make(chan ServerEvent)}
+}
+
+// addBot seats a new bot playing the named strategy.
+func (r *Room) addBot(kind string) (*Client, error) {
+	if kind == "" {
+		kind = defaultStrategy
+	}
+	newStrategy, ok := strategies[kind]
+	if !ok {
+		return nil, fmt.Errorf("봇 종류 %s 이(가) 없습니다. 사용 가능한 종류: %s", kind, strings.Join(strategyNames(), ", "))
+	}
+	if r.state.Active {
+		return nil, errors.New("게임 중에는 봇을 추가할 수 없습니다.")
+	}
+	c := newBotClient(r.manager.claimBotName(r), r.manager, newStrategy())
+	r.addPlayer(c)
+	return c, nil
+}
+
+// onlyBots reports whether every seated player is a bot.
+func (r *Room) onlyBots() bool {
+	for _, cl := range r.players {
+		if cl.bot == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// runBots lets the bots act on the phase that just began. In a simulation
+// they act at once; otherwise each waits a random part of the phase so
+// they do not all answer in the same instant.
+func (r *Room) runBots(d time.Duration) {
+	seq := r.phaseSeq
+	for _, name := range r.order {
+		c := r.players[name]
+		if c == nil || c.bot == nil || !r.state.Alive[name] {
+			continue
+		}
+		if r.simulate {
+			r.botTurn(c, seq)
+			continue
+		}
+		delay := d/5 + time.Duration(r.rand.Int63n(int64(d/2)+1))
+		time.AfterFunc(delay, func() {
+			r.enqueue(func(room *Room) { room.botTurn(c, seq) })
+		})
+	}
+}
+
+// botTurn has bot c act once in the phase numbered seq, unless that phase
+// is over.
+func (r *Room) botTurn(c *Client, seq int) {
+	if seq != r.phaseSeq || r.players[c.name] != c || !r.state.Active || !r.state.Alive[c.name] {
+		return
+	}
+	v := r.botView(c.name)
+	switch r.state.Phase {
+	case PhaseNight:
+		if target := c.bot.NightTarget(v); target != "" {
+			r.handleMessage(c, ClientMessage{Type: "action", Target: target})
+		}
+	case PhaseDay:
+		if line := c.bot.Chat(v); line != "" {
+			r.handleMessage(c, ClientMessage{Type: "chat", Text: line})
+		}
+	case PhaseVote:
+		if target := c.bot.Vote(v); target != "" {
+			r.handleMessage(c, ClientMessage{Type: "vote", Target: target})
+		}
+	case PhaseDefense:
+		exec := r.state.Execution
+		if exec == nil {
+			return
+		}
+		if !exec.Voting {
+			if line := c.bot.Chat(v); line != "" {
+				r.handleMessage(c, ClientMessage{Type: "chat", Text: line})
+			}
+			return
+		}
+		decision := "oppose"
+		if c.bot.Execute(v) {
+			decision = "agree"
+		}
+		r.handleMessage(c, ClientMessage{Type: "decision", Text: decision})
+	}
+}
+
+func (r *Room) botView(name string) *BotView {
+	job := r.state.Assign[name]
+	v := &BotView{
+		Self:       name,
+		Role:       job.Name,
+		Team:       job.Team,
+		Phase:      r.state.Phase,
+		Day:        r.state.DayCount,
+		Candidates: r.state.Runoff,
+		Votes:      r.state.Vote,
+		Rand:       r.rand,
+	}
+	for other := range r.state.Alive {
+		v.Alive = append(v.Alive, other)
+		if other == name {
+			continue
+		}
+		if mate := r.state.Assign[other]; mate != nil && mate.Team == job.Team && (job.Team == jobs.TeamMafia || job.Team == jobs.TeamSect) {
+			v.Teammates = append(v.Teammates, other)
+		}
+	}
+	sort.Strings(v.Alive)
+	sort.Strings(v.Teammates)
+	if r.state.Execution != nil {
+		v.Nominee = r.state.Execution.Target
+	}
+	return v
+}
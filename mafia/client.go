@@ -18,12 +18,16 @@ const (
 
 // Client represents a single websocket participant.
 type Client struct {
-	name   string
-	room   *Room
-	conn   *websocket.Conn
-	send   chan ServerEvent
-	mgr    *RoomManager
-	closed atomic.Bool
+	name       string
+	session    string
+	registered bool // the name has a profile and the client presented its key
+	room       *Room
+	watch      *Room // set for spectators before the loops start
+	conn       *websocket.Conn
+	send       chan ServerEvent
+	mgr        *RoomManager
+	bot        Strategy // set for bot players, which have no conn
+	closed     atomic.Bool
 }
 
 func NewClient(name string, conn *websocket.Conn, mgr *RoomManager) *Client {
@@ -90,6 +94,10 @@ func (c *Client) push(ev ServerEvent) {
 	if c.closed.Load() {
 		return
 	}
+	if c.bot != nil {
+		c.bot.Observe(ev)
+		return
+	}
 	select {
 	case c.send <- ev:
 	default:
@@ -117,9 +125,11 @@ func (c *Client) close() {
 	if c.closed.Swap(true) {
 		return
 	}
-	if c.room != nil {
+	if c.room != nil || c.watch != nil {
 		c.mgr.Detach(c)
 	}
 	close(c.send)
-	_ = c.conn.Close()
+	if c.conn != nil {
+		_ = c.conn.Close()
+	}
 }
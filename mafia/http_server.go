@@ -2,6 +2,7 @@ package main
 
 import (
 	"embed"
+	"encoding/json"
 	"fmt"
 	"io/fs"
 	"net/http"
@@ -14,6 +15,10 @@ import (
 //go:embed static
 var staticFS embed.FS
 
+// spectatorName is the name given to spectators who do not pick one. No
+// profile may claim it.
+const spectatorName = "관전자"
+
 // HTTPServer wires HTTP routes to the room manager.
 type HTTPServer struct {
 	mgr      *RoomManager
@@ -44,12 +49,41 @@ func (s *HTTPServer) Router() http.Handler {
 		w.WriteHeader(http.StatusOK)
 	})
 	mux.HandleFunc("/ws", s.handleWebSocket)
+	mux.HandleFunc("/api/rules", s.handleRules)
+	mux.HandleFunc("GET /api/games", s.handleGames)
+	mux.HandleFunc("GET /api/games/{id}/replay", s.handleReplay)
+	mux.HandleFunc("POST /api/profiles", s.handleRegister)
+	mux.HandleFunc("GET /api/profiles/{name}", s.handleProfile)
+	mux.HandleFunc("GET /api/leaderboard", s.handleLeaderboard)
 	return mux
 }
 
+// handleRules lists the rule sets a host can pick with the "rules" admin
+// action.
+func (s *HTTPServer) handleRules(w http.ResponseWriter, _ *http.Request) {
+	type entry struct {
+		Name    string `json:"name"`
+		Summary string `json:"summary"`
+		*Rules
+	}
+	book := s.mgr.rules
+	out := make([]entry, 0, len(book.Names()))
+	for _, name := range book.Names() {
+		rules := book.Get(name)
+		out = append(out, entry{Name: name, Summary: rules.summary(), Rules: rules})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
+}
+
 func (s *HTTPServer) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	roomName := r.URL.Query().Get("room")
 	user := r.URL.Query().Get("user")
+	spectate := r.URL.Query().Get("spectate") != ""
+	anonymous := spectate && user == ""
+	if anonymous {
+		user = spectatorName
+	}
 	if roomName == "" || user == "" {
 		http.Error(w, "missing room or user", http.StatusBadRequest)
 		return
@@ -61,6 +95,22 @@ func (s *HTTPServer) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// An anonymous spectator claims no name, so there is nothing to verify.
+	ok, registered := true, false
+	var err error
+	if !anonymous {
+		ok, registered, err = s.mgr.stats.Verify(user, r.URL.Query().Get("key"))
+	}
+	if err != nil {
+		log.Error().Err(err).Str("user", user).Msg("verify profile")
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "nickname is registered; connect with its key", http.StatusForbidden)
+		return
+	}
+
 	conn, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Error().Err(err).Msg("upgrade websocket")
@@ -68,7 +118,13 @@ func (s *HTTPServer) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	}
 
 	client := NewClient(user, conn, s.mgr)
-	if err := s.mgr.Attach(roomName, client); err != nil {
+	client.registered = registered
+	if spectate {
+		err = s.mgr.AttachSpectator(roomName, client)
+	} else {
+		err = s.mgr.Attach(roomName, client, r.URL.Query().Get("session"))
+	}
+	if err != nil {
 		msg := fmt.Sprintf("join failed: %v", err)
 		_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, msg), time.Now().Add(2*time.Second))
 		_ = conn.Close()
@@ -2,6 +2,13 @@ package main
 
 import "github.com/gosuda/portal-toys/mafia/jobs"
 
+var teamNames = map[jobs.Team]string{
+	jobs.TeamCitizen: "시민",
+	jobs.TeamMafia:   "마피아",
+	jobs.TeamSect:    "교주",
+	jobs.TeamNeutral: "중립",
+}
+
 // JobSpec describes a role pulled from reference data.
 type JobSpec struct {
 	Name string
@@ -35,15 +42,19 @@ var defaultJobs = map[string]JobSpec{
 		Team: jobs.TeamCitizen,
 		Desc: "투표로 처형당하지 않으며 투표권이 두 표로 인정됩니다.",
 	},
+	"교주": {
+		Name: "교주",
+		Team: jobs.TeamSect,
+		Desc: "밤마다 한 명을 포섭해 교주 팀으로 만듭니다. 마피아와 중립은 포섭할 수 없습니다. 마피아가 없고 교주 팀이 나머지 이상이면 승리.",
+	},
+	"광대": {
+		Name: "광대",
+		Team: jobs.TeamNeutral,
+		Desc: "어느 팀에도 속하지 않습니다. 투표로 처형되면 혼자 승리합니다.",
+	},
 	"시민": {
 		Name: "시민",
 		Team: jobs.TeamCitizen,
 		Desc: "능력은 없지만 토론과 투표로 마피아를 색출합니다.",
 	},
 }
-
-var (
-	defaultRolePriority = []string{"마피아", "의사", "경찰", "군인", "정치인"}
-	defaultMafiaRole    = "마피아"
-	defaultCitizenRole  = "시민"
-)
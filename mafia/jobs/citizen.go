@@ -18,3 +18,4 @@ func (j *passiveJob) OnNightResolved(ctx *NightResultContext) {}
 func (j *passiveJob) OnDayStart(ctx *PhaseContext)            {}
 func (j *passiveJob) OnVote(ctx *VoteContext)                 {}
 func (j *passiveJob) OnDeath(ctx *DeathContext) bool          { return false }
+func (j *passiveJob) CheckWin(ctx *WinContext) bool           { return TeamWin(ctx) }
@@ -30,7 +30,10 @@ type RoomState interface {
 	Broadcast(ev ServerEvent)
 	BroadcastTeam(team Team, ev ServerEvent)
 	SetNightTarget(key, value string)
+	NightTarget(key string) string
 	LookupJob(name string) Job
+	TeamOf(name string) Team
+	SetTeam(name string, team Team)
 	SetMeta(key, value string)
 	GetMeta(key string) string
 	AddVote(target string, delta int)
@@ -55,6 +58,7 @@ type Job interface {
 	OnDayStart(ctx *PhaseContext)
 	OnVote(ctx *VoteContext)
 	OnDeath(ctx *DeathContext) bool
+	CheckWin(ctx *WinContext) bool
 }
 
 // Factory creates a job instance from spec metadata.
@@ -69,8 +73,9 @@ type Spec struct {
 
 // Additional lifecycle contexts for future hooks.
 type NightResultContext struct {
-	Room RoomState
-	Meta map[string]string
+	Room  RoomState
+	Actor string
+	Meta  map[string]string
 }
 
 type PhaseContext struct {
@@ -92,3 +97,35 @@ type DeathContext struct {
 	CauseType string
 	Meta      map[string]string
 }
+
+// WinContext is passed to CheckWin for every player, dead or alive, after
+// each death. Team is the player's current team, which differs from the
+// job's own after a conversion; Alive counts living players by team.
+type WinContext struct {
+	Room   RoomState
+	Player string
+	Team   Team
+	Alive  map[Team]int
+	Meta   map[string]string
+}
+
+// TeamWin is the usual win condition for ctx.Team. Citizens win once no
+// mafia or sect member is left. Mafia wins when it is at least as large as
+// everyone else; the sect likewise, but only after the mafia is gone.
+// Neutral players have no team win and count as everyone else.
+func TeamWin(ctx *WinContext) bool {
+	total := 0
+	for _, n := range ctx.Alive {
+		total += n
+	}
+	own := ctx.Alive[ctx.Team]
+	switch ctx.Team {
+	case TeamCitizen:
+		return ctx.Alive[TeamMafia] == 0 && ctx.Alive[TeamSect] == 0
+	case TeamMafia:
+		return own > 0 && own >= total-own
+	case TeamSect:
+		return own > 0 && ctx.Alive[TeamMafia] == 0 && own >= total-own
+	}
+	return false
+}
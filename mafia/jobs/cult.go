@@ -0,0 +1,39 @@
+package jobs
+
+import "fmt"
+
+// cultJob leads the sect. Each night it picks a player, who joins the sect
+// when the night is resolved unless they are mafia or neutral, or died that
+// night.
+type cultJob struct{ spec Spec }
+
+func NewCultLeader(spec Spec) Job { return &cultJob{spec: spec} }
+
+func (j *cultJob) Name() string        { return j.spec.Name }
+func (j *cultJob) Team() Team          { return j.spec.Team }
+func (j *cultJob) Description() string { return j.spec.Desc }
+func (j *cultJob) NightAction(ctx *Context) error {
+	if ctx.Room.TeamOf(ctx.Target) == TeamSect {
+		return fmt.Errorf("%s 님은 이미 교주 팀입니다.", ctx.Target)
+	}
+	ctx.Room.SetNightTarget("sect", ctx.Target)
+	ctx.Room.PushSystem(ctx.Actor, fmt.Sprintf("%s 님을 포섭 대상으로 선택했습니다.", ctx.Target))
+	return nil
+}
+func (j *cultJob) OnNightResolved(ctx *NightResultContext) {
+	target := ctx.Room.NightTarget("sect")
+	if target == "" || !ctx.Room.IsAlive(ctx.Actor) || !ctx.Room.IsAlive(target) {
+		return
+	}
+	if team := ctx.Room.TeamOf(target); team == TeamMafia || team == TeamNeutral {
+		ctx.Room.PushSystem(ctx.Actor, fmt.Sprintf("%s 님을 포섭하지 못했습니다.", target))
+		return
+	}
+	ctx.Room.SetTeam(target, TeamSect)
+	ctx.Room.PushSystem(target, "교주에게 포섭되었습니다. 이제 교주 팀입니다.")
+	ctx.Room.BroadcastTeam(TeamSect, ServerEvent{Type: EventTypeLog, Room: ctx.Room.Name(), Body: fmt.Sprintf("%s 님이 교주 팀에 합류했습니다.", target)})
+}
+func (j *cultJob) OnDayStart(ctx *PhaseContext)   {}
+func (j *cultJob) OnVote(ctx *VoteContext)        {}
+func (j *cultJob) OnDeath(ctx *DeathContext) bool { return false }
+func (j *cultJob) CheckWin(ctx *WinContext) bool  { return TeamWin(ctx) }
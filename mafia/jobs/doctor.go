@@ -18,3 +18,4 @@ func (j *doctorJob) OnNightResolved(ctx *NightResultContext) {}
 func (j *doctorJob) OnDayStart(ctx *PhaseContext)            {}
 func (j *doctorJob) OnVote(ctx *VoteContext)                 {}
 func (j *doctorJob) OnDeath(ctx *DeathContext) bool          { return false }
+func (j *doctorJob) CheckWin(ctx *WinContext) bool           { return TeamWin(ctx) }
@@ -0,0 +1,25 @@
+package jobs
+
+import "errors"
+
+// jesterJob is neutral and wins alone by getting itself executed.
+type jesterJob struct{ spec Spec }
+
+func NewJester(spec Spec) Job { return &jesterJob{spec: spec} }
+
+func (j *jesterJob) Name() string                            { return j.spec.Name }
+func (j *jesterJob) Team() Team                              { return j.spec.Team }
+func (j *jesterJob) Description() string                     { return j.spec.Desc }
+func (j *jesterJob) NightAction(ctx *Context) error          { return errors.New("능력이 없습니다.") }
+func (j *jesterJob) OnNightResolved(ctx *NightResultContext) {}
+func (j *jesterJob) OnDayStart(ctx *PhaseContext)            {}
+func (j *jesterJob) OnVote(ctx *VoteContext)                 {}
+func (j *jesterJob) OnDeath(ctx *DeathContext) bool {
+	if ctx.CauseType == "vote" {
+		ctx.Room.SetMeta("jester_executed_"+ctx.Victim, "1")
+	}
+	return false
+}
+func (j *jesterJob) CheckWin(ctx *WinContext) bool {
+	return ctx.Room.GetMeta("jester_executed_"+ctx.Player) == "1"
+}
@@ -19,3 +19,4 @@ func (j *mafiaJob) OnNightResolved(ctx *NightResultContext) {}
 func (j *mafiaJob) OnDayStart(ctx *PhaseContext)            {}
 func (j *mafiaJob) OnVote(ctx *VoteContext)                 {}
 func (j *mafiaJob) OnDeath(ctx *DeathContext) bool          { return false }
+func (j *mafiaJob) CheckWin(ctx *WinContext) bool           { return TeamWin(ctx) }
@@ -36,3 +36,4 @@ func (j *policeJob) OnNightResolved(ctx *NightResultContext) {}
 func (j *policeJob) OnDayStart(ctx *PhaseContext)            {}
 func (j *policeJob) OnVote(ctx *VoteContext)                 {}
 func (j *policeJob) OnDeath(ctx *DeathContext) bool          { return false }
+func (j *policeJob) CheckWin(ctx *WinContext) bool           { return TeamWin(ctx) }
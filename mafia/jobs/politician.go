@@ -25,3 +25,4 @@ func (j *politicianJob) OnDeath(ctx *DeathContext) bool {
 	}
 	return false
 }
+func (j *politicianJob) CheckWin(ctx *WinContext) bool { return TeamWin(ctx) }
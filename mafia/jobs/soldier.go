@@ -26,3 +26,4 @@ func (j *soldierJob) OnDeath(ctx *DeathContext) bool {
 	ctx.Room.Broadcast(ServerEvent{Type: EventTypeLog, Room: ctx.Room.Name(), Body: fmt.Sprintf("[ %s ] 님이 마피아의 공격을 버텨 냈습니다.", ctx.Victim)})
 	return true
 }
+func (j *soldierJob) CheckWin(ctx *WinContext) bool { return TeamWin(ctx) }
@@ -0,0 +1,122 @@
+package jobs
+
+import "testing"
+
+// fakeRoom is the slice of RoomState the win checks and conversions use.
+type fakeRoom struct {
+	alive map[string]bool
+	teams map[string]Team
+	meta  map[string]string
+	night map[string]string
+}
+
+func newFakeRoom() *fakeRoom {
+	return &fakeRoom{alive: map[string]bool{}, teams: map[string]Team{}, meta: map[string]string{}, night: map[string]string{}}
+}
+
+func (r *fakeRoom) Name() string                            { return "test" }
+func (r *fakeRoom) IsAlive(name string) bool                { return r.alive[name] }
+func (r *fakeRoom) PushSystem(name, msg string)             {}
+func (r *fakeRoom) Broadcast(ev ServerEvent)                {}
+func (r *fakeRoom) BroadcastTeam(team Team, ev ServerEvent) {}
+func (r *fakeRoom) SetNightTarget(key, value string)        { r.night[key] = value }
+func (r *fakeRoom) NightTarget(key string) string           { return r.night[key] }
+func (r *fakeRoom) LookupJob(name string) Job               { return nil }
+func (r *fakeRoom) TeamOf(name string) Team                 { return r.teams[name] }
+func (r *fakeRoom) SetTeam(name string, team Team)          { r.teams[name] = team }
+func (r *fakeRoom) SetMeta(key, value string)               { r.meta[key] = value }
+func (r *fakeRoom) GetMeta(key string) string               { return r.meta[key] }
+func (r *fakeRoom) AddVote(target string, delta int)        {}
+
+func TestTeamWin(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		team  Team
+		alive map[Team]int
+		want  bool
+	}{
+		{"citizens once mafia and sect are gone", TeamCitizen, map[Team]int{TeamCitizen: 3}, true},
+		{"citizens alongside a jester", TeamCitizen, map[Team]int{TeamCitizen: 1, TeamNeutral: 1}, true},
+		{"citizens with mafia left", TeamCitizen, map[Team]int{TeamCitizen: 3, TeamMafia: 1}, false},
+		{"citizens with sect left", TeamCitizen, map[Team]int{TeamCitizen: 3, TeamSect: 1}, false},
+		{"dead citizens share the win", TeamCitizen, map[Team]int{TeamCitizen: 0, TeamNeutral: 1}, true},
+		{"mafia at parity", TeamMafia, map[Team]int{TeamMafia: 1, TeamCitizen: 1}, true},
+		{"mafia outnumbering", TeamMafia, map[Team]int{TeamMafia: 2, TeamCitizen: 1}, true},
+		{"mafia outnumbered", TeamMafia, map[Team]int{TeamMafia: 1, TeamCitizen: 2}, false},
+		{"a jester counts against mafia", TeamMafia, map[Team]int{TeamMafia: 1, TeamCitizen: 1, TeamNeutral: 1}, false},
+		{"mafia all dead", TeamMafia, map[Team]int{TeamCitizen: 1}, false},
+		{"sect at parity", TeamSect, map[Team]int{TeamSect: 2, TeamCitizen: 2}, true},
+		{"sect waits for the mafia", TeamSect, map[Team]int{TeamSect: 2, TeamCitizen: 1, TeamMafia: 1}, false},
+		{"sect outnumbered", TeamSect, map[Team]int{TeamSect: 1, TeamCitizen: 2}, false},
+		{"sect all dead", TeamSect, map[Team]int{TeamCitizen: 1}, false},
+		{"neutral has no team win", TeamNeutral, map[Team]int{TeamNeutral: 1}, false},
+	} {
+		if got := TeamWin(&WinContext{Team: tc.team, Alive: tc.alive}); got != tc.want {
+			t.Errorf("%s: TeamWin = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+// TestTeamJobsCheckWin checks that every team role wins exactly when its
+// team does.
+func TestTeamJobsCheckWin(t *testing.T) {
+	for _, newJob := range []Factory{NewCitizen, NewDoctor, NewPolice, NewSoldier, NewPolitician, NewMafia, NewCultLeader} {
+		job := newJob(Spec{Name: "x", Team: TeamCitizen})
+		for _, alive := range []map[Team]int{
+			{TeamCitizen: 2},
+			{TeamCitizen: 1, TeamMafia: 1},
+			{TeamCitizen: 1, TeamSect: 2},
+		} {
+			for _, team := range []Team{TeamCitizen, TeamMafia, TeamSect} {
+				ctx := &WinContext{Room: newFakeRoom(), Player: "p", Team: team, Alive: alive}
+				if got, want := job.CheckWin(ctx), TeamWin(ctx); got != want {
+					t.Errorf("%T on team %s with %v: CheckWin = %v, want %v", job, team, alive, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestJesterWin(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		victim string
+		cause  string
+		want   bool
+	}{
+		{"executed by vote", "jester", "vote", true},
+		{"killed at night", "jester", "mafia", false},
+		{"someone else executed", "citizen", "vote", false},
+	} {
+		room := newFakeRoom()
+		job := NewJester(Spec{Name: "광대", Team: TeamNeutral})
+		job.OnDeath(&DeathContext{Room: room, Victim: tc.victim, CauseType: tc.cause})
+		// Alive numbers that would hand another team the game must not matter
+		ctx := &WinContext{Room: room, Player: "jester", Team: TeamNeutral, Alive: map[Team]int{TeamMafia: 1}}
+		if got := job.CheckWin(ctx); got != tc.want {
+			t.Errorf("%s: CheckWin = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestCultConversion(t *testing.T) {
+	for _, tc := range []struct {
+		target Team
+		alive  bool
+		want   Team
+	}{
+		{TeamCitizen, true, TeamSect},
+		{TeamMafia, true, TeamMafia},
+		{TeamNeutral, true, TeamNeutral},
+		{TeamCitizen, false, TeamCitizen},
+	} {
+		room := newFakeRoom()
+		room.alive["leader"], room.alive["target"] = true, tc.alive
+		room.teams["leader"], room.teams["target"] = TeamSect, tc.target
+		room.SetNightTarget("sect", "target")
+		NewCultLeader(Spec{Team: TeamSect}).OnNightResolved(&NightResultContext{Room: room, Actor: "leader"})
+		if got := room.teams["target"]; got != tc.want {
+			t.Errorf("%s target (alive %v): team %s after the night, want %s", tc.target, tc.alive, got, tc.want)
+		}
+	}
+}
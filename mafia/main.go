@@ -31,6 +31,9 @@ var (
 	flagName       string
 	flagCredKey    string
 	flagAuthKey    string
+	flagRulesDir   string
+	flagGrace      time.Duration
+	flagDataPath   string
 )
 
 func init() {
@@ -40,6 +43,9 @@ func init() {
 	flags.StringVar(&flagName, "name", "mafia", "backend display name")
 	flags.StringVar(&flagCredKey, "cred-key", "", "optional credential key to use for the listener (base64 encoded)")
 	flags.StringVar(&flagAuthKey, "ws-auth-key", os.Getenv("MAFIA_WS_AUTH"), "optional shared secret required from clients via X-Mafia-Key header")
+	flags.DurationVar(&flagGrace, "reconnect-grace", 60*time.Second, "how long a dropped player's seat is held for them to reconnect (0 removes them at once)")
+	flags.StringVar(&flagDataPath, "data-path", "", "optional Pebble directory for player profiles, stats and ratings (empty disables them)")
+	flags.StringVar(&flagRulesDir, "rules-dir", "", "optional directory of game rule sets (*.json, *.yaml) hosts can choose from")
 }
 
 func main() {
@@ -59,7 +65,17 @@ func runServer(cmd *cobra.Command, args []string) error {
 		}
 	}
 
-	mgr := NewRoomManager()
+	rules, err := loadRuleBook(flagRulesDir)
+	if err != nil {
+		return fmt.Errorf("load rules: %w", err)
+	}
+	log.Info().Strs("rules", rules.Names()).Msg("[mafia] game rules loaded")
+	stats, err := openStatsStore(flagDataPath)
+	if err != nil {
+		return fmt.Errorf("open stats store: %w", err)
+	}
+	defer func() { _ = stats.Close() }()
+	mgr := NewRoomManager(rules, flagGrace, stats)
 	handler := NewHTTPServer(mgr, flagAuthKey)
 
 	var (
@@ -12,6 +12,12 @@ const (
 	EventTypeRole   ServerEventType = "role"
 	EventTypePhase  ServerEventType = "phase"
 	EventTypeState  ServerEventType = "state"
+	// EventTypeSession carries the resume token in Body; pass it back as
+	// ?session= when reconnecting to keep the seat.
+	EventTypeSession ServerEventType = "session"
+	// EventTypeGameOver carries the finished game's ID in Body; its log is
+	// at /api/games/{id}/replay.
+	EventTypeGameOver ServerEventType = "game_over"
 )
 
 // ClientMessage is the envelope received from websocket clients.
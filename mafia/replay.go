@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GameLog is the append-only record of one game. The room appends to it
+// while the game runs and hands it to the archive when the game ends; only
+// finished games are served, so a replay cannot leak night actions.
+type GameLog struct {
+	ID      string         `json:"id"`
+	Room    string         `json:"room"`
+	Rules   string         `json:"rules"`
+	Started time.Time      `json:"started"`
+	Ended   time.Time      `json:"ended"`
+	Players []PlayerRecord `json:"players"`
+	Winners []string       `json:"winners"`
+	Events  []GameEvent    `json:"events"`
+}
+
+// PlayerRecord is a player's role at the start of a game and their fate.
+type PlayerRecord struct {
+	Name      string `json:"name"`
+	Role      string `json:"role"`
+	Team      string `json:"team"`
+	FinalTeam string `json:"final_team"`
+	Survived  bool   `json:"survived"`
+	Rated     bool   `json:"rated,omitempty"` // registered; counts toward stats
+	Bot       bool   `json:"bot,omitempty"`
+}
+
+// GameEvent is one state transition. Kind is one of
+//
+//	phase              Detail: announcement
+//	night_action       Actor used their role (Detail) on Target
+//	saved              Target was attacked and healed
+//	elimination        Target died; Detail: cause type (mafia, vote)
+//	death_intercepted  Target survived death by Detail's ability
+//	team_change        Target joined team Detail
+//	vote               Actor voted for Target
+//	extra_vote         Target got Detail extra votes from a role
+//	nomination         Target goes to the defense
+//	tie                the vote tied between Detail; resolved per tie_break
+//	execution_vote     Actor answered Detail (agree, oppose) about Target
+//	left               Actor left the room
+//	game_over          Detail: winning players
+type GameEvent struct {
+	Seq    int       `json:"seq"`
+	At     time.Time `json:"at"`
+	Day    int       `json:"day"`
+	Phase  GamePhase `json:"phase"`
+	Kind   string    `json:"kind"`
+	Actor  string    `json:"actor,omitempty"`
+	Target string    `json:"target,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// maxArchivedGames bounds how many finished games are kept for replay.
+const maxArchivedGames = 200
+
+// gameArchive keeps the most recent finished games in memory.
+type gameArchive struct {
+	mu    sync.RWMutex
+	games map[string]*GameLog
+	order []string
+}
+
+func newGameArchive() *gameArchive {
+	return &gameArchive{games: make(map[string]*GameLog)}
+}
+
+func (a *gameArchive) add(g *GameLog) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.games[g.ID] = g
+	a.order = append(a.order, g.ID)
+	if len(a.order) > maxArchivedGames {
+		delete(a.games, a.order[0])
+		a.order = a.order[1:]
+	}
+}
+
+func (a *gameArchive) get(id string) *GameLog {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.games[id]
+}
+
+// recent returns up to n finished games, newest first.
+func (a *gameArchive) recent(n int) []*GameLog {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	out := make([]*GameLog, 0, n)
+	for i := len(a.order) - 1; i >= 0 && len(out) < n; i-- {
+		out = append(out, a.games[a.order[i]])
+	}
+	return out
+}
+
+// beginLog starts the log of the game that was just dealt.
+func (r *Room) beginLog() {
+	var raw [8]byte
+	_, _ = rand.Read(raw[:])
+	g := &GameLog{ID: hex.EncodeToString(raw[:]), Room: r.name, Rules: r.rules.Name, Started: time.Now()}
+	for name, job := range r.state.Assign {
+		rated, bot := false, false
+		if cl := r.players[name]; cl != nil {
+			rated, bot = cl.registered, cl.bot != nil
+		}
+		g.Players = append(g.Players, PlayerRecord{Name: name, Role: job.Name, Team: string(job.Team), Rated: rated, Bot: bot})
+	}
+	sort.Slice(g.Players, func(i, j int) bool { return g.Players[i].Name < g.Players[j].Name })
+	r.state.Log = g
+}
+
+// record appends an event to the running game's log.
+func (r *Room) record(kind, actor, target, detail string) {
+	g := r.state.Log
+	if g == nil {
+		return
+	}
+	g.Events = append(g.Events, GameEvent{
+		Seq:    len(g.Events) + 1,
+		At:     time.Now(),
+		Day:    r.state.DayCount,
+		Phase:  r.state.Phase,
+		Kind:   kind,
+		Actor:  actor,
+		Target: target,
+		Detail: detail,
+	})
+}
+
+// archiveLog closes the running log and hands it to the archive. It returns
+// the log, or nil when no game was logged.
+func (r *Room) archiveLog(winners []string) *GameLog {
+	g := r.state.Log
+	if g == nil {
+		return nil
+	}
+	r.record("game_over", "", "", strings.Join(winners, ", "))
+	g.Ended = time.Now()
+	g.Winners = winners
+	for i := range g.Players {
+		p := &g.Players[i]
+		if job := r.state.Assign[p.Name]; job != nil {
+			p.FinalTeam = string(job.Team)
+		}
+		p.Survived = r.state.Alive[p.Name]
+	}
+	r.state.Log = nil
+	r.manager.games.add(g)
+	return g
+}
+
+// handleGames lists recently finished games.
+//
+//	GET /api/games
+func (s *HTTPServer) handleGames(w http.ResponseWriter, _ *http.Request) {
+	type summary struct {
+		ID      string    `json:"id"`
+		Room    string    `json:"room"`
+		Ended   time.Time `json:"ended"`
+		Winners []string  `json:"winners"`
+	}
+	games := s.mgr.games.recent(50)
+	out := make([]summary, 0, len(games))
+	for _, g := range games {
+		out = append(out, summary{ID: g.ID, Room: g.Room, Ended: g.Ended, Winners: g.Winners})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+// handleReplay serves the full log of a finished game.
+//
+//	GET /api/games/{id}/replay
+func (s *HTTPServer) handleReplay(w http.ResponseWriter, r *http.Request) {
+	g := s.mgr.games.get(r.PathValue("id"))
+	if g == nil {
+		http.Error(w, "game not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(g)
+}
@@ -9,16 +9,9 @@ import (
 	"strings"
 	"time"
 
-	"github.com/gosuda/portal-toys/mafia/jobs"
-)
-
-var rng = rand.New(rand.NewSource(time.Now().UnixNano()))
+	"github.com/rs/zerolog/log"
 
-const (
-	nightDuration   = 25 * time.Second
-	dayDuration     = 40 * time.Second
-	voteDuration    = 15 * time.Second
-	defenseDuration = 10 * time.Second
+	"github.com/gosuda/portal-toys/mafia/jobs"
 )
 
 type GamePhase string
@@ -38,6 +31,15 @@ type Room struct {
 	players map[string]*Client
 	order   []string
 	host    string
+	rules   *Rules
+	// away holds the grace timers of seated players whose connection
+	// dropped; their *Client stays in players, closed, until they resume.
+	away map[string]*time.Timer
+	// spectators watch read-only and get public events only, after
+	// rules.SpectatorDelay.
+	spectators map[*Client]bool
+	specQueue  []delayedEvent
+	specTimer  *time.Timer
 
 	commands chan func(*Room)
 	closing  chan struct{}
@@ -47,6 +49,14 @@ type Room struct {
 	phaseTimer   *time.Timer
 	phaseTimerFn func(*Room)
 	phaseEndsAt  time.Time
+	// phaseSeq counts phases so a bot's delayed turn can tell it is stale.
+	phaseSeq int
+
+	rand *rand.Rand
+	// simulate runs a headless bot-only game: bots act as soon as a phase
+	// begins and the phase ends right after, with no timers.
+	simulate bool
+	onFinish func(*GameLog)
 }
 
 type GameState struct {
@@ -62,6 +72,10 @@ type GameState struct {
 	VoteUsed     map[string]int
 	NightTargets map[string]string
 	Execution    *ExecutionState
+	Runoff       []string
+	Private      map[string][]ServerEvent
+	GhostChat    []ServerEvent // dead players' chat, shown to the rest after the game
+	Log          *GameLog
 	Meta         map[string]string
 }
 
@@ -77,20 +91,27 @@ type ExecutionState struct {
 	Agree  int
 	Oppose int
 	Voted  map[string]bool
+	Voting bool // the defense is over and the agree/oppose vote is open
 }
 
 type RosterState struct {
-	Players []string `json:"players"`
-	Host    string   `json:"host"`
+	Players    []string `json:"players"`
+	Host       string   `json:"host"`
+	Spectators int      `json:"spectators"`
+	Bots       []string `json:"bots,omitempty"`
 }
 
 func NewRoom(name string, mgr *RoomManager) *Room {
 	r := &Room{
-		name:     name,
-		manager:  mgr,
-		players:  make(map[string]*Client),
-		commands: make(chan func(*Room), 256),
-		closing:  make(chan struct{}),
+		name:       name,
+		manager:    mgr,
+		rules:      mgr.rules.Default(),
+		players:    make(map[string]*Client),
+		away:       make(map[string]*time.Timer),
+		spectators: make(map[*Client]bool),
+		commands:   make(chan func(*Room), 256),
+		closing:    make(chan struct{}),
+		rand:       rand.New(rand.NewSource(rand.Int63())),
 	}
 	r.state.Reset()
 	go r.loop()
@@ -111,6 +132,10 @@ func (gs *GameState) Reset() {
 	gs.VoteUsed = make(map[string]int)
 	gs.NightTargets = make(map[string]string)
 	gs.Execution = nil
+	gs.Runoff = nil
+	gs.Private = make(map[string][]ServerEvent)
+	gs.GhostChat = nil
+	gs.Log = nil
 }
 
 func (r *Room) loop() {
@@ -122,6 +147,12 @@ func (r *Room) loop() {
 			if r.phaseTimer != nil {
 				r.phaseTimer.Stop()
 			}
+			for _, t := range r.away {
+				t.Stop()
+			}
+			if r.specTimer != nil {
+				r.specTimer.Stop()
+			}
 			return
 		}
 	}
@@ -154,17 +185,84 @@ func (r *Room) addPlayer(c *Client) {
 	r.state.Prefix[c.name] = make(map[string]string)
 	r.broadcast(ServerEvent{Type: EventTypeLog, Room: r.name, Body: fmt.Sprintf("[ %s ] 방에 %s 님이 입장했습니다. (인원 %d명)", r.name, c.name, len(r.players))})
 	r.pushRoster()
+	c.push(ServerEvent{Type: EventTypeSession, Room: r.name, Body: c.session})
+	c.pushSystem(fmt.Sprintf("현재 게임 규칙: %s (%s)", r.rules.Name, r.rules.summary()))
 	if r.state.Active && !r.state.Alive[c.name] {
 		c.pushSystem("진행 중인 게임이 있어 관전자 상태입니다.")
 	}
 }
 
+// dropPlayer holds c's seat after its connection closed. Players are
+// removed at once when there is no grace period.
+func (r *Room) dropPlayer(c *Client) {
+	if r.players[c.name] != c {
+		// already removed, or the seat was resumed by a newer connection
+		return
+	}
+	grace := r.manager.grace
+	if grace <= 0 {
+		r.removePlayer(c)
+		return
+	}
+	r.broadcast(ServerEvent{Type: EventTypeLog, Room: r.name, Body: fmt.Sprintf("%s 님의 연결이 끊겼습니다. %.0f초 동안 재접속을 기다립니다.", c.name, grace.Seconds())})
+	r.away[c.name] = time.AfterFunc(grace, func() {
+		r.enqueue(func(room *Room) {
+			if room.players[c.name] == c {
+				room.removePlayer(c)
+			}
+		})
+	})
+}
+
+// resumePlayer gives c the seat held under its name and replays the
+// player's state.
+func (r *Room) resumePlayer(c *Client) {
+	old, ok := r.players[c.name]
+	if !ok {
+		c.pushSystem("세션이 만료되었습니다. 다시 입장해 주세요.")
+		c.close()
+		return
+	}
+	if t := r.away[c.name]; t != nil {
+		t.Stop()
+		delete(r.away, c.name)
+	}
+	c.room = r
+	r.players[c.name] = c
+	// Close a connection the new one replaced before it was noticed dead;
+	// with room cleared it will not detach the seat.
+	old.room = nil
+	old.close()
+	r.broadcast(ServerEvent{Type: EventTypeLog, Room: r.name, Body: fmt.Sprintf("%s 님이 다시 연결되었습니다.", c.name)})
+	r.pushRoster()
+	c.push(ServerEvent{Type: EventTypeSession, Room: r.name, Body: c.session})
+	r.sendState(c)
+}
+
 func (r *Room) removePlayer(c *Client) {
+	if t := r.away[c.name]; t != nil {
+		t.Stop()
+		delete(r.away, c.name)
+	}
+	r.manager.forget(c.name)
 	delete(r.players, c.name)
+	if !r.simulate && r.onlyBots() {
+		// bots do not keep a room open on their own
+		for name, bot := range r.players {
+			r.manager.forget(name)
+			delete(r.players, name)
+			bot.room = nil
+			bot.close()
+		}
+	}
 	r.broadcast(ServerEvent{Type: EventTypeLog, Room: r.name, Body: fmt.Sprintf("%s 님이 퇴장했습니다.", c.name)})
 	r.pushRoster()
 	if len(r.players) == 0 {
 		r.manager.removeRoom(r.name, r)
+		for sp := range r.spectators {
+			sp.pushSystem("방이 닫혔습니다.")
+			sp.close()
+		}
 		r.close()
 		return
 	}
@@ -173,15 +271,61 @@ func (r *Room) removePlayer(c *Client) {
 		r.broadcast(ServerEvent{Type: EventTypeLog, Room: r.name, Body: fmt.Sprintf("방장이 %s 님으로 변경되었습니다.", r.host)})
 	}
 	if r.state.Active && r.state.Alive[c.name] {
+		r.record("left", c.name, "", "")
 		delete(r.state.Alive, c.name)
 		r.checkGameOver()
 	}
 	c.room = nil
 }
 
+func (r *Room) addSpectator(c *Client) {
+	if c.name != spectatorName && r.state.Assign[c.name] != nil {
+		// a player who left the game keeps their name in it
+		c.pushSystem(errSpectatorName.Error())
+		c.close()
+		return
+	}
+	r.spectators[c] = true
+	msg := "관전 모드입니다. 게임에는 참여할 수 없고 관전자 채팅만 가능합니다."
+	if d := time.Duration(r.rules.SpectatorDelay); d > 0 {
+		msg += fmt.Sprintf(" 게임 진행은 %s 늦게 표시됩니다.", d)
+	}
+	c.push(ServerEvent{Type: EventTypeLog, Room: r.name, Body: msg})
+	if r.rules.SpectatorDelay > 0 {
+		c.push(r.rosterEvent())
+	}
+	r.pushRoster()
+	r.sendSpectatorState(c)
+}
+
+func (r *Room) removeSpectator(c *Client) {
+	if !r.spectators[c] {
+		return
+	}
+	delete(r.spectators, c)
+	r.pushRoster()
+}
+
+// handleSpectatorMessage serves the few requests a spectator may make.
+func (r *Room) handleSpectatorMessage(c *Client, msg ClientMessage) {
+	if !r.spectators[c] {
+		return
+	}
+	switch msg.Type {
+	case "chat":
+		if text := strings.TrimSpace(msg.Text); text != "" {
+			r.spectatorChat(c, text)
+		}
+	case "sync":
+		r.sendSpectatorState(c)
+	default:
+		c.pushSystem("관전자는 게임에 참여할 수 없습니다.")
+	}
+}
+
 func (r *Room) pickNextHost() string {
 	for _, name := range r.order {
-		if _, ok := r.players[name]; ok {
+		if cl, ok := r.players[name]; ok && cl.bot == nil {
 			return name
 		}
 	}
@@ -192,6 +336,9 @@ func (r *Room) pickNextHost() string {
 }
 
 func (r *Room) handleMessage(c *Client, msg ClientMessage) {
+	if r.players[c.name] != c {
+		return
+	}
 	switch msg.Type {
 	case "chat":
 		r.handleChat(c, msg.Text)
@@ -225,6 +372,11 @@ func (r *Room) handleChat(c *Client, text string) {
 		r.broadcast(ServerEvent{Type: EventTypeChat, Room: r.name, Author: c.name, Body: text})
 		return
 	}
+	if !r.state.Alive[c.name] {
+		// the dead and late joiners talk among spectators
+		r.spectatorChat(c, text)
+		return
+	}
 	phase := r.state.Phase
 	switch phase {
 	case PhaseDay, PhaseVote, PhaseDefense:
@@ -235,9 +387,12 @@ func (r *Room) handleChat(c *Client, text string) {
 			c.pushSystem("밤에는 관전자입니다.")
 			return
 		}
-		if job.Team == jobs.TeamMafia {
+		switch job.Team {
+		case jobs.TeamMafia:
 			r.broadcastTeam(jobs.TeamMafia, ServerEvent{Type: EventTypeChat, Room: r.name, Author: c.name, Body: fmt.Sprintf("[마피아] %s", text)})
-		} else {
+		case jobs.TeamSect:
+			r.broadcastTeam(jobs.TeamSect, ServerEvent{Type: EventTypeChat, Room: r.name, Author: c.name, Body: fmt.Sprintf("[교주] %s", text)})
+		default:
 			c.pushSystem("밤에는 채팅이 제한됩니다.")
 		}
 	default:
@@ -272,7 +427,9 @@ func (r *Room) handleNightAction(c *Client, target string) {
 
 	if err := job.NightAction(ctx); err != nil {
 		c.pushSystem(err.Error())
+		return
 	}
+	r.record("night_action", c.name, target, job.Name())
 }
 
 func (r *Room) handleVote(c *Client, target string) {
@@ -288,6 +445,10 @@ func (r *Room) handleVote(c *Client, target string) {
 		c.pushSystem("대상은 생존 중인 플레이어가 아닙니다.")
 		return
 	}
+	if len(r.state.Runoff) > 0 && !contains(r.state.Runoff, target) {
+		c.pushSystem(fmt.Sprintf("결선 투표 대상이 아닙니다: %s", strings.Join(r.state.Runoff, ", ")))
+		return
+	}
 	if r.state.Vote == nil {
 		r.state.Vote = make(map[string]int)
 	}
@@ -304,6 +465,7 @@ func (r *Room) handleVote(c *Client, target string) {
 	}
 	r.state.VoteUsed[c.name] = dayIndex
 	r.state.Vote[target]++
+	r.record("vote", c.name, target, "")
 	if job := r.state.Runtime[c.name]; job != nil {
 		ctx := &jobs.VoteContext{Room: r.jobAdapter(), Actor: c.name, Target: target, Meta: r.state.Meta}
 		job.OnVote(ctx)
@@ -321,8 +483,8 @@ func (r *Room) startGame() {
 		r.broadcast(ServerEvent{Type: EventTypeLog, Room: r.name, Body: "이미 게임이 진행 중입니다."})
 		return
 	}
-	if len(r.players) < 4 {
-		r.broadcast(ServerEvent{Type: EventTypeLog, Room: r.name, Body: "게임을 시작하려면 최소 4명이 필요합니다."})
+	if len(r.players) < r.rules.MinPlayers {
+		r.broadcast(ServerEvent{Type: EventTypeLog, Room: r.name, Body: fmt.Sprintf("게임을 시작하려면 최소 %d명이 필요합니다.", r.rules.MinPlayers)})
 		return
 	}
 	r.state.Reset()
@@ -335,14 +497,15 @@ func (r *Room) startGame() {
 		r.state.Alive[name] = true
 	}
 	r.assignRoles(names)
+	r.beginLog()
 	r.broadcast(ServerEvent{Type: EventTypeLog, Room: r.name, Body: "게임이 시작되었습니다. 첫 번째 밤이 시작됩니다."})
 	r.beginNight()
 }
 
 func (r *Room) assignRoles(players []string) {
-	rng.Shuffle(len(players), func(i, j int) { players[i], players[j] = players[j], players[i] })
-	jobQueue := buildRoleQueue(len(players))
-	rng.Shuffle(len(jobQueue), func(i, j int) { jobQueue[i], jobQueue[j] = jobQueue[j], jobQueue[i] })
+	r.rand.Shuffle(len(players), func(i, j int) { players[i], players[j] = players[j], players[i] })
+	jobQueue := r.rules.roleQueue(len(players))
+	r.rand.Shuffle(len(jobQueue), func(i, j int) { jobQueue[i], jobQueue[j] = jobQueue[j], jobQueue[i] })
 	for idx, player := range players {
 		role := jobQueue[idx]
 		spec := defaultJobs[role]
@@ -354,12 +517,13 @@ func (r *Room) assignRoles(players []string) {
 		if spec.Team == jobs.TeamMafia {
 			r.state.Prefix[player][player] = spec.Name
 		}
-		r.players[player].push(ServerEvent{Type: EventTypeRole, Room: r.name, Body: fmt.Sprintf("당신의 직업은 %s 입니다. %s", spec.Name, spec.Desc)})
+		r.pushPrivate(player, ServerEvent{Type: EventTypeRole, Room: r.name, Body: fmt.Sprintf("당신의 직업은 %s 입니다. %s", spec.Name, spec.Desc)})
 	}
 }
 
 func (r *Room) beginNight() {
 	r.state.Phase = PhaseNight
+	r.state.Runoff = nil
 	if r.state.NightTargets == nil {
 		r.state.NightTargets = make(map[string]string)
 	} else {
@@ -372,8 +536,8 @@ func (r *Room) beginNight() {
 		r.state.Meta = make(map[string]string)
 	}
 	r.state.Meta["night_counter"] = nightIndex
-	r.broadcast(ServerEvent{Type: EventTypePhase, Room: r.name, Phase: string(r.state.Phase), Body: fmt.Sprintf("%d번째 밤이 시작되었습니다.", r.state.DayCount+1)})
-	r.setPhaseTimer(nightDuration, func(room *Room) {
+	r.broadcastPhase(fmt.Sprintf("%d번째 밤이 시작되었습니다.", r.state.DayCount+1), r.rules.Phases.Night)
+	r.setPhaseTimer(time.Duration(r.rules.Phases.Night), func(room *Room) {
 		room.resolveNight()
 	})
 }
@@ -383,12 +547,18 @@ func (r *Room) resolveNight() {
 	saved := r.state.NightTargets["doctor"]
 
 	if target != "" && target == saved {
+		r.record("saved", "", target, "")
 		r.broadcast(ServerEvent{Type: EventTypeLog, Room: r.name, Body: fmt.Sprintf("의사가 %s 님을 치료했습니다.", target)})
 	} else if target != "" {
 		r.eliminate(target, "마피아에게 살해당했습니다.", "mafia")
 	} else {
 		r.broadcast(ServerEvent{Type: EventTypeLog, Room: r.name, Body: "아무 일도 일어나지 않았습니다."})
 	}
+	for _, name := range r.order {
+		if job := r.state.Runtime[name]; job != nil && r.state.Alive[name] {
+			job.OnNightResolved(&jobs.NightResultContext{Room: r.jobAdapter(), Actor: name, Meta: r.state.Meta})
+		}
+	}
 
 	r.checkGameOver()
 	if !r.state.Active {
@@ -402,8 +572,8 @@ func (r *Room) beginDay() {
 	r.state.DayCount++
 	r.state.Vote = make(map[string]int)
 	r.state.VoteUsed = make(map[string]int)
-	r.broadcast(ServerEvent{Type: EventTypePhase, Room: r.name, Phase: string(r.state.Phase), Body: fmt.Sprintf("%d번째 낮이 시작되었습니다. 토론 후 투표가 진행됩니다.", r.state.DayCount)})
-	r.setPhaseTimer(dayDuration, func(room *Room) {
+	r.broadcastPhase(fmt.Sprintf("%d번째 낮이 시작되었습니다. 토론 후 투표가 진행됩니다.", r.state.DayCount), r.rules.Phases.Day)
+	r.setPhaseTimer(time.Duration(r.rules.Phases.Day), func(room *Room) {
 		room.beginVote()
 	})
 }
@@ -411,8 +581,12 @@ func (r *Room) beginDay() {
 func (r *Room) beginVote() {
 	r.state.Phase = PhaseVote
 	r.state.Vote = make(map[string]int)
-	r.broadcast(ServerEvent{Type: EventTypePhase, Room: r.name, Phase: string(r.state.Phase), Body: "투표 시간이 시작되었습니다. /vote 명령으로 대상 입력"})
-	r.setPhaseTimer(voteDuration, func(room *Room) {
+	body := "투표 시간이 시작되었습니다. /vote 명령으로 대상 입력"
+	if len(r.state.Runoff) > 0 {
+		body = fmt.Sprintf("결선 투표가 시작되었습니다. 대상: %s", strings.Join(r.state.Runoff, ", "))
+	}
+	r.broadcastPhase(body, r.rules.Phases.Vote)
+	r.setPhaseTimer(time.Duration(r.rules.Phases.Vote), func(room *Room) {
 		room.resolveVote()
 	})
 }
@@ -434,20 +608,36 @@ func (r *Room) resolveVote() {
 		}
 	}
 	sort.Strings(winners)
-	if len(winners) != 1 {
-		r.broadcast(ServerEvent{Type: EventTypeLog, Room: r.name, Body: "표가 동률이라 밤으로 넘어갑니다."})
-		r.beginNight()
+	if len(winners) == 1 {
+		r.beginDefense(winners[0])
+		return
+	}
+	r.record("tie", "", "", strings.Join(winners, ", "))
+	switch r.rules.TieBreak {
+	case TieBreakRandom:
+		target := winners[r.rand.Intn(len(winners))]
+		r.broadcast(ServerEvent{Type: EventTypeLog, Room: r.name, Body: fmt.Sprintf("표가 동률이라 %s 님이 무작위로 지목되었습니다.", target)})
+		r.beginDefense(target)
 		return
+	case TieBreakRevote:
+		if len(r.state.Runoff) == 0 {
+			r.state.Runoff = winners
+			r.state.VoteUsed = make(map[string]int)
+			r.beginVote()
+			return
+		}
 	}
-	target := winners[0]
-	r.beginDefense(target)
+	r.broadcast(ServerEvent{Type: EventTypeLog, Room: r.name, Body: "표가 동률이라 밤으로 넘어갑니다."})
+	r.beginNight()
 }
 
 func (r *Room) beginDefense(target string) {
 	r.state.Phase = PhaseDefense
+	r.state.Runoff = nil
 	r.state.Execution = &ExecutionState{Target: target, Voted: make(map[string]bool)}
-	r.broadcast(ServerEvent{Type: EventTypePhase, Room: r.name, Phase: string(r.state.Phase), Body: fmt.Sprintf("%s 님의 최후 변론 시간입니다.", target)})
-	r.setPhaseTimer(defenseDuration, func(room *Room) {
+	r.record("nomination", "", target, "")
+	r.broadcastPhase(fmt.Sprintf("%s 님의 최후 변론 시간입니다.", target), r.rules.Phases.Defense)
+	r.setPhaseTimer(time.Duration(r.rules.Phases.Defense), func(room *Room) {
 		room.beginExecutionVote()
 	})
 }
@@ -457,8 +647,9 @@ func (r *Room) beginExecutionVote() {
 		r.beginNight()
 		return
 	}
+	r.state.Execution.Voting = true
 	r.broadcast(ServerEvent{Type: EventTypeLog, Room: r.name, Body: fmt.Sprintf("%s 님을 처형할지 agree/oppose 로 투표해 주세요.", r.state.Execution.Target)})
-	r.setPhaseTimer(defenseDuration, func(room *Room) {
+	r.setPhaseTimer(time.Duration(r.rules.Phases.Execution), func(room *Room) {
 		room.resolveDefense()
 	})
 }
@@ -470,43 +661,68 @@ func (r *Room) eliminate(name, reason, cause string) {
 	if job := r.state.Runtime[name]; job != nil {
 		ctx := &jobs.DeathContext{Room: r.jobAdapter(), Victim: name, Cause: reason, CauseType: cause, Meta: r.state.Meta}
 		if job.OnDeath(ctx) {
+			r.record("death_intercepted", "", name, job.Name())
 			return
 		}
 	}
 	delete(r.state.Alive, name)
+	r.record("elimination", "", name, cause)
 	r.broadcast(ServerEvent{
 		Type: EventTypeLog,
 		Room: r.name,
 		Body: fmt.Sprintf("%s %s", name, reason),
 	})
+	if job := r.state.Assign[name]; job != nil && r.rules.RevealOnDeath {
+		r.broadcast(ServerEvent{Type: EventTypeLog, Room: r.name, Body: fmt.Sprintf("%s 님의 직업은 %s 였습니다.", name, job.Name)})
+	}
 }
 
+// checkGameOver asks every player's job whether it has won and ends the
+// game if any has. Team wins are announced once per team, neutral wins per
+// player.
 func (r *Room) checkGameOver() {
-	mafiaAlive := 0
-	citizenAlive := 0
+	alive := make(map[jobs.Team]int)
 	for name := range r.state.Alive {
-		job := r.state.Assign[name]
-		if job == nil {
-			continue
+		if job := r.state.Assign[name]; job != nil {
+			alive[job.Team]++
 		}
-		if job.Team == jobs.TeamMafia {
-			mafiaAlive++
-		} else {
-			citizenAlive++
+	}
+	winners := make(map[jobs.Team][]string)
+	var all []string
+	for name, job := range r.state.Runtime {
+		assigned := r.state.Assign[name]
+		ctx := &jobs.WinContext{Room: r.jobAdapter(), Player: name, Team: assigned.Team, Alive: alive, Meta: r.state.Meta}
+		if job.CheckWin(ctx) {
+			// a neutral role wins alone even if it was moved to a team
+			team := assigned.Team
+			if job.Team() == jobs.TeamNeutral {
+				team = jobs.TeamNeutral
+			}
+			winners[team] = append(winners[team], name)
+			all = append(all, name)
 		}
 	}
-	if mafiaAlive == 0 {
-		r.broadcast(ServerEvent{Type: EventTypeLog, Room: r.name, Body: "시민 팀이 승리했습니다!"})
-		r.finishGame()
+	if len(winners) == 0 {
 		return
 	}
-	if mafiaAlive >= citizenAlive {
-		r.broadcast(ServerEvent{Type: EventTypeLog, Room: r.name, Body: "마피아 팀이 승리했습니다!"})
-		r.finishGame()
+	for _, team := range []jobs.Team{jobs.TeamCitizen, jobs.TeamMafia, jobs.TeamSect} {
+		if len(winners[team]) > 0 {
+			r.broadcast(ServerEvent{Type: EventTypeLog, Room: r.name, Body: fmt.Sprintf("%s 팀이 승리했습니다!", teamNames[team])})
+		}
 	}
+	neutral := winners[jobs.TeamNeutral]
+	sort.Strings(neutral)
+	for _, name := range neutral {
+		r.broadcast(ServerEvent{Type: EventTypeLog, Room: r.name, Body: fmt.Sprintf("%s 님(%s)이 승리했습니다!", name, r.state.Assign[name].Name)})
+	}
+	sort.Strings(all)
+	r.finishGame(all)
 }
 
-func (r *Room) finishGame() {
+// finishGame ends the game with the given winners, none if it was called
+// off, and archives its log.
+func (r *Room) finishGame(winners []string) {
+	g := r.archiveLog(winners)
 	r.state.Active = false
 	r.state.Phase = PhaseLobby
 	r.state.Vote = nil
@@ -518,12 +734,34 @@ func (r *Room) finishGame() {
 	r.phaseTimerFn = nil
 	r.phaseEndsAt = time.Time{}
 	r.broadcastRoles()
+	for _, ev := range r.state.GhostChat {
+		for name, cl := range r.players {
+			if r.state.Assign[name] == nil {
+				cl.push(ev)
+			}
+		}
+		r.spectate(ev)
+	}
+	r.state.GhostChat = nil
+	if g != nil {
+		if err := r.manager.stats.RecordGame(g); err != nil {
+			log.Error().Err(err).Str("game", g.ID).Msg("[mafia] record stats")
+		}
+		r.broadcast(ServerEvent{Type: EventTypeGameOver, Room: r.name, Body: g.ID})
+		if r.onFinish != nil {
+			r.onFinish(g)
+		}
+	}
 }
 
 func (r *Room) broadcastRoles() {
 	arr := make([]string, 0, len(r.state.Assign))
 	for name, job := range r.state.Assign {
-		arr = append(arr, fmt.Sprintf("%s => %s", name, job.Name))
+		entry := fmt.Sprintf("%s => %s", name, job.Name)
+		if job.Team != defaultJobs[job.Name].Team {
+			entry += fmt.Sprintf("(%s 팀)", teamNames[job.Team])
+		}
+		arr = append(arr, entry)
 	}
 	sort.Strings(arr)
 	r.broadcast(ServerEvent{Type: EventTypeLog, Room: r.name, Body: "직업 공개: " + strings.Join(arr, ", ")})
@@ -551,10 +789,12 @@ func (r *Room) handleDecision(c *Client, text string) {
 	case "agree", "찬성":
 		exec.Agree++
 		exec.Voted[c.name] = true
+		r.record("execution_vote", c.name, exec.Target, "agree")
 		c.pushSystem("찬성하였습니다.")
 	case "oppose", "반대":
 		exec.Oppose++
 		exec.Voted[c.name] = true
+		r.record("execution_vote", c.name, exec.Target, "oppose")
 		c.pushSystem("반대하였습니다.")
 	default:
 		c.pushSystem("agree/oppose 로 입력해 주세요.")
@@ -584,37 +824,168 @@ func (r *Room) broadcast(ev ServerEvent) {
 	for _, cl := range r.players {
 		cl.push(ev)
 	}
+	r.spectate(ev)
+}
+
+// spectate relays a public event to spectators after the spectator delay.
+func (r *Room) spectate(ev ServerEvent) {
+	if len(r.spectators) == 0 {
+		return
+	}
+	r.afterSpectatorDelay(func(room *Room) {
+		for sp := range room.spectators {
+			sp.push(ev)
+		}
+	})
+}
+
+// sendSpectatorState shows c the game as it is now, once the delay has
+// passed.
+func (r *Room) sendSpectatorState(c *Client) {
+	ev := r.publicState()
+	r.afterSpectatorDelay(func(room *Room) {
+		if room.spectators[c] {
+			c.push(ev)
+		}
+	})
+}
+
+// delayedEvent is spectator work waiting out the delay.
+type delayedEvent struct {
+	due time.Time
+	fn  func(*Room)
+}
+
+// afterSpectatorDelay runs fn on the room loop once the spectator delay has
+// passed. Work runs in the order it was queued.
+func (r *Room) afterSpectatorDelay(fn func(*Room)) {
+	delay := time.Duration(r.rules.SpectatorDelay)
+	if delay <= 0 && len(r.specQueue) == 0 {
+		fn(r)
+		return
+	}
+	r.specQueue = append(r.specQueue, delayedEvent{due: time.Now().Add(delay), fn: fn})
+	if r.specTimer == nil {
+		r.specTimer = time.AfterFunc(delay, func() {
+			r.enqueue(func(room *Room) { room.flushSpectators() })
+		})
+	}
+}
+
+func (r *Room) flushSpectators() {
+	now := time.Now()
+	for len(r.specQueue) > 0 && !r.specQueue[0].due.After(now) {
+		next := r.specQueue[0]
+		r.specQueue = r.specQueue[1:]
+		next.fn(r)
+	}
+	r.specTimer = nil
+	if len(r.specQueue) > 0 {
+		r.specTimer = time.AfterFunc(time.Until(r.specQueue[0].due), func() {
+			r.enqueue(func(room *Room) { room.flushSpectators() })
+		})
+	}
+}
+
+// spectatorChat delivers c's chat line to players who are not alive in the
+// current game and, after the usual delay, to spectators. Living players
+// never see it. While a game runs, the dead players' own lines stay among
+// the dead players of that game until it ends: spectators are anonymous, so
+// a living player could otherwise read them from a second tab. Only the
+// seated client counts as a dead player, never a spectator sharing its name.
+func (r *Room) spectatorChat(c *Client, text string) {
+	ev := ServerEvent{Type: EventTypeChat, Room: r.name, Author: c.name, Body: "[관전] " + text}
+	if r.state.Active && r.players[c.name] == c && r.state.Assign[c.name] != nil {
+		for name, cl := range r.players {
+			if r.state.Assign[name] != nil && !r.state.Alive[name] {
+				cl.push(ev)
+			}
+		}
+		r.state.GhostChat = append(r.state.GhostChat, ev)
+		return
+	}
+	for name, cl := range r.players {
+		if !r.state.Alive[name] {
+			cl.push(ev)
+		}
+	}
+	r.spectate(ev)
+}
+
+// broadcastPhase announces the current phase and how long it lasts so
+// clients can run their countdown.
+func (r *Room) broadcastPhase(body string, d Duration) {
+	r.record("phase", "", "", body)
+	state := map[string]interface{}{"duration": time.Duration(d).Seconds()}
+	r.broadcast(ServerEvent{Type: EventTypePhase, Room: r.name, Phase: string(r.state.Phase), Body: body, State: state})
 }
 
 func (r *Room) broadcastTeam(team jobs.Team, ev ServerEvent) {
 	for name := range r.state.Assign {
 		job := r.state.Assign[name]
 		if job != nil && job.Team == team {
-			if cl, ok := r.players[name]; ok {
-				cl.push(ev)
-			}
+			r.pushPrivate(name, ev)
 		}
 	}
 }
 
+// pushPrivate sends ev to one player and, during a game, keeps it so
+// sendState can replay it after a reconnect.
+func (r *Room) pushPrivate(name string, ev ServerEvent) {
+	if r.state.Active {
+		r.state.Private[name] = append(r.state.Private[name], ev)
+	}
+	if cl, ok := r.players[name]; ok {
+		cl.push(ev)
+	}
+}
+
 func (r *Room) pushRoster() {
+	r.broadcast(r.rosterEvent())
+}
+
+func (r *Room) rosterEvent() ServerEvent {
 	order := make([]string, 0, len(r.players))
 	for _, name := range r.order {
 		if _, ok := r.players[name]; ok {
 			order = append(order, name)
 		}
 	}
-	state := RosterState{Players: order, Host: r.host}
-	r.broadcast(ServerEvent{Type: EventTypeRoster, Room: r.name, State: state})
+	state := RosterState{Players: order, Host: r.host, Spectators: len(r.spectators)}
+	for _, name := range order {
+		if r.players[name].bot != nil {
+			state.Bots = append(state.Bots, name)
+		}
+	}
+	return ServerEvent{Type: EventTypeRoster, Room: r.name, State: state}
 }
 
+// sendState pushes a snapshot of the game to c, followed by everything sent
+// privately to its player this game: role, team chat and night results.
 func (r *Room) sendState(c *Client) {
+	c.push(r.publicState())
+	for _, ev := range r.state.Private[c.name] {
+		c.push(ev)
+	}
+}
+
+func (r *Room) publicState() ServerEvent {
+	alive := make([]string, 0, len(r.state.Alive))
+	for name := range r.state.Alive {
+		alive = append(alive, name)
+	}
+	sort.Strings(alive)
 	snapshot := map[string]interface{}{
 		"phase":  r.state.Phase,
 		"active": r.state.Active,
 		"day":    r.state.DayCount,
+		"rules":  r.rules.Name,
+		"alive":  alive,
 	}
-	c.push(ServerEvent{Type: EventTypeState, Room: r.name, State: snapshot})
+	if !r.phaseEndsAt.IsZero() {
+		snapshot["remaining"] = time.Until(r.phaseEndsAt).Seconds()
+	}
+	return ServerEvent{Type: EventTypeState, Room: r.name, State: snapshot}
 }
 
 func (r *Room) handleAdmin(c *Client, msg ClientMessage) {
@@ -636,14 +1007,35 @@ func (r *Room) handleAdmin(c *Client, msg ClientMessage) {
 		}
 		if victim, ok := r.players[target]; ok {
 			victim.pushSystem("방장에 의해 강퇴되었습니다.")
+			r.removePlayer(victim)
 			victim.close()
 			r.broadcast(ServerEvent{Type: EventTypeLog, Room: r.name, Body: fmt.Sprintf("%s 님이 강퇴되었습니다.", target)})
 		} else {
 			c.pushSystem("해당 플레이어가 존재하지 않습니다.")
 		}
+	case "bot":
+		if _, err := r.addBot(target); err != nil {
+			c.pushSystem(err.Error())
+		}
+	case "rules":
+		if target == "" {
+			c.pushSystem(fmt.Sprintf("현재 규칙: %s. 사용 가능한 규칙: %s", r.rules.Name, strings.Join(r.manager.rules.Names(), ", ")))
+			return
+		}
+		if r.state.Active {
+			c.pushSystem("게임 중에는 규칙을 바꿀 수 없습니다.")
+			return
+		}
+		rules := r.manager.rules.Get(target)
+		if rules == nil {
+			c.pushSystem(fmt.Sprintf("규칙 %s 이(가) 없습니다. 사용 가능한 규칙: %s", target, strings.Join(r.manager.rules.Names(), ", ")))
+			return
+		}
+		r.rules = rules
+		r.broadcast(ServerEvent{Type: EventTypeLog, Room: r.name, Body: fmt.Sprintf("게임 규칙이 %s(으)로 변경되었습니다. (%s)", rules.Name, rules.summary())})
 	case "end":
 		r.broadcast(ServerEvent{Type: EventTypeLog, Room: r.name, Body: "방장이 게임을 종료했습니다."})
-		r.finishGame()
+		r.finishGame(nil)
 	case "shorten-day":
 		remaining, err := r.adjustDayTimer(-10 * time.Second)
 		if err != nil {
@@ -686,11 +1078,32 @@ func (r *Room) adjustDayTimer(delta time.Duration) (time.Duration, error) {
 		newRemaining = maxRemaining
 	}
 	r.phaseTimer.Stop()
-	r.setPhaseTimer(newRemaining, r.phaseTimerFn)
+	r.armPhaseTimer(newRemaining, r.phaseTimerFn)
 	return newRemaining, nil
 }
 
+// maxSimulatedDays calls off a simulated game that stalls.
+const maxSimulatedDays = 30
+
+// setPhaseTimer starts a new phase that ends with fn after d, and lets the
+// bots act in it.
 func (r *Room) setPhaseTimer(d time.Duration, fn func(*Room)) {
+	r.phaseSeq++
+	if !r.simulate {
+		r.runBots(d)
+		r.armPhaseTimer(d, fn)
+		return
+	}
+	if r.state.DayCount > maxSimulatedDays {
+		r.finishGame(nil)
+		return
+	}
+	r.runBots(d)
+	r.phaseTimerFn = fn
+	r.enqueue(fn)
+}
+
+func (r *Room) armPhaseTimer(d time.Duration, fn func(*Room)) {
 	if r.phaseTimer != nil {
 		r.phaseTimer.Stop()
 	}
@@ -719,26 +1132,11 @@ func appendUnique(slice []string, v string) []string {
 	return append(slice, v)
 }
 
-func buildRoleQueue(count int) []string {
-	mafiaCount := 1
-	if count >= 7 {
-		mafiaCount = 2
-	}
-	queue := make([]string, 0, count)
-	for i := 0; i < mafiaCount && len(queue) < count; i++ {
-		queue = append(queue, defaultMafiaRole)
-	}
-	for _, role := range defaultRolePriority {
-		if role == defaultMafiaRole {
-			continue
-		}
-		if len(queue) >= count {
-			break
+func contains(slice []string, v string) bool {
+	for _, existing := range slice {
+		if existing == v {
+			return true
 		}
-		queue = append(queue, role)
-	}
-	for len(queue) < count {
-		queue = append(queue, defaultCitizenRole)
 	}
-	return queue
+	return false
 }
@@ -1,12 +1,19 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"sync"
+	"time"
 )
 
 var (
 	errAlreadyJoined = errors.New("player already joined another room")
+	errNoSuchRoom    = errors.New("no such room")
+	errNameTaken     = errors.New("nickname is in use in this room; reconnect with its session token")
+	errSpectatorName = errors.New("nickname belongs to a player; spectate without one or pick another")
 )
 
 // RoomManager keeps global room registry similar to mafiaList in the JS version.
@@ -14,21 +21,50 @@ type RoomManager struct {
 	mu      sync.RWMutex
 	rooms   map[string]*Room
 	players map[string]*Room
+	// sessions holds each player's resume token. A player keeps their seat
+	// for grace after their connection drops and may reclaim it by
+	// reconnecting with the token.
+	sessions map[string]string
+	grace    time.Duration
+	rules    *RuleBook
+	games    *gameArchive
+	stats    *statsStore
 }
 
-func NewRoomManager() *RoomManager {
+func NewRoomManager(rules *RuleBook, grace time.Duration, stats *statsStore) *RoomManager {
 	return &RoomManager{
-		rooms:   make(map[string]*Room),
-		players: make(map[string]*Room),
+		rules:    rules,
+		stats:    stats,
+		grace:    grace,
+		games:    newGameArchive(),
+		rooms:    make(map[string]*Room),
+		players:  make(map[string]*Room),
+		sessions: make(map[string]string),
 	}
 }
 
-func (m *RoomManager) Attach(roomName string, c *Client) error {
+// Attach seats c in the named room, or hands c an existing seat in that room
+// when token is the seat's resume token.
+func (m *RoomManager) Attach(roomName string, c *Client, token string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	if _, ok := m.players[c.name]; ok {
-		return errAlreadyJoined
+	if room, ok := m.players[c.name]; ok {
+		if room.name != roomName {
+			return errAlreadyJoined
+		}
+		if token == "" || token != m.sessions[c.name] {
+			return errNameTaken
+		}
+		c.session = token
+		room.enqueue(func(r *Room) {
+			r.resumePlayer(c)
+		})
+		return nil
 	}
+	var raw [16]byte
+	_, _ = rand.Read(raw[:])
+	c.session = hex.EncodeToString(raw[:])
+	m.sessions[c.name] = c.session
 	room, ok := m.rooms[roomName]
 	if !ok {
 		room = NewRoom(roomName, m)
@@ -41,21 +77,74 @@ func (m *RoomManager) Attach(roomName string, c *Client) error {
 	return nil
 }
 
+// AttachSpectator adds c to an existing room as a read-only spectator.
+// Spectators do not claim their name, so any number may share one, but
+// they may not borrow a player's.
+func (m *RoomManager) AttachSpectator(roomName string, c *Client) error {
+	m.mu.RLock()
+	room, ok := m.rooms[roomName]
+	_, seated := m.players[c.name]
+	m.mu.RUnlock()
+	if !ok {
+		return errNoSuchRoom
+	}
+	if seated && c.name != spectatorName {
+		return errSpectatorName
+	}
+	c.watch = room
+	room.enqueue(func(r *Room) {
+		r.addSpectator(c)
+	})
+	return nil
+}
+
+// Detach reports that c's connection is gone. The room keeps the seat for
+// the grace period; forget releases the name once the seat is given up.
 func (m *RoomManager) Detach(c *Client) {
-	m.mu.Lock()
-	room, ok := m.players[c.name]
-	if ok {
-		delete(m.players, c.name)
+	if c.watch != nil {
+		c.watch.enqueue(func(r *Room) {
+			r.removeSpectator(c)
+		})
+		return
 	}
-	m.mu.Unlock()
-	if ok {
+	m.mu.RLock()
+	room := m.players[c.name]
+	m.mu.RUnlock()
+	if room != nil {
 		room.enqueue(func(r *Room) {
-			r.removePlayer(c)
+			r.dropPlayer(c)
 		})
 	}
 }
 
+// claimBotName reserves the first free bot name for room so no player can
+// join under it.
+func (m *RoomManager) claimBotName(room *Room) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := 1; ; i++ {
+		name := fmt.Sprintf("봇%d", i)
+		if _, taken := m.players[name]; !taken {
+			m.players[name] = room
+			return name
+		}
+	}
+}
+
+func (m *RoomManager) forget(name string) {
+	m.mu.Lock()
+	delete(m.players, name)
+	delete(m.sessions, name)
+	m.mu.Unlock()
+}
+
 func (m *RoomManager) RouteMessage(c *Client, msg ClientMessage) {
+	if c.watch != nil {
+		c.watch.enqueue(func(r *Room) {
+			r.handleSpectatorMessage(c, msg)
+		})
+		return
+	}
 	m.mu.RLock()
 	room := m.players[c.name]
 	m.mu.RUnlock()
@@ -76,6 +165,7 @@ func (m *RoomManager) Close() {
 		delete(m.rooms, name)
 	}
 	m.players = make(map[string]*Room)
+	m.sessions = make(map[string]string)
 }
 
 func (m *RoomManager) removeRoom(name string, room *Room) {
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/gosuda/portal-toys/mafia/jobs"
+)
+
+// Rules describe how a game is set up and paced. The host picks one rule set
+// per room while it is in the lobby. Rule sets are loaded from a directory of
+// JSON or YAML files (--rules-dir), one set per file named after the file:
+//
+//	# quick.yaml
+//	description: 짧은 판
+//	min_players: 4
+//	setups:
+//	  - players: 4
+//	    roles: {마피아: 1, 의사: 1, 경찰: 1}
+//	  - players: 8
+//	    roles: {마피아: 2, 의사: 1, 경찰: 1, 군인: 1}
+//	phases: {night: 15s, day: 30s, vote: 10s, defense: 8s}
+//	reveal_on_death: true
+//	tie_break: revote
+//	spectator_delay: 30s
+//
+// A game uses the setup with the largest player count not above the number
+// of players, and fills the remaining seats with the filler role. Omitted
+// fields take the value of the built-in "default" set, which a file named
+// default.* replaces.
+type Rules struct {
+	Name          string         `json:"-" yaml:"-"`
+	Description   string         `json:"description,omitempty" yaml:"description"`
+	MinPlayers    int            `json:"min_players,omitempty" yaml:"min_players"`
+	Setups        []RoleSetup    `json:"setups,omitempty" yaml:"setups"`
+	Filler        string         `json:"filler,omitempty" yaml:"filler"`
+	Phases        PhaseDurations `json:"phases" yaml:"phases"`
+	RevealOnDeath bool           `json:"reveal_on_death,omitempty" yaml:"reveal_on_death"`
+	TieBreak      TieBreak       `json:"tie_break,omitempty" yaml:"tie_break"`
+	// SpectatorDelay holds back game events for spectators so they cannot
+	// relay them to players as they happen.
+	SpectatorDelay Duration `json:"spectator_delay,omitempty" yaml:"spectator_delay"`
+}
+
+// RoleSetup lists the roles dealt from a player count upward.
+type RoleSetup struct {
+	Players int            `json:"players" yaml:"players"`
+	Roles   map[string]int `json:"roles" yaml:"roles"`
+}
+
+// PhaseDurations are the phase lengths. Execution is the agree/oppose vote
+// that follows the defense.
+type PhaseDurations struct {
+	Night     Duration `json:"night,omitempty" yaml:"night"`
+	Day       Duration `json:"day,omitempty" yaml:"day"`
+	Vote      Duration `json:"vote,omitempty" yaml:"vote"`
+	Defense   Duration `json:"defense,omitempty" yaml:"defense"`
+	Execution Duration `json:"execution,omitempty" yaml:"execution"`
+}
+
+// Duration is a time.Duration written as "25s" or "1m30s" in rules files.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalText(b []byte) error {
+	v, err := time.ParseDuration(string(b))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// TieBreak decides what happens when the nomination vote ties.
+type TieBreak string
+
+const (
+	TieBreakSkip   TieBreak = "skip"   // nobody is nominated; night falls
+	TieBreakRandom TieBreak = "random" // one of the tied players is nominated at random
+	TieBreakRevote TieBreak = "revote" // vote again among the tied players, then skip
+)
+
+const (
+	minPhaseDuration = 3 * time.Second
+	maxPhaseDuration = 10 * time.Minute
+)
+
+var defaultRules = Rules{
+	Name:        "default",
+	Description: "기본 규칙",
+	MinPlayers:  4,
+	Setups: []RoleSetup{
+		{Players: 4, Roles: map[string]int{"마피아": 1, "의사": 1, "경찰": 1, "군인": 1}},
+		{Players: 5, Roles: map[string]int{"마피아": 1, "의사": 1, "경찰": 1, "군인": 1, "정치인": 1}},
+		{Players: 7, Roles: map[string]int{"마피아": 2, "의사": 1, "경찰": 1, "군인": 1, "정치인": 1}},
+	},
+	Filler: "시민",
+	Phases: PhaseDurations{
+		Night:     Duration(25 * time.Second),
+		Day:       Duration(40 * time.Second),
+		Vote:      Duration(15 * time.Second),
+		Defense:   Duration(10 * time.Second),
+		Execution: Duration(10 * time.Second),
+	},
+	TieBreak: TieBreakSkip,
+}
+
+// withDefaults fills the zero fields of r from defaultRules.
+func (r Rules) withDefaults() Rules {
+	d := defaultRules
+	if r.MinPlayers == 0 {
+		r.MinPlayers = d.MinPlayers
+	}
+	if len(r.Setups) == 0 {
+		r.Setups = d.Setups
+	}
+	if r.Filler == "" {
+		r.Filler = d.Filler
+	}
+	for _, p := range []struct{ dst, def *Duration }{
+		{&r.Phases.Night, &d.Phases.Night},
+		{&r.Phases.Day, &d.Phases.Day},
+		{&r.Phases.Vote, &d.Phases.Vote},
+		{&r.Phases.Defense, &d.Phases.Defense},
+		{&r.Phases.Execution, &d.Phases.Execution},
+	} {
+		if *p.dst == 0 {
+			*p.dst = *p.def
+		}
+	}
+	if r.TieBreak == "" {
+		r.TieBreak = d.TieBreak
+	}
+	return r
+}
+
+// validate rejects rules that could not run a game to completion.
+func (r *Rules) validate() error {
+	if r.MinPlayers < 3 {
+		return fmt.Errorf("min_players must be at least 3, got %d", r.MinPlayers)
+	}
+	filler, ok := defaultJobs[r.Filler]
+	if !ok {
+		return fmt.Errorf("filler: unknown role %q", r.Filler)
+	}
+	if filler.Team != jobs.TeamCitizen {
+		return fmt.Errorf("filler: %s is not on the citizen team", r.Filler)
+	}
+	for name, d := range map[string]Duration{
+		"night": r.Phases.Night, "day": r.Phases.Day, "vote": r.Phases.Vote,
+		"defense": r.Phases.Defense, "execution": r.Phases.Execution,
+	} {
+		if v := time.Duration(d); v < minPhaseDuration || v > maxPhaseDuration {
+			return fmt.Errorf("phases.%s: %s is outside %s..%s", name, v, minPhaseDuration, maxPhaseDuration)
+		}
+	}
+	if v := time.Duration(r.SpectatorDelay); v < 0 || v > maxPhaseDuration {
+		return fmt.Errorf("spectator_delay: %s is outside 0s..%s", v, maxPhaseDuration)
+	}
+	switch r.TieBreak {
+	case TieBreakSkip, TieBreakRandom, TieBreakRevote:
+	default:
+		return fmt.Errorf("tie_break: unknown value %q (want skip, random or revote)", r.TieBreak)
+	}
+
+	sort.Slice(r.Setups, func(i, j int) bool { return r.Setups[i].Players < r.Setups[j].Players })
+	if r.Setups[0].Players > r.MinPlayers {
+		return fmt.Errorf("setups: no setup for %d players (smallest is for %d)", r.MinPlayers, r.Setups[0].Players)
+	}
+	for i, s := range r.Setups {
+		if i > 0 && s.Players == r.Setups[i-1].Players {
+			return fmt.Errorf("setups: %d players listed twice", s.Players)
+		}
+		mafia, total := 0, 0
+		for role, n := range s.Roles {
+			spec, ok := defaultJobs[role]
+			if !ok {
+				return fmt.Errorf("setup for %d players: unknown role %q", s.Players, role)
+			}
+			if n < 0 {
+				return fmt.Errorf("setup for %d players: negative count for %s", s.Players, role)
+			}
+			if spec.Team == jobs.TeamMafia {
+				mafia += n
+			}
+			total += n
+		}
+		if total > s.Players {
+			return fmt.Errorf("setup for %d players: %d roles do not fit", s.Players, total)
+		}
+		if mafia == 0 {
+			return fmt.Errorf("setup for %d players: no mafia role", s.Players)
+		}
+		if mafia >= s.Players-mafia {
+			return fmt.Errorf("setup for %d players: %d mafia would win before the first night", s.Players, mafia)
+		}
+	}
+	return nil
+}
+
+// roleQueue returns the roles to deal to count players, in no particular
+// order.
+func (r *Rules) roleQueue(count int) []string {
+	setup := r.Setups[0]
+	for _, s := range r.Setups {
+		if s.Players <= count {
+			setup = s
+		}
+	}
+	queue := make([]string, 0, count)
+	for role, n := range setup.Roles {
+		for i := 0; i < n && len(queue) < count; i++ {
+			queue = append(queue, role)
+		}
+	}
+	for len(queue) < count {
+		queue = append(queue, r.Filler)
+	}
+	return queue
+}
+
+func (r *Rules) summary() string {
+	tie := map[TieBreak]string{
+		TieBreakSkip:   "동률 시 넘어감",
+		TieBreakRandom: "동률 시 무작위 지목",
+		TieBreakRevote: "동률 시 결선 투표",
+	}[r.TieBreak]
+	reveal := "사망 시 직업 비공개"
+	if r.RevealOnDeath {
+		reveal = "사망 시 직업 공개"
+	}
+	p := r.Phases
+	s := fmt.Sprintf("최소 %d명, 밤 %s / 낮 %s / 투표 %s / 변론 %s / 처형 투표 %s, %s, %s",
+		r.MinPlayers, time.Duration(p.Night), time.Duration(p.Day), time.Duration(p.Vote),
+		time.Duration(p.Defense), time.Duration(p.Execution), tie, reveal)
+	if r.SpectatorDelay > 0 {
+		s += fmt.Sprintf(", 관전 %s 지연", time.Duration(r.SpectatorDelay))
+	}
+	return s
+}
+
+// RuleBook holds the rule sets a host can choose from.
+type RuleBook struct {
+	sets  map[string]*Rules
+	names []string
+}
+
+// loadRuleBook reads every *.json, *.yaml and *.yml file in dir and validates
+// it. An empty dir yields just the built-in default.
+func loadRuleBook(dir string) (*RuleBook, error) {
+	def := defaultRules
+	if err := def.validate(); err != nil {
+		return nil, fmt.Errorf("built-in rules: %w", err)
+	}
+	book := &RuleBook{sets: map[string]*Rules{"default": &def}}
+	if dir != "" {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		files := map[string]string{}
+		for _, e := range entries {
+			ext := strings.ToLower(filepath.Ext(e.Name()))
+			if e.IsDir() || (ext != ".json" && ext != ".yaml" && ext != ".yml") {
+				continue
+			}
+			name := strings.TrimSuffix(e.Name(), filepath.Ext(e.Name()))
+			if prev, dup := files[name]; dup {
+				return nil, fmt.Errorf("rules %q defined by both %s and %s", name, prev, e.Name())
+			}
+			files[name] = e.Name()
+			rules, err := readRules(filepath.Join(dir, e.Name()))
+			if err != nil {
+				return nil, fmt.Errorf("rules %s: %w", e.Name(), err)
+			}
+			rules.Name = name
+			book.sets[name] = rules
+		}
+	}
+	for name := range book.sets {
+		book.names = append(book.names, name)
+	}
+	sort.Strings(book.names)
+	return book, nil
+}
+
+func readRules(path string) (*Rules, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules Rules
+	if ext := strings.ToLower(filepath.Ext(path)); ext == ".json" {
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&rules)
+	} else {
+		dec := yaml.NewDecoder(bytes.NewReader(raw))
+		dec.KnownFields(true)
+		if err = dec.Decode(&rules); errors.Is(err, io.EOF) {
+			err = errors.New("empty file")
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	rules = rules.withDefaults()
+	if err := rules.validate(); err != nil {
+		return nil, err
+	}
+	return &rules, nil
+}
+
+// Get returns the named rule set, or nil.
+func (b *RuleBook) Get(name string) *Rules {
+	return b.sets[name]
+}
+
+// Default returns the rule set new rooms start with.
+func (b *RuleBook) Default() *Rules {
+	return b.sets["default"]
+}
+
+// Names lists the rule sets in alphabetical order.
+func (b *RuleBook) Names() []string {
+	return b.names
+}
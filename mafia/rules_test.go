@@ -0,0 +1,101 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadRules(t *testing.T) {
+	for _, tc := range []struct {
+		name, file, body string
+		err              string // substring of the expected error; "" for none
+	}{
+		{"valid yaml", "quick.yaml", `
+min_players: 4
+setups:
+  - players: 4
+    roles: {마피아: 1, 의사: 1}
+phases: {night: 15s}
+tie_break: revote
+`, ""},
+		{"valid json", "quick.json", `{"setups": [{"players": 4, "roles": {"마피아": 1}}], "spectator_delay": "30s"}`, ""},
+		{"defaults only", "empty.json", `{}`, ""},
+		{"empty yaml", "empty.yaml", "", "empty file"},
+		{"unknown field", "typo.yaml", "min_player: 4\n", "min_player"},
+		{"unknown json field", "typo.json", `{"tiebreak": "skip"}`, "tiebreak"},
+		{"unknown role", "role.yaml", "setups: [{players: 4, roles: {마피아: 1, 늑대인간: 1}}]\n", `unknown role "늑대인간"`},
+		{"unknown filler", "filler.yaml", "filler: 늑대인간\n", `filler: unknown role`},
+		{"filler off the citizen team", "filler.yaml", "filler: 광대\n", "not on the citizen team"},
+		{"duplicate player count", "dup.yaml", `
+setups:
+  - {players: 4, roles: {마피아: 1}}
+  - {players: 4, roles: {마피아: 1, 의사: 1}}
+`, "4 players listed twice"},
+		{"too many mafia", "mafia.yaml", "setups: [{players: 4, roles: {마피아: 2}}]\n", "2 mafia would win before the first night"},
+		{"no mafia", "mafia.yaml", "setups: [{players: 4, roles: {의사: 1}}]\n", "no mafia role"},
+		{"roles do not fit", "fit.yaml", "setups: [{players: 4, roles: {마피아: 1, 의사: 2, 경찰: 2}}]\n", "5 roles do not fit"},
+		{"negative count", "neg.yaml", "setups: [{players: 4, roles: {마피아: 1, 의사: -1}}]\n", "negative count"},
+		{"no setup for min players", "min.yaml", "min_players: 4\nsetups: [{players: 6, roles: {마피아: 1}}]\n", "no setup for 4 players"},
+		{"too few players", "min.yaml", "min_players: 2\n", "at least 3"},
+		{"phase too short", "fast.yaml", "phases: {night: 1s}\n", "phases.night"},
+		{"phase too long", "slow.yaml", "phases: {day: 11m}\n", "phases.day"},
+		{"bad duration", "slow.yaml", "phases: {day: soon}\n", "soon"},
+		{"spectator delay too long", "delay.yaml", "spectator_delay: 1h\n", "spectator_delay"},
+		{"unknown tie break", "tie.yaml", "tie_break: coin\n", "tie_break"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tc.file)
+			if err := os.WriteFile(path, []byte(tc.body), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			rules, err := readRules(path)
+			switch {
+			case tc.err == "" && err != nil:
+				t.Fatalf("readRules: %v", err)
+			case tc.err != "" && err == nil:
+				t.Fatalf("readRules accepted the file, want an error containing %q", tc.err)
+			case tc.err != "" && !strings.Contains(err.Error(), tc.err):
+				t.Fatalf("readRules: %v, want an error containing %q", err, tc.err)
+			case tc.err == "" && rules.Filler == "":
+				t.Fatal("defaults were not applied")
+			}
+		})
+	}
+}
+
+func TestRoleQueue(t *testing.T) {
+	rules := defaultRules.withDefaults()
+	rules.Setups = []RoleSetup{
+		{Players: 6, Roles: map[string]int{"마피아": 2, "경찰": 1, "의사": 1}},
+		{Players: 4, Roles: map[string]int{"마피아": 1, "의사": 1}},
+	}
+	if err := rules.validate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		players int
+		want    map[string]int
+	}{
+		{4, map[string]int{"마피아": 1, "의사": 1, "시민": 2}},
+		{5, map[string]int{"마피아": 1, "의사": 1, "시민": 3}},
+		{6, map[string]int{"마피아": 2, "경찰": 1, "의사": 1, "시민": 2}},
+		{9, map[string]int{"마피아": 2, "경찰": 1, "의사": 1, "시민": 5}},
+	} {
+		queue := rules.roleQueue(tc.players)
+		if len(queue) != tc.players {
+			t.Errorf("%d players: dealt %d roles", tc.players, len(queue))
+			continue
+		}
+		got := map[string]int{}
+		for _, role := range queue {
+			got[role]++
+		}
+		for role, n := range tc.want {
+			if got[role] != n {
+				t.Errorf("%d players: %d × %s, want %d (dealt %v)", tc.players, got[role], role, n, got)
+			}
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"strconv"
+
 	"github.com/gosuda/portal-toys/mafia/jobs"
 )
 
@@ -10,6 +12,8 @@ var jobRegistry = map[string]jobs.Factory{
 	"경찰":  jobs.NewPolice,
 	"군인":  jobs.NewSoldier,
 	"정치인": jobs.NewPolitician,
+	"교주":  jobs.NewCultLeader,
+	"광대":  jobs.NewJester,
 	"시민":  jobs.NewCitizen,
 }
 
@@ -37,9 +41,7 @@ func (a *jobRoomAdapter) IsAlive(name string) bool {
 }
 
 func (a *jobRoomAdapter) PushSystem(name, msg string) {
-	if cl, ok := a.r.players[name]; ok {
-		cl.pushSystem(msg)
-	}
+	a.r.pushPrivate(name, ServerEvent{Type: EventTypeLog, Room: a.r.name, Body: msg})
 }
 
 func (a *jobRoomAdapter) Broadcast(ev jobs.ServerEvent) {
@@ -58,6 +60,24 @@ func (a *jobRoomAdapter) SetNightTarget(key, value string) {
 	a.r.state.NightTargets[key] = value
 }
 
+func (a *jobRoomAdapter) NightTarget(key string) string {
+	return a.r.state.NightTargets[key]
+}
+
+func (a *jobRoomAdapter) TeamOf(name string) jobs.Team {
+	if job := a.r.state.Assign[name]; job != nil {
+		return job.Team
+	}
+	return ""
+}
+
+func (a *jobRoomAdapter) SetTeam(name string, team jobs.Team) {
+	if job := a.r.state.Assign[name]; job != nil {
+		job.Team = team
+		a.r.record("team_change", "", name, string(team))
+	}
+}
+
 func (a *jobRoomAdapter) LookupJob(name string) jobs.Job {
 	return a.r.state.Runtime[name]
 }
@@ -81,4 +101,5 @@ func (a *jobRoomAdapter) AddVote(target string, delta int) {
 		a.r.state.Vote = make(map[string]int)
 	}
 	a.r.state.Vote[target] += delta
+	a.r.record("extra_vote", "", target, strconv.Itoa(delta))
 }
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+// simulateCmd plays bot-only games without timers to measure how a rule
+// set's role mix balances:
+//
+//	mafia simulate --rules-dir rules --rules quick --players 6 --games 5000
+var simulateCmd = &cobra.Command{
+	Use:   "simulate",
+	Short: "Play bot-only games headlessly and report win rates by team and role",
+	RunE:  runSimulate,
+}
+
+var (
+	flagSimRules    string
+	flagSimPlayers  int
+	flagSimGames    int
+	flagSimStrategy string
+	flagSimParallel int
+)
+
+func init() {
+	flags := simulateCmd.Flags()
+	flags.StringVar(&flagSimRules, "rules", "default", "rule set to play")
+	flags.IntVar(&flagSimPlayers, "players", 0, "players per game (0 uses the rule set's minimum)")
+	flags.IntVar(&flagSimGames, "games", 1000, "number of games to play")
+	flags.StringVar(&flagSimStrategy, "strategy", defaultStrategy, "bot strategy: "+strings.Join(strategyNames(), ", "))
+	flags.IntVar(&flagSimParallel, "parallel", runtime.NumCPU(), "games played at once")
+	rootCmd.AddCommand(simulateCmd)
+}
+
+func runSimulate(cmd *cobra.Command, _ []string) error {
+	book, err := loadRuleBook(flagRulesDir)
+	if err != nil {
+		return fmt.Errorf("load rules: %w", err)
+	}
+	rules := book.Get(flagSimRules)
+	if rules == nil {
+		return fmt.Errorf("no rule set %q (have %s)", flagSimRules, strings.Join(book.Names(), ", "))
+	}
+	players := flagSimPlayers
+	if players == 0 {
+		players = rules.MinPlayers
+	}
+	if players < rules.MinPlayers {
+		return fmt.Errorf("rule set %s needs at least %d players", rules.Name, rules.MinPlayers)
+	}
+	if _, ok := strategies[flagSimStrategy]; !ok {
+		return fmt.Errorf("unknown strategy %q (have %s)", flagSimStrategy, strings.Join(strategyNames(), ", "))
+	}
+	if flagSimGames <= 0 || flagSimParallel <= 0 {
+		return fmt.Errorf("--games and --parallel must be positive")
+	}
+
+	queue := make(chan struct{})
+	results := make(chan *GameLog)
+	var wg sync.WaitGroup
+	for i := 0; i < flagSimParallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range queue {
+				results <- simulateGame(book, rules, players, flagSimStrategy)
+			}
+		}()
+	}
+	go func() {
+		for i := 0; i < flagSimGames; i++ {
+			queue <- struct{}{}
+		}
+		close(queue)
+		wg.Wait()
+		close(results)
+	}()
+
+	var tally simTally
+	for g := range results {
+		tally.add(g)
+	}
+	tally.print(cmd, rules.Name, players, flagSimStrategy)
+	return nil
+}
+
+// simulateGame plays one game between bots and returns its log.
+func simulateGame(book *RuleBook, rules *Rules, players int, strategy string) *GameLog {
+	done := make(chan *GameLog, 1)
+	room := NewRoom("simulation", NewRoomManager(book, 0, nil))
+	room.enqueue(func(r *Room) {
+		r.simulate = true
+		r.rules = rules
+		r.onFinish = func(g *GameLog) { done <- g }
+		for i := 0; i < players; i++ {
+			if _, err := r.addBot(strategy); err != nil {
+				panic(err) // strategy and player count were checked
+			}
+		}
+		r.startGame()
+	})
+	g := <-done
+	room.close()
+	return g
+}
+
+// simTally aggregates simulated games.
+type simTally struct {
+	games, calledOff, days int
+	teamWins               map[string]int
+	roleGames, roleWins    map[string]int
+}
+
+func (t *simTally) add(g *GameLog) {
+	if t.teamWins == nil {
+		t.teamWins, t.roleGames, t.roleWins = map[string]int{}, map[string]int{}, map[string]int{}
+	}
+	t.games++
+	if n := len(g.Events); n > 0 {
+		t.days += g.Events[n-1].Day
+	}
+	if len(g.Winners) == 0 {
+		t.calledOff++
+	}
+	won := make(map[string]bool, len(g.Winners))
+	for _, name := range g.Winners {
+		won[name] = true
+	}
+	teams := map[string]bool{}
+	for _, p := range g.Players {
+		t.roleGames[p.Role]++
+		if won[p.Name] {
+			t.roleWins[p.Role]++
+			teams[p.FinalTeam] = true
+		}
+	}
+	for team := range teams {
+		t.teamWins[team]++
+	}
+}
+
+func (t *simTally) print(cmd *cobra.Command, rules string, players int, strategy string) {
+	out := cmd.OutOrStdout()
+	fmt.Fprintf(out, "%d games of %s with %d %s bots, %.1f days on average", t.games, rules, players, strategy, float64(t.days)/float64(t.games))
+	if t.calledOff > 0 {
+		fmt.Fprintf(out, ", %d called off after %d days", t.calledOff, maxSimulatedDays)
+	}
+	fmt.Fprintln(out)
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "\nteam\twins\twin rate")
+	for _, team := range sortedKeys(t.teamWins) {
+		fmt.Fprintf(w, "%s\t%d\t%.1f%%\n", team, t.teamWins[team], 100*float64(t.teamWins[team])/float64(t.games))
+	}
+	fmt.Fprintln(w, "\nrole\tseats\twin rate")
+	for _, role := range sortedKeys(t.roleGames) {
+		fmt.Fprintf(w, "%s\t%d\t%.1f%%\n", role, t.roleGames[role], 100*float64(t.roleWins[role])/float64(t.roleGames[role]))
+	}
+	_ = w.Flush()
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,40 @@
+const body = document.querySelector('#leaderboard tbody');
+const emptyEl = document.getElementById('leaderboard-empty');
+const teamLabels = { citizen: '시민', mafia: '마피아', sect: '교주', neutral: '중립' };
+
+function percent(n, d) {
+  return d ? `${Math.round((n / d) * 100)}%` : '-';
+}
+
+function topRole(games) {
+  const entries = Object.entries(games || {});
+  if (!entries.length) return '-';
+  entries.sort((a, b) => b[1] - a[1]);
+  return `${entries[0][0]} (${entries[0][1]})`;
+}
+
+function cell(row, text) {
+  const td = document.createElement('td');
+  td.textContent = text;
+  row.appendChild(td);
+}
+
+async function load() {
+  const res = await fetch('api/leaderboard');
+  const players = res.ok ? await res.json() : [];
+  emptyEl.hidden = players.length > 0;
+  players.forEach((p, i) => {
+    const row = document.createElement('tr');
+    cell(row, i + 1);
+    cell(row, p.name);
+    cell(row, Math.round(p.rating));
+    cell(row, p.games);
+    cell(row, percent(p.wins, p.games));
+    cell(row, percent(p.survived, p.games));
+    cell(row, Object.entries(p.wins_by_team || {}).map(([t, n]) => `${teamLabels[t] || t} ${n}`).join(', ') || '-');
+    cell(row, topRole(p.games_by_role));
+    body.appendChild(row);
+  });
+}
+
+load();
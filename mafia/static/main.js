@@ -7,6 +7,8 @@ const connectForm = document.getElementById('connect-form');
 const nicknameEl = document.getElementById('nickname');
 const roomEl = document.getElementById('room');
 const wsModeEl = document.getElementById('ws-mode');
+const spectateEl = document.getElementById('spectate');
+const registerBtn = document.getElementById('register');
 const controlButtons = document.querySelectorAll('#controls button');
 const selectedTargetEl = document.getElementById('selected-target');
 const phaseLabelEl = document.getElementById('phase-label');
@@ -14,6 +16,8 @@ const phaseTimerEl = document.getElementById('phase-timer');
 const timerControlsEl = document.getElementById('timer-controls');
 const shortenDayBtn = document.getElementById('btn-shorten-day');
 const extendDayBtn = document.getElementById('btn-extend-day');
+const rulesSelectEl = document.getElementById('rules-select');
+const timelineEl = document.getElementById('timeline');
 
 const phaseNames = { lobby: '로비', night: '밤', day: '낮', vote: '투표', defense: '최후 변론' };
 const phaseDurations = { night: 25, day: 40, vote: 15, defense: 10 };
@@ -25,6 +29,15 @@ let currentHost = '';
 let myNickname = '';
 let phaseTimerHandle = null;
 let phaseDeadline = 0;
+let currentRoom = '';
+let spectating = false;
+let manualClose = false;
+let reconnectAttempts = 0;
+const maxReconnectAttempts = 8;
+
+function sessionKey() {
+  return `mafia-session:${currentRoom}:${myNickname}`;
+}
 function log(message, author = 'system') {
   const entry = document.createElement('div');
   entry.className = 'log-entry';
@@ -38,7 +51,7 @@ function setStatus(text, level = 'neutral') {
   statusEl.dataset.level = level;
 }
 
-function updatePhaseIndicator(phase, shouldStartTimer = true) {
+function updatePhaseIndicator(phase, shouldStartTimer = true, seconds = 0) {
   const label = phaseNames[phase] || phase || '대기';
   if (phaseLabelEl) {
     phaseLabelEl.textContent = label;
@@ -48,7 +61,7 @@ function updatePhaseIndicator(phase, shouldStartTimer = true) {
     updateTimerControlsVisibility();
     return;
   }
-  const duration = phaseDurations[phase];
+  const duration = seconds || phaseDurations[phase];
   if (!duration) {
     stopPhaseTimer();
     updateTimerControlsVisibility();
@@ -97,6 +110,7 @@ function updateTimerControlsVisibility() {
 function connect(evt) {
   evt.preventDefault();
   if (socket && socket.readyState === WebSocket.OPEN) {
+    manualClose = true;
     socket.close();
   }
 
@@ -108,28 +122,62 @@ function connect(evt) {
   }
 
   myNickname = nickname;
+  currentRoom = room;
+  spectating = spectateEl.checked;
+  reconnectAttempts = 0;
   selectedTarget = '';
   updateSelectedDisplay();
   updatePhaseIndicator('lobby', false);
   stopPhaseTimer();
   updateTimerControlsVisibility();
 
+  openSocket();
+}
+
+// openSocket connects, presenting the stored session token so a dropped
+// player gets their seat back; unexpected closes retry with backoff.
+function openSocket() {
   const base = buildWsBase(wsModeEl.value.trim());
-  const url = `${base}/ws?room=${encodeURIComponent(room)}&user=${encodeURIComponent(nickname)}`;
-  socket = new WebSocket(url);
-  socket.addEventListener('open', () => setStatus('Connected', 'ok'));
-  socket.addEventListener('close', () => {
+  let url = `${base}/ws?room=${encodeURIComponent(currentRoom)}&user=${encodeURIComponent(myNickname)}`;
+  const profileKey = localStorage.getItem(`mafia-profile:${myNickname}`);
+  if (profileKey) {
+    url += `&key=${encodeURIComponent(profileKey)}`;
+  }
+  const session = localStorage.getItem(sessionKey());
+  if (spectating) {
+    url += '&spectate=1';
+  } else if (session) {
+    url += `&session=${encodeURIComponent(session)}`;
+  }
+  const ws = new WebSocket(url);
+  socket = ws;
+  manualClose = false;
+  ws.addEventListener('open', () => {
+    reconnectAttempts = 0;
+    setStatus('Connected', 'ok');
+  });
+  ws.addEventListener('close', evt => {
+    if (socket !== ws) return;
     setStatus('Disconnected', 'warn');
     stopPhaseTimer();
     updateTimerControlsVisibility();
+    // 1008: the server refused the join, e.g. the name is taken
+    if (manualClose || spectating || evt.code === 1008 || !localStorage.getItem(sessionKey())) return;
+    if (reconnectAttempts >= maxReconnectAttempts) return;
+    const delay = Math.min(1000 * 2 ** reconnectAttempts, 10000);
+    reconnectAttempts++;
+    setStatus(`Reconnecting (${reconnectAttempts})…`, 'warn');
+    setTimeout(() => {
+      if (socket === ws) openSocket();
+    }, delay);
   });
-  socket.addEventListener('error', err => {
+  ws.addEventListener('error', err => {
     console.error(err);
     setStatus('Error', 'error');
     stopPhaseTimer();
     updateTimerControlsVisibility();
   });
-  socket.addEventListener('message', evt => handleMessage(evt.data));
+  ws.addEventListener('message', evt => handleMessage(evt.data));
 }
 
 function send(type, payload = {}) {
@@ -164,15 +212,22 @@ function handleMessage(raw) {
     case 'phase':
       currentPhase = data.phase || currentPhase;
       log(`Phase → ${currentPhase}: ${data.body || ''}`);
-      updatePhaseIndicator(currentPhase, true);
+      updatePhaseIndicator(currentPhase, true, data.state && data.state.duration);
       break;
     case 'state':
       log(`상태 업데이트: ${JSON.stringify(data.state)}`);
       if (data.state && data.state.phase) {
         currentPhase = data.state.phase;
-        updatePhaseIndicator(currentPhase, false);
+        const remaining = data.state.remaining || 0;
+        updatePhaseIndicator(currentPhase, remaining > 0, remaining);
       }
       break;
+    case 'game_over':
+      loadReplay(data.body);
+      break;
+    case 'session':
+      localStorage.setItem(sessionKey(), data.body || '');
+      break;
     default:
       log(`이벤트 (${data.type}): ${data.body || ''}`);
   }
@@ -186,11 +241,12 @@ function renderRoster(state) {
     selectedTarget = '';
   }
   updateSelectedDisplay();
+  const bots = state && Array.isArray(state.bots) ? state.bots : [];
   players.forEach(name => {
     const btn = document.createElement('button');
     const isHost = name === currentHost;
     const isSelf = name === myNickname;
-    btn.textContent = isHost ? '[HOST] ' + name : name;
+    btn.textContent = (isHost ? '[HOST] ' : '') + (bots.includes(name) ? '[BOT] ' : '') + name;
     btn.dataset.selected = String(name === selectedTarget);
     btn.dataset.self = String(isSelf);
     btn.classList.toggle('host', isHost);
@@ -198,6 +254,12 @@ function renderRoster(state) {
     btn.addEventListener('click', () => handlePlayerInteraction(name));
     rosterEl.appendChild(btn);
   });
+  if (state && state.spectators) {
+    const note = document.createElement('small');
+    note.className = 'hint';
+    note.textContent = `관전자 ${state.spectators}명`;
+    rosterEl.appendChild(note);
+  }
   updateTimerControlsVisibility();
 }
 function updateSelectedDisplay() {
@@ -209,6 +271,29 @@ function updateSelectedDisplay() {
 }
 
 connectForm.addEventListener('submit', connect);
+registerBtn.addEventListener('click', registerProfile);
+
+// registerProfile claims the nickname so games played with it count toward
+// stats. The key is kept in this browser only.
+async function registerProfile() {
+  const name = nicknameEl.value.trim();
+  if (!name) {
+    alert('등록할 닉네임을 입력하세요.');
+    return;
+  }
+  const res = await fetch('api/profiles', {
+    method: 'POST',
+    headers: { 'Content-Type': 'application/json' },
+    body: JSON.stringify({ name }),
+  });
+  if (!res.ok) {
+    alert(`등록 실패: ${(await res.text()).trim()}`);
+    return;
+  }
+  const { key } = await res.json();
+  localStorage.setItem(`mafia-profile:${name}`, key);
+  log(`${name} 닉네임이 등록되었습니다. 이 브라우저에서만 사용할 수 있습니다.`);
+}
 chatBtn.addEventListener('click', () => {
   const text = chatInput.value.trim();
   if (!text) return;
@@ -261,6 +346,13 @@ controlButtons.forEach(btn => {
         }
         send('admin', { action: btn.dataset.action });
         break;
+      case 'bot':
+        send('admin', { action: 'bot' });
+        break;
+      case 'rules':
+        if (!rulesSelectEl.value) return;
+        send('admin', { action: 'rules', target: rulesSelectEl.value });
+        break;
       default:
         break;
     }
@@ -268,6 +360,83 @@ controlButtons.forEach(btn => {
 });
 
 setStatus('Disconnected');
+loadRules();
+
+const teamLabels = { citizen: '시민', mafia: '마피아', sect: '교주', neutral: '중립' };
+
+function describeEvent(ev) {
+  switch (ev.kind) {
+    case 'phase': return ev.detail;
+    case 'night_action': return `${ev.actor} (${ev.detail}) → ${ev.target}`;
+    case 'saved': return `${ev.target} 님이 공격받았지만 치료되었습니다.`;
+    case 'elimination': return `${ev.target} 사망 (${ev.detail === 'vote' ? '처형' : ev.detail})`;
+    case 'death_intercepted': return `${ev.target} 님이 ${ev.detail} 능력으로 죽음을 피했습니다.`;
+    case 'team_change': return `${ev.target} 님이 ${teamLabels[ev.detail] || ev.detail} 팀이 되었습니다.`;
+    case 'vote': return `${ev.actor} → ${ev.target} 투표`;
+    case 'extra_vote': return `${ev.target} 추가 ${ev.detail}표`;
+    case 'nomination': return `${ev.target} 님 최후 변론`;
+    case 'tie': return `동률: ${ev.detail}`;
+    case 'execution_vote': return `${ev.actor}: ${ev.detail === 'agree' ? '찬성' : '반대'}`;
+    case 'left': return `${ev.actor} 퇴장`;
+    case 'game_over': return ev.detail ? `승리: ${ev.detail}` : '게임 종료';
+    default: return `${ev.kind} ${ev.actor || ''} ${ev.target || ''} ${ev.detail || ''}`;
+  }
+}
+
+// loadReplay renders a finished game's log grouped by night and day.
+async function loadReplay(id) {
+  if (!timelineEl || !id) return;
+  let game;
+  try {
+    const res = await fetch(`api/games/${encodeURIComponent(id)}/replay`);
+    if (!res.ok) throw new Error(res.statusText);
+    game = await res.json();
+  } catch (err) {
+    console.error(err);
+    return;
+  }
+  timelineEl.innerHTML = '';
+  const roles = document.createElement('p');
+  roles.className = 'hint';
+  roles.textContent = game.players.map(p => `${p.name}: ${p.role}${p.survived ? '' : ' †'}`).join(', ');
+  timelineEl.appendChild(roles);
+  let group = null;
+  let label = '';
+  game.events.forEach(ev => {
+    const next = ev.phase === 'night' ? `${ev.day + 1}번째 밤` : ev.day > 0 ? `${ev.day}번째 낮` : '';
+    if (next && next !== label) {
+      label = next;
+      group = document.createElement('details');
+      group.open = true;
+      const summary = document.createElement('summary');
+      summary.textContent = label;
+      group.appendChild(summary);
+      timelineEl.appendChild(group);
+    }
+    const row = document.createElement('div');
+    row.className = `timeline-entry ${ev.kind}`;
+    row.textContent = describeEvent(ev);
+    (group || timelineEl).appendChild(row);
+  });
+}
+
+async function loadRules() {
+  if (!rulesSelectEl) return;
+  try {
+    const res = await fetch('api/rules');
+    const sets = await res.json();
+    rulesSelectEl.innerHTML = '';
+    sets.forEach(set => {
+      const opt = document.createElement('option');
+      opt.value = set.name;
+      opt.textContent = set.description ? `${set.name} – ${set.description}` : set.name;
+      opt.title = set.summary;
+      rulesSelectEl.appendChild(opt);
+    });
+  } catch (err) {
+    console.error(err);
+  }
+}
 function buildWsBase(mode) {
   if (mode === 'online') {
     return `${location.protocol === 'https:' ? 'wss' : 'ws'}://${location.host}`;
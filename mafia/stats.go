@@ -0,0 +1,343 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/cockroachdb/pebble/v2"
+)
+
+// Player profiles are optional. A player registers their nickname once and
+// gets a key, which the browser keeps and sends as ?key= on /ws; a
+// registered nickname cannot be used without it. Only registered players
+// have stats and a rating, updated when a game ends with a winner.
+//
+// Ratings are Elo with every game scored as winners against losers: each
+// winner is rated against the average of the losers and vice versa.
+// Unregistered players count at the starting rating.
+
+const (
+	startRating = 1500.0
+	ratingK     = 32.0
+	maxNameLen  = 32
+)
+
+var (
+	profilePrefix = []byte("profile/")
+
+	errNameRegistered = errors.New("nickname is already registered")
+	errBadName        = errors.New("nickname must be 1 to 32 characters")
+	errNameReserved   = errors.New("nickname is reserved")
+)
+
+// Profile is a registered player's record.
+type Profile struct {
+	Name        string         `json:"name"`
+	Rating      float64        `json:"rating"`
+	Games       int            `json:"games"`
+	Wins        int            `json:"wins"`
+	Survived    int            `json:"survived"`
+	GamesByTeam map[string]int `json:"games_by_team"`
+	WinsByTeam  map[string]int `json:"wins_by_team"`
+	GamesByRole map[string]int `json:"games_by_role"`
+	WinsByRole  map[string]int `json:"wins_by_role"`
+	Created     time.Time      `json:"created"`
+	LastPlayed  time.Time      `json:"last_played,omitempty"`
+}
+
+// profileRecord is a Profile as stored, with the hash of its key.
+type profileRecord struct {
+	Profile
+	KeyHash string `json:"key_hash"`
+}
+
+// statsStore keeps profiles in Pebble. A nil store means persistence is off;
+// its methods then do nothing.
+type statsStore struct {
+	db *pebble.DB
+	mu sync.Mutex // serialises read-modify-write of profiles
+}
+
+func openStatsStore(dir string) (*statsStore, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	db, err := pebble.Open(filepath.Clean(dir), &pebble.Options{})
+	if err != nil {
+		return nil, err
+	}
+	return &statsStore{db: db}, nil
+}
+
+func (s *statsStore) Close() error {
+	if s == nil || s.db == nil {
+		return nil
+	}
+	return s.db.Close()
+}
+
+func profileKey(name string) []byte {
+	return append(append([]byte(nil), profilePrefix...), name...)
+}
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *statsStore) load(name string) (*profileRecord, error) {
+	v, closer, err := s.db.Get(profileKey(name))
+	if err == pebble.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer func() { _ = closer.Close() }()
+	var rec profileRecord
+	if err := json.Unmarshal(v, &rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// Register creates a profile for name and returns its key.
+func (s *statsStore) Register(name string) (string, error) {
+	if s == nil {
+		return "", errors.New("profiles need --data-path")
+	}
+	if name == "" || utf8.RuneCountInString(name) > maxNameLen {
+		return "", errBadName
+	}
+	if name == spectatorName {
+		return "", errNameReserved
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rec, err := s.load(name); err != nil {
+		return "", err
+	} else if rec != nil {
+		return "", errNameRegistered
+	}
+	var raw [16]byte
+	_, _ = rand.Read(raw[:])
+	key := hex.EncodeToString(raw[:])
+	rec := profileRecord{Profile: Profile{Name: name, Rating: startRating, Created: time.Now()}, KeyHash: hashKey(key)}
+	val, _ := json.Marshal(rec)
+	return key, s.db.Set(profileKey(name), val, pebble.Sync)
+}
+
+// Verify reports whether name may be used with key: true if name is
+// unregistered (registered is then false) or key is its key.
+func (s *statsStore) Verify(name, key string) (ok, registered bool, err error) {
+	if s == nil {
+		return true, false, nil
+	}
+	rec, err := s.load(name)
+	if err != nil || rec == nil {
+		return err == nil, false, err
+	}
+	match := subtle.ConstantTimeCompare([]byte(hashKey(key)), []byte(rec.KeyHash)) == 1
+	return match, true, nil
+}
+
+// Get returns the profile of name, or nil.
+func (s *statsStore) Get(name string) (*Profile, error) {
+	if s == nil {
+		return nil, nil
+	}
+	rec, err := s.load(name)
+	if err != nil || rec == nil {
+		return nil, err
+	}
+	return &rec.Profile, nil
+}
+
+// Leaderboard returns up to n profiles with at least one game, best rating
+// first.
+func (s *statsStore) Leaderboard(n int) ([]Profile, error) {
+	if s == nil {
+		return nil, nil
+	}
+	it, err := s.db.NewIter(&pebble.IterOptions{LowerBound: profilePrefix, UpperBound: []byte("profile0")})
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = it.Close() }()
+	var out []Profile
+	for valid := it.First(); valid; valid = it.Next() {
+		var rec profileRecord
+		if err := json.Unmarshal(it.Value(), &rec); err != nil || rec.Games == 0 {
+			continue
+		}
+		out = append(out, rec.Profile)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Rating > out[j].Rating })
+	if len(out) > n {
+		out = out[:n]
+	}
+	return out, nil
+}
+
+// RecordGame updates the registered players of a finished game. A game
+// with a bot in it counts toward games and wins but leaves ratings alone,
+// so nobody climbs the leaderboard by beating bots.
+func (s *statsStore) RecordGame(g *GameLog) error {
+	if s == nil || len(g.Winners) == 0 {
+		return nil
+	}
+	won := make(map[string]bool, len(g.Winners))
+	for _, name := range g.Winners {
+		won[name] = true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	recs := make(map[string]*profileRecord)
+	var winSum, loseSum float64
+	var winN, loseN int
+	withBots := false
+	for _, p := range g.Players {
+		withBots = withBots || p.Bot
+		rating := startRating
+		if p.Rated {
+			rec, err := s.load(p.Name)
+			if err != nil {
+				return err
+			}
+			if rec != nil {
+				recs[p.Name] = rec
+				rating = rec.Rating
+			}
+		}
+		if won[p.Name] {
+			winSum += rating
+			winN++
+		} else {
+			loseSum += rating
+			loseN++
+		}
+	}
+
+	b := s.db.NewBatch()
+	defer func() { _ = b.Close() }()
+	for _, p := range g.Players {
+		rec := recs[p.Name]
+		if rec == nil {
+			continue
+		}
+		pr := &rec.Profile
+		if pr.GamesByTeam == nil {
+			pr.GamesByTeam, pr.WinsByTeam = map[string]int{}, map[string]int{}
+			pr.GamesByRole, pr.WinsByRole = map[string]int{}, map[string]int{}
+		}
+		pr.Games++
+		pr.GamesByTeam[p.FinalTeam]++
+		pr.GamesByRole[p.Role]++
+		if p.Survived {
+			pr.Survived++
+		}
+		score, opponents := 0.0, winSum/math.Max(float64(winN), 1)
+		if won[p.Name] {
+			pr.Wins++
+			pr.WinsByTeam[p.FinalTeam]++
+			pr.WinsByRole[p.Role]++
+			score, opponents = 1, loseSum/math.Max(float64(loseN), 1)
+		}
+		if !withBots && winN > 0 && loseN > 0 {
+			expected := 1 / (1 + math.Pow(10, (opponents-pr.Rating)/400))
+			pr.Rating += ratingK * (score - expected)
+		}
+		pr.LastPlayed = g.Ended
+		val, _ := json.Marshal(rec)
+		if err := b.Set(profileKey(p.Name), val, nil); err != nil {
+			return err
+		}
+	}
+	return b.Commit(pebble.Sync)
+}
+
+// handleRegister creates a profile and returns its key. Like the websocket,
+// it asks for X-Mafia-Key when --ws-auth-key is set.
+//
+//	POST /api/profiles   {"name": "..."}
+func (s *HTTPServer) handleRegister(w http.ResponseWriter, r *http.Request) {
+	if s.mgr.stats == nil {
+		http.Error(w, "profiles are disabled on this server", http.StatusServiceUnavailable)
+		return
+	}
+	if s.authKey != "" && r.Header.Get("X-Mafia-Key") != s.authKey {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	key, err := s.mgr.stats.Register(strings.TrimSpace(req.Name))
+	switch {
+	case errors.Is(err, errNameRegistered), errors.Is(err, errNameReserved):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, errBadName):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(map[string]string{"name": strings.TrimSpace(req.Name), "key": key})
+}
+
+// handleProfile serves one player's stats.
+//
+//	GET /api/profiles/{name}
+func (s *HTTPServer) handleProfile(w http.ResponseWriter, r *http.Request) {
+	p, err := s.mgr.stats.Get(r.PathValue("name"))
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if p == nil {
+		http.Error(w, "profile not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(p)
+}
+
+// handleLeaderboard lists the top rated players.
+//
+//	GET /api/leaderboard
+func (s *HTTPServer) handleLeaderboard(w http.ResponseWriter, _ *http.Request) {
+	top, err := s.mgr.stats.Leaderboard(100)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if top == nil {
+		top = []Profile{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(top)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestRecordGame(t *testing.T) {
+	type want struct {
+		rating      float64
+		games, wins int
+	}
+	rated := func(name, team string) PlayerRecord {
+		return PlayerRecord{Name: name, Role: "시민", Team: team, FinalTeam: team, Rated: true}
+	}
+	guest := func(name, team string) PlayerRecord {
+		return PlayerRecord{Name: name, Role: "시민", Team: team, FinalTeam: team}
+	}
+	bot := func(name, team string) PlayerRecord {
+		return PlayerRecord{Name: name, Role: "시민", Team: team, FinalTeam: team, Bot: true}
+	}
+	game := func(winners []string, players ...PlayerRecord) *GameLog {
+		return &GameLog{ID: "g", Players: players, Winners: winners}
+	}
+
+	for _, tc := range []struct {
+		name  string
+		games []*GameLog
+		want  map[string]want
+	}{
+		{
+			name:  "even match",
+			games: []*GameLog{game([]string{"a"}, rated("a", "mafia"), rated("b", "citizen"))},
+			want:  map[string]want{"a": {1516, 1, 1}, "b": {1484, 1, 0}},
+		},
+		{
+			name: "rematch moves less",
+			games: []*GameLog{
+				game([]string{"a"}, rated("a", "mafia"), rated("b", "citizen")),
+				game([]string{"a"}, rated("a", "mafia"), rated("b", "citizen")),
+			},
+			want: map[string]want{"a": {1530.5305, 2, 2}, "b": {1469.4695, 2, 0}},
+		},
+		{
+			name: "unregistered players count at the starting rating",
+			games: []*GameLog{
+				game([]string{"a"}, rated("a", "mafia"), rated("b", "citizen")),
+				game([]string{"a"}, rated("a", "mafia"), rated("b", "citizen"), guest("c", "citizen")),
+			},
+			want: map[string]want{"a": {1530.8965, 2, 2}, "b": {1469.4695, 2, 0}, "c": {}},
+		},
+		{
+			name: "a bot freezes ratings",
+			games: []*GameLog{
+				game([]string{"a", "봇1"}, rated("a", "mafia"), bot("봇1", "mafia"), rated("b", "citizen"), rated("c", "citizen")),
+			},
+			want: map[string]want{"a": {1500, 1, 1}, "b": {1500, 1, 0}, "c": {1500, 1, 0}},
+		},
+		{
+			name:  "a losing bot freezes ratings too",
+			games: []*GameLog{game([]string{"a"}, rated("a", "citizen"), bot("봇1", "mafia"))},
+			want:  map[string]want{"a": {1500, 1, 1}},
+		},
+		{
+			name:  "nobody lost",
+			games: []*GameLog{game([]string{"a", "b"}, rated("a", "citizen"), rated("b", "citizen"))},
+			want:  map[string]want{"a": {1500, 1, 1}, "b": {1500, 1, 1}},
+		},
+		{
+			name:  "called off",
+			games: []*GameLog{game(nil, rated("a", "citizen"), rated("b", "mafia"))},
+			want:  map[string]want{"a": {1500, 0, 0}, "b": {1500, 0, 0}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := openStatsStore(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = s.Close() }()
+			for name, w := range tc.want {
+				if w.rating == 0 {
+					continue // not registered
+				}
+				if _, err := s.Register(name); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, g := range tc.games {
+				if err := s.RecordGame(g); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for name, w := range tc.want {
+				p, err := s.Get(name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if w.rating == 0 {
+					if p != nil {
+						t.Fatalf("%s got a profile: %+v", name, p)
+					}
+					continue
+				}
+				if math.Abs(p.Rating-w.rating) > 0.001 || p.Games != w.games || p.Wins != w.wins {
+					t.Errorf("%s: rating %.4f, %d games, %d wins; want %.4f, %d, %d", name, p.Rating, p.Games, p.Wins, w.rating, w.games, w.wins)
+				}
+			}
+		})
+	}
+}
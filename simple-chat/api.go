@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/rs/zerolog/log"
+)
+
+// writeAPIJSON encodes v as the JSON response body. Like writeJSON it keeps
+// <, > and & intact so message text round-trips unchanged.
+func writeAPIJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	_ = enc.Encode(v)
+}
+
+// queryUint parses an optional unsigned integer query parameter.
+func queryUint(r *http.Request, key string) (uint64, bool) {
+	v := r.URL.Query().Get(key)
+	if v == "" {
+		return 0, true
+	}
+	n, err := strconv.ParseUint(v, 10, 64)
+	return n, err == nil
+}
+
+// handleHistory serves one page of a channel's history.
+//
+//	GET /api/history?channel=general&before=<id>&limit=50   older than id (default: newest page)
+//	GET /api/history?channel=general&after=<id>&limit=50    newer than id
+func handleHistory(w http.ResponseWriter, r *http.Request, h *hub) {
+	q := r.URL.Query()
+	name := normalizeChannel(q.Get("channel"))
+	if name == "" {
+		name = defaultChannel
+	}
+	before, ok1 := queryUint(r, "before")
+	after, ok2 := queryUint(r, "after")
+	limit, ok3 := queryUint(r, "limit")
+	if !ok1 || !ok2 || !ok3 {
+		http.Error(w, "bad cursor", http.StatusBadRequest)
+		return
+	}
+	if before > 0 && after > 0 {
+		http.Error(w, "use either before or after", http.StatusBadRequest)
+		return
+	}
+	page, more, err := h.history(name, before, after, int(min(limit, maxHistoryPage)))
+	if err != nil {
+		log.Warn().Err(err).Msg("[chat] load history page")
+		http.Error(w, "history unavailable", http.StatusInternalServerError)
+		return
+	}
+	if page == nil {
+		page = []message{}
+	}
+	writeAPIJSON(w, http.StatusOK, map[string]any{
+		"channel":  name,
+		"messages": page,
+		"more":     more,
+	})
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/pebble/v2"
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog/log"
+)
+
+// Attachment metadata lives at a:<id>; the bytes are a file named <id> in the
+// attachments directory under --data-path.
+var attachPrefix = []byte("a:")
+
+const orphanAttachmentAge = 24 * time.Hour // uploads never posted are removed after this
+
+var errBadAttachment = errors.New("unknown attachment")
+
+// attachment describes an uploaded file. Messages embed it so clients can
+// render a preview without another round trip.
+type attachment struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Type    string    `json:"type"`
+	Size    int64     `json:"size"`
+	TS      time.Time `json:"ts"`
+	Author  string    `json:"author,omitempty"`  // uploader
+	Message uint64    `json:"message,omitempty"` // ID of the message that posted it, 0 until then
+}
+
+func (a attachment) isImage() bool { return strings.HasPrefix(a.Type, "image/") }
+
+// uploadConfig limits what may be uploaded.
+type uploadConfig struct {
+	MaxBytes int64
+	Types    []string // allowed MIME types; "image/*" style wildcards allowed
+}
+
+func (c uploadConfig) allows(mediaType string) bool {
+	for _, t := range c.Types {
+		if t == mediaType || (strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(t, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+func attachKey(id string) []byte {
+	return append(append([]byte(nil), attachPrefix...), id...)
+}
+
+func isAttachmentID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// SaveAttachment streams r into a new blob of at most limit bytes. The content
+// type is sniffed from the data rather than trusted from the client.
+func (s *messageStore) SaveAttachment(name, author string, r io.Reader, cfg uploadConfig) (attachment, error) {
+	if s == nil || s.db == nil {
+		return attachment{}, errors.New("attachments need --data-path")
+	}
+	if err := os.MkdirAll(s.blobDir, 0o755); err != nil {
+		return attachment{}, err
+	}
+	var raw [16]byte
+	_, _ = rand.Read(raw[:])
+	a := attachment{ID: hex.EncodeToString(raw[:]), Name: name, TS: time.Now().UTC(), Author: author}
+
+	tmp, err := os.CreateTemp(s.blobDir, ".upload-*")
+	if err != nil {
+		return attachment{}, err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	head := make([]byte, 512)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		_ = tmp.Close()
+		return attachment{}, err
+	}
+	head = head[:n]
+	a.Type, _, _ = mime.ParseMediaType(http.DetectContentType(head))
+	if !cfg.allows(a.Type) {
+		_ = tmp.Close()
+		return attachment{}, fmt.Errorf("file type %s is not allowed", a.Type)
+	}
+	written, err := io.Copy(tmp, io.LimitReader(io.MultiReader(bytes.NewReader(head), r), cfg.MaxBytes+1))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return attachment{}, err
+	}
+	if written > cfg.MaxBytes {
+		return attachment{}, fmt.Errorf("file is larger than %d bytes", cfg.MaxBytes)
+	}
+	a.Size = written
+	if err := os.Rename(tmp.Name(), filepath.Join(s.blobDir, a.ID)); err != nil {
+		return attachment{}, err
+	}
+	v, _ := json.Marshal(a)
+	if err := s.db.Set(attachKey(a.ID), v, pebble.Sync); err != nil {
+		_ = os.Remove(filepath.Join(s.blobDir, a.ID))
+		return attachment{}, err
+	}
+	return a, nil
+}
+
+// Attachment looks up attachment metadata.
+func (s *messageStore) Attachment(id string) (attachment, error) {
+	if s == nil || s.db == nil || !isAttachmentID(id) {
+		return attachment{}, errBadAttachment
+	}
+	v, closer, err := s.db.Get(attachKey(id))
+	if err == pebble.ErrNotFound {
+		return attachment{}, errBadAttachment
+	} else if err != nil {
+		return attachment{}, err
+	}
+	defer func() { _ = closer.Close() }()
+	var a attachment
+	if err := json.Unmarshal(v, &a); err != nil {
+		return attachment{}, err
+	}
+	return a, nil
+}
+
+// linkAttachment records in b which message posted an attachment.
+func (s *messageStore) linkAttachment(b *pebble.Batch, a *attachment, msgID uint64) error {
+	linked := *a
+	linked.Message = msgID
+	v, _ := json.Marshal(linked)
+	return b.Set(attachKey(a.ID), v, nil)
+}
+
+// DeleteAttachments removes blobs and their metadata.
+func (s *messageStore) DeleteAttachments(ids []string) error {
+	if s == nil || s.db == nil || len(ids) == 0 {
+		return nil
+	}
+	b := s.db.NewBatch()
+	defer func() { _ = b.Close() }()
+	for _, id := range ids {
+		if err := b.Delete(attachKey(id), nil); err != nil {
+			return err
+		}
+	}
+	if err := b.Commit(pebble.Sync); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := os.Remove(filepath.Join(s.blobDir, id)); err != nil && !os.IsNotExist(err) {
+			log.Warn().Err(err).Str("id", id).Msg("[chat] remove attachment blob")
+		}
+	}
+	return nil
+}
+
+// pruneAttachments deletes attachments older than cutoff, and uploads that
+// were never posted once they are orphanAttachmentAge old.
+func (s *messageStore) pruneAttachments(cutoff time.Time) (int, error) {
+	if s == nil || s.db == nil {
+		return 0, nil
+	}
+	it, err := s.db.NewIter(&pebble.IterOptions{LowerBound: attachPrefix, UpperBound: prefixEnd(attachPrefix)})
+	if err != nil {
+		return 0, err
+	}
+	orphanCutoff := time.Now().Add(-orphanAttachmentAge)
+	var ids []string
+	for valid := it.First(); valid; valid = it.Next() {
+		var a attachment
+		if json.Unmarshal(it.Value(), &a) != nil {
+			continue
+		}
+		if (!cutoff.IsZero() && a.TS.Before(cutoff)) || (a.Message == 0 && a.TS.Before(orphanCutoff)) {
+			ids = append(ids, a.ID)
+		}
+	}
+	_ = it.Close()
+	return len(ids), s.DeleteAttachments(ids)
+}
+
+// attachUploads sets the upload limits for POST /api/attachments.
+func (h *hub) attachUploads(cfg uploadConfig) {
+	h.mu.Lock()
+	h.uploads = cfg
+	h.mu.Unlock()
+}
+
+// resolveAttachment checks that id names an upload by author that has not
+// been posted yet, for attaching it to a new message.
+func (h *hub) resolveAttachment(id, author string) (*attachment, error) {
+	a, err := h.store.Attachment(id)
+	if err != nil {
+		return nil, err
+	}
+	if a.Author != author || a.Message != 0 {
+		return nil, errBadAttachment
+	}
+	return &a, nil
+}
+
+// handleUpload stores one file and returns its metadata. The client then
+// posts a message referencing the returned ID.
+//
+//	POST /api/attachments   multipart/form-data with "file" and "uid" fields
+func handleUpload(w http.ResponseWriter, r *http.Request, h *hub, cfg uploadConfig) {
+	if h.store == nil {
+		http.Error(w, "attachments need --data-path", http.StatusServiceUnavailable)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxBytes+64<<10)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "expected multipart form", http.StatusBadRequest)
+		return
+	}
+	ip := clientIP(r)
+	var uid string
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			http.Error(w, "missing file", http.StatusBadRequest)
+			return
+		} else if err != nil {
+			http.Error(w, "bad multipart form", http.StatusBadRequest)
+			return
+		}
+		switch part.FormName() {
+		case "uid":
+			v, _ := io.ReadAll(io.LimitReader(part, 256))
+			uid = strings.TrimSpace(string(v))
+		case "file":
+			// The uid field must come first so the upload can be checked before
+			// any bytes are stored.
+			if uid == "" {
+				http.Error(w, "uid must precede file", http.StatusBadRequest)
+				return
+			}
+			if _, banned := h.banned(uid, ip); banned {
+				http.Error(w, "banned", http.StatusForbidden)
+				return
+			}
+			if v, _ := h.limits.allow(uid, ip, ""); v != limitOK {
+				http.Error(w, "slow down", http.StatusTooManyRequests)
+				return
+			}
+			name := sanitizeString(path.Base(part.FileName()), 200)
+			a, err := h.store.SaveAttachment(name, authorID(uid), part, cfg)
+			if err != nil {
+				log.Debug().Err(err).Msg("[chat] upload rejected")
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			writeAPIJSON(w, http.StatusCreated, a)
+			return
+		}
+	}
+}
+
+// handleDownload serves an attachment. Images are shown inline; everything
+// else is offered as a download so browsers never render uploaded HTML.
+//
+//	GET /api/attachments/{id}
+func handleDownload(w http.ResponseWriter, r *http.Request, h *hub) {
+	a, err := h.store.Attachment(chi.URLParam(r, "id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	f, err := os.Open(filepath.Join(h.store.blobDir, a.ID))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer func() { _ = f.Close() }()
+	w.Header().Set("Content-Type", a.Type)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+	disposition := "attachment"
+	if a.isImage() {
+		disposition = "inline"
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": a.Name}))
+	http.ServeContent(w, r, a.Name, a.TS, f)
+}
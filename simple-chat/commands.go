@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// command is a slash command typed into the chat box ("/name args").
+// Implementations are registered with registerCommand, usually from an init
+// function, and run on the connection's read goroutine.
+type command interface {
+	// Name is the word after the slash, lower case and without the slash.
+	Name() string
+	// Usage is a one-line synopsis shown by /help, e.g. "/nick <name>".
+	Usage() string
+	// Run executes the command. A returned error is reported to the caller only.
+	Run(ctx *commandContext, args string) error
+}
+
+// commandContext describes who invoked a command and where, and offers the
+// two ways of answering: privately to the caller or publicly to the channel.
+type commandContext struct {
+	hub     *hub
+	conn    client
+	uid     string
+	user    string
+	channel string
+}
+
+// reply sends a system line to the calling connection only.
+func (c *commandContext) reply(format string, args ...any) {
+	c.hub.send(c.conn, message{TS: time.Now().UTC(), Channel: c.channel, Event: "system", Text: fmt.Sprintf(format, args...)})
+}
+
+// broadcast posts a message to everyone in the caller's channel.
+func (c *commandContext) broadcast(m message) {
+	m.TS = time.Now().UTC()
+	m.Channel = c.channel
+	if m.User == "" {
+		m.User = c.user
+	}
+	c.hub.broadcast(m)
+}
+
+var (
+	commandsMu sync.RWMutex
+	commands   = map[string]command{}
+)
+
+// registerCommand makes a command available to all clients, replacing any
+// earlier command with the same name.
+func registerCommand(cmd command) {
+	commandsMu.Lock()
+	commands[strings.ToLower(cmd.Name())] = cmd
+	commandsMu.Unlock()
+}
+
+func lookupCommand(name string) (command, bool) {
+	commandsMu.RLock()
+	defer commandsMu.RUnlock()
+	cmd, ok := commands[strings.ToLower(name)]
+	return cmd, ok
+}
+
+// dmCommands are the commands that make sense without a channel. Everything
+// else acts on ctx.channel, so it is refused in a DM tab.
+var dmCommands = map[string]bool{"help": true, "op": true, "nick": true}
+
+// runCommand dispatches a "/name args" line. When text is not a command it
+// returns false along with the text to post as a normal chat line, where a
+// leading "//" escapes to a literal slash. An empty channel means the line
+// was typed in a DM tab.
+func (h *hub) runCommand(c client, uid, user, channel, text string) (string, bool) {
+	if !strings.HasPrefix(text, "/") {
+		return text, false
+	}
+	if strings.HasPrefix(text, "//") {
+		return text[1:], false
+	}
+	name, args, _ := strings.Cut(text[1:], " ")
+	ctx := &commandContext{hub: h, conn: c, uid: uid, user: user, channel: channel}
+	cmd, ok := lookupCommand(name)
+	if !ok {
+		ctx.reply("unknown command /%s — try /help", name)
+		return "", true
+	}
+	if channel == "" && !dmCommands[cmd.Name()] {
+		ctx.reply("/%s only works in a channel", cmd.Name())
+		return "", true
+	}
+	if err := cmd.Run(ctx, strings.TrimSpace(args)); err != nil {
+		ctx.reply("/%s: %v", cmd.Name(), err)
+	}
+	return "", true
+}
+
+// funcCommand adapts a plain function to the command interface.
+type funcCommand struct {
+	name  string
+	usage string
+	run   func(ctx *commandContext, args string) error
+}
+
+func (f funcCommand) Name() string                               { return f.name }
+func (f funcCommand) Usage() string                              { return f.usage }
+func (f funcCommand) Run(ctx *commandContext, args string) error { return f.run(ctx, args) }
+
+var errUsage = errors.New("missing argument")
+
+func init() {
+	registerCommand(funcCommand{"help", "/help — list commands", cmdHelp})
+	registerCommand(funcCommand{"nick", "/nick <name> — change your nickname", cmdNick})
+	registerCommand(funcCommand{"me", "/me <action> — describe what you are doing", cmdMe})
+	registerCommand(funcCommand{"topic", "/topic [text] — show or set the channel topic", cmdTopic})
+	registerCommand(funcCommand{"who", "/who — list people in this channel", cmdWho})
+	registerCommand(funcCommand{"clear", "/clear — clear your view of this channel", cmdClear})
+}
+
+func cmdHelp(ctx *commandContext, _ string) error {
+	commandsMu.RLock()
+	lines := make([]string, 0, len(commands))
+	for _, cmd := range commands {
+		lines = append(lines, cmd.Usage())
+	}
+	commandsMu.RUnlock()
+	sort.Strings(lines)
+	ctx.reply("commands:\n%s", strings.Join(lines, "\n"))
+	return nil
+}
+
+func cmdNick(ctx *commandContext, args string) error {
+	name := sanitizeString(args, 100)
+	if name == "" {
+		return errUsage
+	}
+	h := ctx.hub
+	h.mu.Lock()
+	h.userName[ctx.uid] = name
+	h.mu.Unlock()
+	// Tell the caller's tabs so their nickname field follows the change
+	h.mu.RLock()
+	conns := make([]client, 0, len(h.userConns[ctx.uid]))
+	for c := range h.userConns[ctx.uid] {
+		conns = append(conns, c)
+	}
+	h.mu.RUnlock()
+	channels := map[string]struct{}{}
+	for _, c := range conns {
+		h.send(c, message{TS: time.Now().UTC(), Event: "nick", User: name})
+		for _, ch := range h.joinedChannels(c) {
+			channels[ch] = struct{}{}
+		}
+	}
+	for ch := range channels {
+		h.broadcastRoster(ch)
+	}
+	return nil
+}
+
+func cmdMe(ctx *commandContext, args string) error {
+	if args == "" {
+		return errUsage
+	}
+	if err := ctx.hub.checkText(ctx.channel, args); err != nil {
+		return err
+	}
+	ctx.broadcast(message{Event: "me", Text: args, Author: authorID(ctx.uid)})
+	return nil
+}
+
+func cmdTopic(ctx *commandContext, args string) error {
+	if args == "" {
+		if topic := ctx.hub.topic(ctx.channel); topic != "" {
+			ctx.reply("topic for #%s: %s", ctx.channel, topic)
+		} else {
+			ctx.reply("#%s has no topic", ctx.channel)
+		}
+		return nil
+	}
+	return ctx.hub.setTopic(ctx.channel, ctx.user, sanitizeString(args, 200))
+}
+
+func cmdWho(ctx *commandContext, _ string) error {
+	h := ctx.hub
+	h.mu.RLock()
+	seen := map[string]struct{}{}
+	var names []string
+	if ch, ok := h.channels[ctx.channel]; ok {
+		for c := range ch.conns {
+			uid := h.connUID[c]
+			if _, dup := seen[uid]; dup {
+				continue
+			}
+			seen[uid] = struct{}{}
+			names = append(names, h.userName[uid])
+		}
+	}
+	h.mu.RUnlock()
+	sort.Strings(names)
+	ctx.reply("%d in #%s: %s", len(names), ctx.channel, strings.Join(names, ", "))
+	return nil
+}
+
+func cmdClear(ctx *commandContext, _ string) error {
+	ctx.hub.send(ctx.conn, message{TS: time.Now().UTC(), Channel: ctx.channel, Event: "clear"})
+	return nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/cockroachdb/pebble/v2"
+)
+
+var errBadRecipient = errors.New("unknown recipient")
+
+// conversation is one entry of a user's direct-message list.
+type conversation struct {
+	Peer     string    `json:"peer"` // authorID of the other party
+	Name     string    `json:"name"` // their most recently seen nickname
+	LastID   uint64    `json:"last_id"`
+	LastText string    `json:"last_text"`
+	TS       time.Time `json:"ts"`
+}
+
+// isAuthorID reports whether s has the shape of an authorID (16 hex digits).
+func isAuthorID(s string) bool {
+	if len(s) != 16 {
+		return false
+	}
+	for _, r := range s {
+		if (r < '0' || r > '9') && (r < 'a' || r > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// dmConvID names the conversation between two authors independent of who
+// sends: the pair in sorted order.
+func dmConvID(a, b string) string {
+	if a > b {
+		a, b = b, a
+	}
+	return a + "-" + b
+}
+
+// dmPrefixFor is the key prefix of every message between a and b.
+func dmPrefixFor(a, b string) []byte {
+	id := dmConvID(a, b)
+	p := make([]byte, 0, len(dmPrefix)+len(id)+1)
+	p = append(p, dmPrefix...)
+	p = append(p, id...)
+	return append(p, 0)
+}
+
+// convKey is the key of author's conversation-list entry for peer.
+func convKey(author, peer string) []byte {
+	k := make([]byte, 0, len(convPrefix)+len(author)+1+len(peer))
+	k = append(k, convPrefix...)
+	k = append(k, author...)
+	k = append(k, 0)
+	return append(k, peer...)
+}
+
+// AppendDirect stores a direct message in the d: keyspace and refreshes both
+// participants' conversation index entries. toName is the recipient's
+// nickname as far as the sender knows it.
+func (s *messageStore) AppendDirect(m message, toName string) (uint64, error) {
+	return s.appendWith(m, func(b *pebble.Batch, m message, val []byte) error {
+		return s.putDirect(b, m, val, toName)
+	})
+}
+
+// putDirect adds a numbered direct message and both conversation index
+// entries to b.
+func (s *messageStore) putDirect(b *pebble.Batch, m message, val []byte, toName string) error {
+	if err := b.Set(append(dmPrefixFor(m.Author, m.To), encodeSeq(m.ID)...), val, nil); err != nil {
+		return err
+	}
+	if m.Attachment != nil {
+		if err := s.linkAttachment(b, m.Attachment, m.ID); err != nil {
+			return err
+		}
+	}
+	preview := []rune(m.Text)
+	if len(preview) == 0 && m.Attachment != nil {
+		preview = []rune("📎 " + m.Attachment.Name)
+	}
+	if len(preview) > 80 {
+		preview = preview[:80]
+	}
+	entries := []struct {
+		owner string
+		conv  conversation
+	}{
+		{m.Author, conversation{Peer: m.To, Name: toName, LastID: m.ID, LastText: string(preview), TS: m.TS}},
+		{m.To, conversation{Peer: m.Author, Name: m.User, LastID: m.ID, LastText: string(preview), TS: m.TS}},
+	}
+	for _, e := range entries {
+		if e.conv.Name == "" {
+			// Keep the name we already had for this peer
+			if v, closer, err := s.db.Get(convKey(e.owner, e.conv.Peer)); err == nil {
+				var prev conversation
+				if json.Unmarshal(v, &prev) == nil {
+					e.conv.Name = prev.Name
+				}
+				_ = closer.Close()
+			}
+		}
+		cv, _ := json.Marshal(e.conv)
+		if err := b.Set(convKey(e.owner, e.conv.Peer), cv, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadDirect pages backwards through the conversation between two authors.
+func (s *messageStore) LoadDirect(a, b string, before uint64, limit int) ([]message, bool, error) {
+	return s.pageBefore(dmPrefixFor(a, b), before, limit)
+}
+
+// Conversations lists an author's DM partners, most recently active first.
+func (s *messageStore) Conversations(author string) ([]conversation, error) {
+	if s == nil || s.db == nil {
+		return nil, nil
+	}
+	prefix := convKey(author, "")
+	it, err := s.db.NewIter(&pebble.IterOptions{LowerBound: prefix, UpperBound: prefixEnd(prefix)})
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = it.Close() }()
+	var out []conversation
+	for valid := it.First(); valid; valid = it.Next() {
+		var c conversation
+		if err := json.Unmarshal(it.Value(), &c); err == nil {
+			out = append(out, c)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].LastID > out[j].LastID })
+	return out, nil
+}
+
+// sendDirect delivers a private message from one user to the author handle of
+// another. Only the recipient's connections and the sender's own tabs see it.
+func (h *hub) sendDirect(fromUID, toAuthor, text string, att *attachment) error {
+	from := authorID(fromUID)
+	if !isAuthorID(toAuthor) || toAuthor == from {
+		return errBadRecipient
+	}
+	h.mu.RLock()
+	toUID, online := h.authorUID[toAuthor]
+	toName := h.userName[toUID]
+	m := message{TS: time.Now().UTC(), Event: "dm", User: h.userName[fromUID], Author: from, To: toAuthor, Text: text, Attachment: att}
+	h.mu.RUnlock()
+	if !online && h.store == nil {
+		// Nowhere to deliver and nowhere to keep it
+		return errBadRecipient
+	}
+	if h.store != nil {
+		start := time.Now()
+		id, err := h.store.AppendDirect(m, toName)
+		metricAppend.Observe(time.Since(start).Seconds())
+		if err != nil {
+			return err
+		}
+		m.ID = id
+	} else {
+		h.mu.Lock()
+		h.lastID++
+		m.ID = h.lastID
+		h.mu.Unlock()
+	}
+
+	h.mu.RLock()
+	targets := make([]client, 0, 4)
+	for c := range h.userConns[fromUID] {
+		targets = append(targets, c)
+	}
+	if online {
+		for c := range h.userConns[toUID] {
+			targets = append(targets, c)
+		}
+	}
+	h.mu.RUnlock()
+	for _, c := range targets {
+		h.send(c, m)
+	}
+	metricMessages.WithLabelValues("dm").Inc()
+	return nil
+}
+
+// directHistory pages backwards through uid's conversation with peer.
+func (h *hub) directHistory(uid, peer string, before uint64, limit int) ([]message, bool, error) {
+	if limit <= 0 {
+		limit = defaultHistoryPage
+	}
+	if limit > maxHistoryPage {
+		limit = maxHistoryPage
+	}
+	if before == 0 {
+		before = math.MaxUint64
+	}
+	if h.store == nil || !isAuthorID(peer) {
+		return nil, false, nil
+	}
+	return h.store.LoadDirect(authorID(uid), peer, before, limit)
+}
+
+// conversations returns uid's DM list.
+func (h *hub) conversations(uid string) ([]conversation, error) {
+	if h.store == nil {
+		return nil, nil
+	}
+	return h.store.Conversations(authorID(uid))
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/pebble/v2"
+)
+
+// End-to-end encrypted rooms. Members derive an AES-GCM key from a shared
+// passphrase with PBKDF2-SHA256 over the room's salt and send Text as
+//
+//	e2e:v1:<base64(12-byte IV || ciphertext)>
+//
+// with the channel name as additional data. The passphrase never reaches the
+// server, which stores and relays the envelope untouched, refuses plaintext in
+// encrypted rooms and keeps ciphertext out of the search index. Nicknames,
+// timestamps, reactions and the topic remain visible metadata.
+//
+// Encrypted rooms are stored as
+//
+//	e:<channel>   room salt (hex)
+var roomPrefix = []byte("e:")
+
+const (
+	cipherPrefix = "e2e:v1:"
+	maxCipherLen = 64 << 10 // fits a maximum-length message after encryption
+	minCipherLen = 28       // IV plus GCM tag
+)
+
+var (
+	errPlaintext           = errors.New("this channel is end-to-end encrypted; unlock it with the passphrase before sending")
+	errEncryptedAttachment = errors.New("attachments are not encrypted, so they cannot be posted in an end-to-end encrypted channel")
+	errRoomHasHistory      = errors.New("only moderators can encrypt a channel that already has messages")
+	errEncryptDefault      = errors.New("only moderators can encrypt #" + defaultChannel)
+)
+
+// isCiphertext reports whether s is an encrypted-room envelope.
+func isCiphertext(s string) bool {
+	body, ok := strings.CutPrefix(s, cipherPrefix)
+	if !ok || len(s) > maxCipherLen {
+		return false
+	}
+	raw, err := base64.StdEncoding.DecodeString(body)
+	return err == nil && len(raw) >= minCipherLen
+}
+
+// sanitizeText cleans incoming chat text for channel. Ciphertext sent to an
+// encrypted room, alone or as the argument of /me, is passed through as is:
+// it is plain base64 already, and trimming it to the plaintext length limit
+// would make it undecryptable.
+func (h *hub) sanitizeText(channel, s string) string {
+	if isCiphertext(strings.TrimPrefix(s, "/me ")) && h.roomSalt(channel) != "" {
+		return s
+	}
+	return sanitizeString(s, 10000)
+}
+
+func roomKey(channel string) []byte {
+	return append(append([]byte(nil), roomPrefix...), channel...)
+}
+
+// SetRoomSalt marks a channel as end-to-end encrypted.
+func (s *messageStore) SetRoomSalt(channel, salt string) error {
+	if s == nil || s.db == nil {
+		return nil
+	}
+	return s.db.Set(roomKey(channel), []byte(salt), pebble.Sync)
+}
+
+// RoomSalts returns the salts of all encrypted rooms keyed by channel name.
+func (s *messageStore) RoomSalts() (map[string]string, error) {
+	if s == nil || s.db == nil {
+		return nil, nil
+	}
+	it, err := s.db.NewIter(&pebble.IterOptions{LowerBound: roomPrefix, UpperBound: prefixEnd(roomPrefix)})
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = it.Close() }()
+	out := map[string]string{}
+	for valid := it.First(); valid; valid = it.Next() {
+		out[string(it.Key()[len(roomPrefix):])] = string(it.Value())
+	}
+	return out, nil
+}
+
+// roomSalt returns a channel's salt, empty unless it is encrypted.
+func (h *hub) roomSalt(name string) string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if ch, ok := h.channels[name]; ok {
+		return ch.salt
+	}
+	return ""
+}
+
+// bootstrapRoom restores an encrypted room loaded from the store.
+func (h *hub) bootstrapRoom(name, salt string) {
+	h.mu.Lock()
+	h.channelLocked(name).salt = salt
+	h.mu.Unlock()
+}
+
+// checkText rejects plaintext for encrypted rooms.
+func (h *hub) checkText(channel, text string) error {
+	if text != "" && h.roomSalt(channel) != "" && !isCiphertext(text) {
+		return errPlaintext
+	}
+	return nil
+}
+
+// encryptRoom turns on end-to-end encryption for a channel with a fresh salt
+// and announces it. There is no way back: old ciphertext would become
+// unreadable noise in a plaintext room.
+func (h *hub) encryptRoom(name, user string) error {
+	var raw [16]byte
+	_, _ = rand.Read(raw[:])
+	salt := hex.EncodeToString(raw[:])
+	if err := h.store.SetRoomSalt(name, salt); err != nil {
+		return err
+	}
+	h.mu.Lock()
+	h.channelLocked(name).salt = salt
+	h.mu.Unlock()
+	h.broadcast(message{TS: time.Now().UTC(), Channel: name, User: user, Event: "encrypted", Text: salt})
+	return nil
+}
+
+// hasChatLines reports whether a channel holds any chat line or action.
+func (h *hub) hasChatLines(name string) (bool, error) {
+	var before uint64
+	for {
+		page, more, err := h.history(name, before, 0, maxHistoryPage)
+		if err != nil {
+			return true, err
+		}
+		for _, m := range page {
+			if m.Event == "" || m.Event == "me" {
+				return true, nil
+			}
+		}
+		if !more || len(page) == 0 {
+			return false, nil
+		}
+		before = page[0].ID
+	}
+}
+
+func init() {
+	registerCommand(funcCommand{"encrypt", "/encrypt — make this channel end-to-end encrypted with a shared passphrase", cmdEncrypt})
+}
+
+func cmdEncrypt(ctx *commandContext, _ string) error {
+	h := ctx.hub
+	if h.roomSalt(ctx.channel) != "" {
+		ctx.reply("#%s is already end-to-end encrypted", ctx.channel)
+		return nil
+	}
+	if ctx.channel == defaultChannel && !h.isModerator(ctx.uid) {
+		return errEncryptDefault
+	}
+	if !h.isModerator(ctx.uid) {
+		busy, err := h.hasChatLines(ctx.channel)
+		if err != nil {
+			return err
+		}
+		if busy {
+			return errRoomHasHistory
+		}
+	}
+	return h.encryptRoom(ctx.channel, ctx.user)
+}
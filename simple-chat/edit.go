@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"slices"
+	"time"
+	"unicode/utf8"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	errMessageNotFound = errors.New("message not found")
+	errNotAuthor       = errors.New("only the author may change this message")
+	errNotEditable     = errors.New("message cannot be changed")
+)
+
+const (
+	maxReactionRunes = 8  // an emoji with modifiers/ZWJ sequences fits comfortably
+	maxReactionKinds = 20 // distinct emoji per message
+)
+
+// authorID derives the public author handle for a client UID. The UID itself
+// acts as the client's credential, so only this one-way hash is ever sent out.
+// Browsers compute the same value to recognise their own messages.
+func authorID(uid string) string {
+	sum := sha256.Sum256([]byte(uid))
+	return hex.EncodeToString(sum[:8])
+}
+
+// mutate applies fn to message id of a channel in both the store and the
+// in-memory backlog and returns the updated message.
+func (h *hub) mutate(name string, id uint64, fn func(*message) error) (message, error) {
+	if id == 0 {
+		return message{}, errMessageNotFound
+	}
+	if h.store != nil {
+		updated, err := h.store.Update(name, id, fn)
+		if err != nil {
+			return message{}, err
+		}
+		h.mu.Lock()
+		if ch, ok := h.channels[name]; ok {
+			for i := range ch.messages {
+				if ch.messages[i].ID == id {
+					ch.messages[i] = updated
+					break
+				}
+			}
+		}
+		h.mu.Unlock()
+		return updated, nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if ch, ok := h.channels[name]; ok {
+		for i := range ch.messages {
+			if ch.messages[i].ID != id {
+				continue
+			}
+			m := ch.messages[i]
+			m.Reactions = cloneReactions(m.Reactions)
+			if err := fn(&m); err != nil {
+				return message{}, err
+			}
+			ch.messages[i] = m
+			return m, nil
+		}
+	}
+	return message{}, errMessageNotFound
+}
+
+func cloneReactions(r map[string][]string) map[string][]string {
+	if r == nil {
+		return nil
+	}
+	out := make(map[string][]string, len(r))
+	for k, v := range r {
+		out[k] = slices.Clone(v)
+	}
+	return out
+}
+
+// editMessage replaces the text of the caller's own message.
+func (h *hub) editMessage(name string, id uint64, uid, text string) error {
+	if err := h.checkText(name, text); err != nil {
+		return err
+	}
+	author := authorID(uid)
+	_, err := h.mutate(name, id, func(m *message) error {
+		if m.Event != "" || m.Deleted {
+			return errNotEditable
+		}
+		if m.Author != author {
+			return errNotAuthor
+		}
+		m.Text = text
+		m.Edited = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	h.broadcast(message{TS: time.Now().UTC(), Channel: name, Event: "edit", Ref: id, Text: text})
+	return nil
+}
+
+// deleteMessage tombstones the caller's own message, or any message when the
+// caller is a moderator: the record keeps its ID and position in history but
+// loses its text and reactions.
+func (h *hub) deleteMessage(name string, id uint64, uid string) error {
+	author := authorID(uid)
+	mod := h.isModerator(uid)
+	var att *attachment
+	_, err := h.mutate(name, id, func(m *message) error {
+		if (m.Event != "" && m.Event != "me") || m.Deleted {
+			return errNotEditable
+		}
+		if m.Author != author && !mod {
+			return errNotAuthor
+		}
+		m.Text = ""
+		m.Deleted = true
+		m.Edited = false
+		m.Reactions = nil
+		att, m.Attachment = m.Attachment, nil
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if att != nil {
+		if err := h.store.DeleteAttachments([]string{att.ID}); err != nil {
+			log.Warn().Err(err).Msg("[chat] delete attachment")
+		}
+	}
+	h.broadcast(message{TS: time.Now().UTC(), Channel: name, Event: "delete", Ref: id})
+	return nil
+}
+
+// toggleReaction adds the caller's emoji reaction to a message, or removes it
+// when already present.
+func (h *hub) toggleReaction(name string, id uint64, uid, emoji string) error {
+	if emoji == "" || utf8.RuneCountInString(emoji) > maxReactionRunes {
+		return errNotEditable
+	}
+	author := authorID(uid)
+	updated, err := h.mutate(name, id, func(m *message) error {
+		if m.Event != "" || m.Deleted {
+			return errNotEditable
+		}
+		who := m.Reactions[emoji]
+		if i := slices.Index(who, author); i >= 0 {
+			who = slices.Delete(who, i, i+1)
+		} else {
+			if _, ok := m.Reactions[emoji]; !ok && len(m.Reactions) >= maxReactionKinds {
+				return errNotEditable
+			}
+			who = append(who, author)
+		}
+		if m.Reactions == nil {
+			m.Reactions = map[string][]string{}
+		}
+		if len(who) == 0 {
+			delete(m.Reactions, emoji)
+		} else {
+			m.Reactions[emoji] = who
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	h.broadcast(message{TS: time.Now().UTC(), Channel: name, Event: "react", Ref: id, Reactions: updated.Reactions})
+	return nil
+}
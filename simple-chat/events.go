@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Event streams are the fallback transport for networks that refuse
+// websocket upgrades. A client opens
+//
+//	GET  /events                 text/event-stream
+//
+// whose first event, "session", carries a session ID. Every message a
+// websocket would receive then follows as a "data:" line of JSON. Requests
+// travel the other way one at a time as
+//
+//	POST /send?session=<id>      the same JSON object as a websocket frame
+//
+// and go through the same hub code, so joins, rosters, commands and errors
+// behave exactly as on /ws; replies arrive on the stream. The stream is the
+// connection: when it closes the session ends and POSTs get 404.
+
+const (
+	streamKeepalive = 20 * time.Second // comment lines keep proxies from timing out idle streams
+	maxRequestBytes = 1 << 20
+)
+
+var errStreamClosed = errors.New("event stream closed")
+
+// streamClient is a client on an event stream.
+type streamClient struct {
+	id     string
+	w      http.ResponseWriter
+	rc     *http.ResponseController
+	mu     sync.Mutex // serialises writes and guards closed
+	closed bool       // the handler returned; w must not be touched
+	reqMu  sync.Mutex // runs POSTed requests one at a time, like a websocket read loop
+	done   chan struct{}
+	once   sync.Once
+}
+
+func (c *streamClient) write(m message) error {
+	var buf bytes.Buffer
+	buf.WriteString("data: ")
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(m); err != nil {
+		return err
+	}
+	// Encode ends the line; an empty line ends the event
+	buf.WriteByte('\n')
+	return c.writeRaw(buf.Bytes())
+}
+
+func (c *streamClient) writeRaw(p []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return errStreamClosed
+	}
+	_ = c.rc.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := c.w.Write(p)
+	if err == nil {
+		err = c.rc.Flush()
+	}
+	if err != nil {
+		c.stop()
+	}
+	return err
+}
+
+// close ends the stream. The reason has already been sent as an "error"
+// message where there is one; event streams have no close frame.
+func (c *streamClient) close(int, string) {
+	c.stop()
+}
+
+func (c *streamClient) stop() {
+	c.once.Do(func() { close(c.done) })
+}
+
+// handleEvents serves one event stream for its whole lifetime.
+//
+//	GET /events
+func handleEvents(w http.ResponseWriter, r *http.Request, h *hub) {
+	ip := clientIP(r)
+	if until, banned := h.banned("", ip); banned {
+		http.Error(w, banNotice(until), http.StatusForbidden)
+		return
+	}
+	var raw [16]byte
+	_, _ = rand.Read(raw[:])
+	c := &streamClient{id: hex.EncodeToString(raw[:]), w: w, rc: http.NewResponseController(w), done: make(chan struct{})}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // ask nginx-style proxies not to buffer
+	w.WriteHeader(http.StatusOK)
+
+	h.wg.Add(1)
+	h.register(c, ip)
+	h.mu.Lock()
+	h.streams[c.id] = c
+	h.mu.Unlock()
+	defer func() {
+		h.mu.Lock()
+		delete(h.streams, c.id)
+		h.mu.Unlock()
+		h.unregister(c)
+		c.mu.Lock()
+		c.closed = true
+		c.mu.Unlock()
+		h.wg.Done()
+	}()
+	if err := c.writeRaw([]byte("event: session\ndata: " + c.id + "\n\n")); err != nil {
+		return
+	}
+
+	ticker := time.NewTicker(streamKeepalive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if err := c.writeRaw([]byte(": ping\n\n")); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// handleSend runs one request on behalf of an event stream session.
+//
+//	POST /send?session=<id>
+func handleSend(w http.ResponseWriter, r *http.Request, h *hub) {
+	h.mu.RLock()
+	c := h.streams[r.URL.Query().Get("session")]
+	ip := h.connIP[c]
+	h.mu.RUnlock()
+	if c == nil {
+		http.Error(w, "unknown session", http.StatusNotFound)
+		return
+	}
+	var req request
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBytes)).Decode(&req); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	c.reqMu.Lock()
+	ok := h.handle(c, ip, req)
+	c.reqMu.Unlock()
+	if !ok {
+		c.close(websocket.CloseNormalClosure, "")
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
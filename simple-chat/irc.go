@@ -0,0 +1,629 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/rs/zerolog/log"
+)
+
+// The IRC gateway lets terminal clients into the hub over plain TCP. Each
+// IRC connection is a hub client like a websocket: its NICK is its name,
+// JOIN/PART/PRIVMSG become the same requests a browser sends, and hub
+// messages come back as JOIN, PART, PRIVMSG, TOPIC, NICK and NAMES lines.
+// Supported commands are PASS, NICK, USER, JOIN, PART, PRIVMSG, NOTICE,
+// TOPIC, NAMES, PING and QUIT. Edits, deletions, reactions and typing
+// indicators are not relayed.
+//
+// PASS, sent before NICK, sets the client UID so an IRC user can keep the
+// identity (and moderator rights) of their browser. Otherwise each
+// connection gets a fresh one. The gateway speaks plain TCP, so a PASS is
+// readable by anyone on the path.
+
+const (
+	ircIdle      = 5 * time.Minute  // drop connections silent for this long
+	ircPing      = 90 * time.Second // server PING interval
+	ircLineBytes = 400              // text bytes per outgoing PRIVMSG
+)
+
+// ircGateway accepts IRC connections and bridges them into the hub.
+type ircGateway struct {
+	hub  *hub
+	name string // server name used as message prefix
+	ln   net.Listener
+	wg   sync.WaitGroup
+}
+
+// startIRC listens on addr until ctx is cancelled.
+func startIRC(ctx context.Context, h *hub, addr, name string) (*ircGateway, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	g := &ircGateway{hub: h, name: ircServerName(name), ln: ln}
+	g.wg.Add(2)
+	go func() {
+		defer g.wg.Done()
+		<-ctx.Done()
+		_ = ln.Close()
+	}()
+	go func() {
+		defer g.wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Warn().Err(err).Msg("[chat] irc accept")
+				}
+				return
+			}
+			h.wg.Add(1)
+			go func() {
+				defer h.wg.Done()
+				g.serve(conn)
+			}()
+		}
+	}()
+	return g, nil
+}
+
+func (g *ircGateway) wait() {
+	if g != nil {
+		g.wg.Wait()
+	}
+}
+
+// ircClient is a client on an IRC connection.
+type ircClient struct {
+	conn   net.Conn
+	server string
+	uid    string
+	author string
+
+	mu     sync.Mutex           // serialises writes and guards the fields below
+	nick   string               // empty until NICK
+	user   bool                 // USER received
+	joined map[string]time.Time // channels joined, with the time of joining
+	names  map[string][]member  // last roster per joined channel
+	nicks  map[string]string    // author -> last nick seen, for NICK lines
+}
+
+func (c *ircClient) registered() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.nick != "" && c.user
+}
+
+func (c *ircClient) currentNick() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.nick
+}
+
+func (c *ircClient) inChannel(name string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.joined[name]
+	return ok
+}
+
+func (c *ircClient) write(m message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sendLocked(c.translateLocked(m)...)
+}
+
+// send writes raw IRC lines.
+func (c *ircClient) send(lines ...string) {
+	c.mu.Lock()
+	_ = c.sendLocked(lines...)
+	c.mu.Unlock()
+}
+
+// numeric sends a numeric reply addressed to the client's nick.
+func (c *ircClient) numeric(code, params string) {
+	c.mu.Lock()
+	nick := c.nick
+	if nick == "" {
+		nick = "*"
+	}
+	_ = c.sendLocked(fmt.Sprintf(":%s %s %s %s", c.server, code, nick, params))
+	c.mu.Unlock()
+}
+
+func (c *ircClient) sendLocked(lines ...string) error {
+	if len(lines) == 0 {
+		return nil
+	}
+	_ = c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := c.conn.Write([]byte(strings.Join(lines, "\r\n") + "\r\n"))
+	return err
+}
+
+func (c *ircClient) close(_ int, reason string) {
+	if reason == "" {
+		reason = "closing link"
+	}
+	c.send("ERROR :" + reason)
+	_ = c.conn.Close()
+}
+
+// prefix is the source of a line sent on behalf of a chat user.
+func (c *ircClient) prefix(name string) string {
+	return ":" + ircNick(name) + "!chat@" + c.server
+}
+
+// translateLocked turns a hub message into IRC lines. Callers must hold c.mu.
+func (c *ircClient) translateLocked(m message) []string {
+	self := ircNick(m.User) == c.nick
+	since, joined := c.joined[m.Channel]
+	// The backlog replayed on join would arrive as a flood of stale lines
+	live := joined && !m.TS.Before(since)
+	switch m.Event {
+	case "", "me":
+		// IRC does not echo our own lines
+		if !live || m.Author == c.author {
+			return nil
+		}
+		return c.privmsgLocked(c.prefix(m.User), "#"+m.Channel, m)
+	case "dm":
+		if m.Author == c.author {
+			return nil
+		}
+		return c.privmsgLocked(c.prefix(m.User), c.nick, m)
+	case "joined":
+		if live && !self {
+			return []string{c.prefix(m.User) + " JOIN #" + m.Channel}
+		}
+	case "left":
+		if live && !self {
+			return []string{c.prefix(m.User) + " PART #" + m.Channel}
+		}
+	case "topic":
+		if !joined {
+			return nil
+		}
+		if m.User == "" {
+			return []string{fmt.Sprintf(":%s 332 %s #%s :%s", c.server, c.nick, m.Channel, oneLine(m.Text))}
+		}
+		if !live {
+			return nil
+		}
+		return []string{c.prefix(m.User) + " TOPIC #" + m.Channel + " :" + oneLine(m.Text)}
+	case "nick":
+		// Our own rename from another tab or a /nick command
+		old := c.nick
+		c.nick = ircNick(m.User)
+		if c.nick != old {
+			return []string{":" + old + "!chat@" + c.server + " NICK :" + c.nick}
+		}
+	case "roster":
+		if !joined {
+			return nil
+		}
+		var lines []string
+		for _, mem := range m.Members {
+			if prev, ok := c.nicks[mem.Author]; ok && prev != mem.Name && mem.Author != c.author {
+				lines = append(lines, c.prefix(prev)+" NICK :"+ircNick(mem.Name))
+			}
+			c.nicks[mem.Author] = mem.Name
+		}
+		_, listed := c.names[m.Channel]
+		c.names[m.Channel] = m.Members
+		if !listed {
+			lines = append(lines, c.namesLocked(m.Channel)...)
+		}
+		return lines
+	case "encrypted":
+		if joined {
+			return []string{fmt.Sprintf(":%s NOTICE #%s :#%s is end-to-end encrypted; its messages cannot be read or sent over IRC", c.server, m.Channel, m.Channel)}
+		}
+	case "system", "error":
+		target := c.nick
+		if joined {
+			target = "#" + m.Channel
+		}
+		var lines []string
+		for _, l := range splitText(m.Text) {
+			lines = append(lines, fmt.Sprintf(":%s NOTICE %s :%s", c.server, target, l))
+		}
+		return lines
+	}
+	return nil
+}
+
+// privmsgLocked renders a chat line, action or direct message as PRIVMSGs.
+func (c *ircClient) privmsgLocked(prefix, target string, m message) []string {
+	text := m.Text
+	if isCiphertext(text) {
+		text = "[encrypted message]"
+	}
+	if m.Attachment != nil {
+		text = strings.TrimSpace(text + " [attachment: " + m.Attachment.Name + "]")
+	}
+	var lines []string
+	for _, l := range splitText(text) {
+		if m.Event == "me" {
+			l = "\x01ACTION " + l + "\x01"
+		}
+		lines = append(lines, prefix+" PRIVMSG "+target+" :"+l)
+	}
+	return lines
+}
+
+// namesLocked renders the NAMES reply for a channel. Callers must hold c.mu.
+func (c *ircClient) namesLocked(name string) []string {
+	nicks := make([]string, 0, len(c.names[name]))
+	for _, mem := range c.names[name] {
+		nicks = append(nicks, ircNick(mem.Name))
+	}
+	return []string{
+		fmt.Sprintf(":%s 353 %s = #%s :%s", c.server, c.nick, name, strings.Join(nicks, " ")),
+		fmt.Sprintf(":%s 366 %s #%s :End of /NAMES list", c.server, c.nick, name),
+	}
+}
+
+// serve runs one IRC connection until it closes.
+func (g *ircGateway) serve(conn net.Conn) {
+	h := g.hub
+	ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	if until, banned := h.banned("", ip); banned {
+		_, _ = conn.Write([]byte("ERROR :" + banNotice(until) + "\r\n"))
+		_ = conn.Close()
+		return
+	}
+	var raw [16]byte
+	_, _ = rand.Read(raw[:])
+	c := &ircClient{
+		conn:   conn,
+		server: g.name,
+		uid:    "irc-" + hex.EncodeToString(raw[:]),
+		joined: map[string]time.Time{},
+		names:  map[string][]member{},
+		nicks:  map[string]string{},
+	}
+	c.author = authorID(c.uid)
+	h.register(c, ip)
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		h.unregister(c)
+		_ = conn.Close()
+	}()
+	go func() {
+		t := time.NewTicker(ircPing)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				c.send("PING :" + g.name)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	sc := bufio.NewScanner(conn)
+	sc.Buffer(make([]byte, 0, 1024), 8192)
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(ircIdle))
+		if !sc.Scan() {
+			return
+		}
+		cmd, params := parseIRC(sc.Text())
+		if cmd == "" {
+			continue
+		}
+		if !g.command(c, ip, cmd, params) {
+			return
+		}
+	}
+}
+
+// command runs one IRC command. It returns false when the connection must
+// be closed.
+func (g *ircGateway) command(c *ircClient, ip, cmd string, params []string) bool {
+	h := g.hub
+	need := func(n int) bool {
+		if len(params) < n {
+			c.numeric("461", cmd+" :Not enough parameters")
+			return false
+		}
+		return true
+	}
+	// run passes a hub request on as this connection
+	run := func(req request) bool {
+		req.User, req.UID = c.currentNick(), c.uid
+		return h.handle(c, ip, req)
+	}
+
+	switch cmd {
+	case "PING":
+		c.send(":" + g.name + " PONG " + g.name + " :" + strings.Join(params, " "))
+		return true
+	case "PONG", "CAP", "MODE", "WHO":
+		// Harmless client chatter
+		return true
+	case "QUIT":
+		c.send("ERROR :bye")
+		return false
+	case "PASS":
+		if c.registered() {
+			c.numeric("462", ":You may not reregister")
+		} else if need(1) {
+			c.uid = sanitizeString(params[0], 100)
+			c.author = authorID(c.uid)
+		}
+		return true
+	case "NICK":
+		if len(params) == 0 {
+			c.numeric("431", ":No nickname given")
+			return true
+		}
+		nick := params[0]
+		if ircNick(nick) != nick || len(nick) > 30 {
+			c.numeric("432", nick+" :Erroneous nickname")
+			return true
+		}
+		c.mu.Lock()
+		old, wasRegistered := c.nick, c.nick != "" && c.user
+		c.nick = nick
+		c.mu.Unlock()
+		if wasRegistered {
+			c.send(":" + old + "!chat@" + g.name + " NICK :" + nick)
+			// An empty join carries the new name to the hub, which updates rosters
+			return run(request{Type: "join"})
+		}
+		return g.welcome(c, run)
+	case "USER":
+		if !need(1) {
+			return true
+		}
+		c.mu.Lock()
+		c.user = true
+		c.mu.Unlock()
+		return g.welcome(c, run)
+	}
+
+	if !c.registered() {
+		c.numeric("451", ":You have not registered")
+		return true
+	}
+	switch cmd {
+	case "JOIN":
+		if !need(1) {
+			return true
+		}
+		for _, target := range strings.Split(params[0], ",") {
+			name := normalizeChannel(target)
+			if name == "" || !strings.HasPrefix(target, "#") {
+				c.numeric("403", target+" :No such channel")
+				continue
+			}
+			if c.inChannel(name) {
+				continue
+			}
+			c.mu.Lock()
+			c.joined[name] = time.Now().UTC()
+			delete(c.names, name)
+			_ = c.sendLocked(c.prefix(c.nick) + " JOIN #" + name)
+			c.mu.Unlock()
+			if !run(request{Type: "join", Channel: name}) {
+				return false
+			}
+		}
+	case "PART":
+		if !need(1) {
+			return true
+		}
+		for _, target := range strings.Split(params[0], ",") {
+			name := normalizeChannel(target)
+			if !c.inChannel(name) {
+				c.numeric("442", target+" :You're not on that channel")
+				continue
+			}
+			c.mu.Lock()
+			_ = c.sendLocked(c.prefix(c.nick) + " PART #" + name)
+			delete(c.joined, name)
+			delete(c.names, name)
+			c.mu.Unlock()
+			if !run(request{Type: "leave", Channel: name}) {
+				return false
+			}
+		}
+	case "PRIVMSG", "NOTICE":
+		if len(params) < 2 || params[1] == "" {
+			c.numeric("412", ":No text to send")
+			return true
+		}
+		text, action := params[1], false
+		if rest, ok := strings.CutPrefix(text, "\x01ACTION "); ok {
+			text, action = strings.TrimSuffix(rest, "\x01"), true
+		} else if strings.HasPrefix(text, "\x01") {
+			return true // other CTCP requests
+		}
+		line, dm := text, text
+		if strings.HasPrefix(text, "/") {
+			dm = "/" + text // literal slash, not a chat command
+		}
+		if action {
+			line = "/me " + text
+		} else {
+			line = dm
+		}
+		for _, target := range strings.Split(params[0], ",") {
+			if strings.HasPrefix(target, "#") {
+				name := normalizeChannel(target)
+				if !c.inChannel(name) {
+					c.numeric("404", target+" :Cannot send to channel")
+					continue
+				}
+				if !run(request{Channel: name, Text: line}) {
+					return false
+				}
+				continue
+			}
+			uid, err := g.resolveNick(target)
+			if err != nil {
+				c.numeric("401", target+" :"+err.Error())
+				continue
+			}
+			if !run(request{Type: "dm", To: authorID(uid), Text: dm}) {
+				return false
+			}
+		}
+	case "TOPIC":
+		if !need(1) {
+			return true
+		}
+		name := normalizeChannel(params[0])
+		if !c.inChannel(name) {
+			c.numeric("442", params[0]+" :You're not on that channel")
+			return true
+		}
+		if len(params) < 2 {
+			if topic := h.topic(name); topic != "" {
+				c.numeric("332", "#"+name+" :"+oneLine(topic))
+			} else {
+				c.numeric("331", "#"+name+" :No topic is set")
+			}
+			return true
+		}
+		return run(request{Channel: name, Text: "/topic " + params[1]})
+	case "NAMES":
+		if !need(1) {
+			return true
+		}
+		for _, target := range strings.Split(params[0], ",") {
+			name := normalizeChannel(target)
+			c.mu.Lock()
+			_ = c.sendLocked(c.namesLocked(name)...)
+			c.mu.Unlock()
+		}
+	default:
+		c.numeric("421", cmd+" :Unknown command")
+	}
+	return true
+}
+
+// welcome completes registration once both NICK and USER have arrived and
+// introduces the connection to the hub so it can receive direct messages.
+func (g *ircGateway) welcome(c *ircClient, run func(request) bool) bool {
+	if !c.registered() {
+		return true
+	}
+	nick := c.currentNick()
+	c.numeric("001", ":Welcome to "+g.name+", "+nick)
+	c.numeric("002", ":Your host is "+g.name+", a simple-chat IRC gateway")
+	c.numeric("422", ":MOTD File is missing")
+	return run(request{Type: "join"})
+}
+
+// resolveNick finds the UID behind an IRC nick, which may be a chat name with
+// characters IRC does not allow replaced.
+func (g *ircGateway) resolveNick(nick string) (string, error) {
+	if uid, err := g.hub.resolveUser(nick); err != errNoSuchUser {
+		return uid, err
+	}
+	h := g.hub
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for uid, name := range h.userName {
+		if strings.EqualFold(ircNick(name), nick) {
+			return uid, nil
+		}
+	}
+	return "", errNoSuchUser
+}
+
+// parseIRC splits a line into its upper-cased command and parameters,
+// dropping any tags and prefix.
+func parseIRC(line string) (string, []string) {
+	line = strings.TrimRight(line, "\r")
+	if strings.HasPrefix(line, "@") {
+		_, line, _ = strings.Cut(line, " ")
+	}
+	if strings.HasPrefix(line, ":") {
+		_, line, _ = strings.Cut(line, " ")
+	}
+	line, trailing, hasTrailing := strings.Cut(line, " :")
+	if !hasTrailing && strings.HasPrefix(line, ":") {
+		line, trailing, hasTrailing = "", line[1:], true
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", nil
+	}
+	params := fields[1:]
+	if hasTrailing {
+		params = append(params, trailing)
+	}
+	return strings.ToUpper(fields[0]), params
+}
+
+// ircServerName folds the backend display name into a hostname-like token
+// usable as a message prefix: "My Chat" becomes "My-Chat".
+func ircServerName(name string) string {
+	var b strings.Builder
+	for _, r := range strings.TrimSpace(name) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-':
+			b.WriteRune(r)
+		default:
+			b.WriteByte('-')
+		}
+	}
+	if s := strings.Trim(b.String(), ".-"); s != "" {
+		return s
+	}
+	return "simple-chat"
+}
+
+// ircNick maps a chat name onto the characters IRC allows in nicknames.
+func ircNick(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', strings.ContainsRune("_-[]\\`^{}|", r):
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	nick := b.String()
+	if nick == "" || (nick[0] >= '0' && nick[0] <= '9') || nick[0] == '-' {
+		nick = "_" + nick
+	}
+	return nick
+}
+
+func oneLine(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "\r", ""), "\n", " ")
+}
+
+// splitText breaks text into IRC-sized lines at newlines and rune boundaries.
+func splitText(s string) []string {
+	var out []string
+	for _, l := range strings.Split(strings.ReplaceAll(s, "\r", ""), "\n") {
+		for len(l) > ircLineBytes {
+			i := ircLineBytes
+			for i > 0 && !utf8.RuneStart(l[i]) {
+				i--
+			}
+			out = append(out, l[:i])
+			l = l[i:]
+		}
+		if l != "" {
+			out = append(out, l)
+		}
+	}
+	return out
+}
@@ -39,6 +39,19 @@ var (
 	flagDescription string
 	flagTags        string
 	flagOwner       string
+	flagHooksFile   string
+	flagHookIn      []string
+	flagHookOut     []string
+	flagHookSecret  string
+	flagLimits      limitConfig
+	flagAdminKey    string
+	flagAdminUIDs   []string
+	flagRetention   retentionConfig
+	flagUploads     uploadConfig
+	flagIRCListen   string
+	flagSend        sendConfig
+	flagTrusted     []string
+	flagMetricsTok  string
 )
 
 func init() {
@@ -52,6 +65,30 @@ func init() {
 	flags.StringVar(&flagTags, "tags", "chat,simple", "comma-separated lease tags")
 	flags.StringVar(&flagDataPath, "data-path", "", "optional directory to persist chat history via PebbleDB")
 	flags.StringVar(&flagCredKey, "cred-key", "", "optional credential key to use for the listener (base64 encoded)")
+	flags.StringVar(&flagHooksFile, "hooks-file", "", "optional JSON file describing incoming and outgoing webhooks")
+	flags.StringSliceVar(&flagHookIn, "hook-in", nil, "incoming webhook as token=botname[#channel]; repeatable (POST /hooks/{token})")
+	flags.StringSliceVar(&flagHookOut, "hook-out", nil, "outgoing webhook URL that receives every new message; repeatable")
+	flags.StringVar(&flagHookSecret, "hook-secret", "", "HMAC-SHA256 key for signing --hook-out deliveries (X-Chat-Signature)")
+	flags.Float64Var(&flagLimits.Rate, "rate-limit", 1, "messages per second allowed per user (0 disables)")
+	flags.IntVar(&flagLimits.Burst, "rate-burst", 8, "messages a user may send in a burst")
+	flags.Float64Var(&flagLimits.IPRate, "rate-limit-ip", 3, "messages per second allowed per remote address (0 disables)")
+	flags.IntVar(&flagLimits.IPBurst, "rate-burst-ip", 20, "messages a remote address may send in a burst")
+	flags.IntVar(&flagLimits.FloodRepeat, "flood-repeat", 3, "identical messages in a row that count as flooding (0 disables)")
+	flags.DurationVar(&flagLimits.MuteFor, "mute-for", 30*time.Second, "mute after a flood violation; doubles with each repeat")
+	flags.IntVar(&flagLimits.BanAfter, "ban-after", 3, "flood violations before a temporary ban (0 never bans)")
+	flags.DurationVar(&flagLimits.BanFor, "ban-for", 10*time.Minute, "temporary ban length")
+	flags.StringSliceVar(&flagTrusted, "trusted-proxy", nil, "IP or CIDR of a reverse proxy whose X-Forwarded-For is believed; repeatable (otherwise the header is ignored)")
+	flags.StringVar(&flagAdminKey, "admin-key", os.Getenv("CHAT_ADMIN_KEY"), "moderator password for /op (from env CHAT_ADMIN_KEY if set)")
+	flags.StringSliceVar(&flagAdminUIDs, "admin-uid", nil, "client UID that is always a moderator; repeatable")
+	flags.StringVar(&flagMetricsTok, "metrics-token", os.Getenv("CHAT_METRICS_TOKEN"), "bearer token Prometheus presents at /metrics; metrics are off without it (from env CHAT_METRICS_TOKEN if set)")
+	flags.DurationVar(&flagRetention.MaxAge, "retain-age", 0, "delete messages older than this (0 keeps them forever)")
+	flags.IntVar(&flagRetention.MaxCount, "retain-count", 0, "keep at most this many messages per channel or conversation (0 for no limit)")
+	flags.DurationVar(&flagRetention.Every, "retain-every", time.Hour, "how often to enforce --retain-age/--retain-count")
+	flags.Int64Var(&flagUploads.MaxBytes, "max-upload", 10<<20, "largest attachment accepted, in bytes")
+	flags.StringSliceVar(&flagUploads.Types, "upload-types", []string{"image/*", "application/pdf", "application/zip", "text/plain"}, "MIME types accepted as attachments (detected from content)")
+	flags.IntVar(&flagSend.Queue, "send-queue", defaultSendQueue, "messages buffered per connection before new ones are dropped")
+	flags.IntVar(&flagSend.MaxDrops, "slow-drops", 64, "disconnect a client after this many dropped messages in a row (0 only drops)")
+	flags.StringVar(&flagIRCListen, "irc-listen", "", "optional address for an IRC gateway into the chat, e.g. :6667 (plaintext TCP: PASS sends the client UID, and with it any moderator rights, in the clear)")
 }
 
 func main() {
@@ -65,7 +102,15 @@ func runChat(cmd *cobra.Command, args []string) error {
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
+	if err := setTrustedProxies(flagTrusted); err != nil {
+		return err
+	}
 	hub := newHub()
+	hub.attachLimiter(newLimiter(flagLimits))
+	hub.setModerators(flagAdminKey, flagAdminUIDs)
+	hub.setMetricsToken(flagMetricsTok)
+	hub.attachUploads(flagUploads)
+	hub.attachSendPolicy(flagSend)
 
 	// Optional: open persistent store and preload history
 	var store *messageStore
@@ -75,16 +120,62 @@ func runChat(cmd *cobra.Command, args []string) error {
 			log.Warn().Err(err).Msg("[chat] open store failed; running in memory only")
 		} else {
 			store = s
-			// Load only the most recent 100 messages to avoid slow startup
-			if msgs, err := store.LoadRecent(100); err != nil {
-				log.Warn().Err(err).Msg("[chat] load history failed")
-			} else if len(msgs) > 0 {
-				hub.bootstrap(msgs)
-				log.Info().Msgf("[chat] loaded %d recent messages from store", len(msgs))
+			channels, err := store.Channels()
+			if err != nil {
+				log.Warn().Err(err).Msg("[chat] list channels failed")
+			}
+			// Load only the most recent 100 messages per channel to avoid slow startup
+			for _, name := range channels {
+				if msgs, err := store.LoadRecent(name, 100); err != nil {
+					log.Warn().Err(err).Str("channel", name).Msg("[chat] load history failed")
+				} else if len(msgs) > 0 {
+					hub.bootstrap(name, msgs)
+					log.Info().Msgf("[chat] loaded %d recent messages for #%s from store", len(msgs), name)
+				}
+			}
+			if topics, err := store.Topics(); err != nil {
+				log.Warn().Err(err).Msg("[chat] load topics failed")
+			} else {
+				for name, topic := range topics {
+					hub.bootstrapTopic(name, topic)
+				}
+			}
+			if rooms, err := store.RoomSalts(); err != nil {
+				log.Warn().Err(err).Msg("[chat] load encrypted rooms failed")
+			} else {
+				for name, salt := range rooms {
+					hub.bootstrapRoom(name, salt)
+				}
+			}
+			if bans, err := store.Bans(); err != nil {
+				log.Warn().Err(err).Msg("[chat] load bans failed")
+			} else {
+				for _, b := range bans {
+					hub.bootstrapBan(b)
+				}
 			}
 			hub.attachStore(store)
 		}
 	}
+	// Optional webhooks for bots and external integrations
+	hooksCfg, err := loadHooks(flagHooksFile, flagHookIn, flagHookOut, flagHookSecret)
+	if err != nil {
+		return err
+	}
+	hooks := startWebhooks(ctx, hub, hooksCfg)
+	pruner := startRetention(ctx, hub, flagRetention)
+	hub.attachHooks(hooks)
+	if len(hooksCfg.Incoming)+len(hooksCfg.Outgoing) > 0 {
+		log.Info().Msgf("[chat] %d incoming and %d outgoing webhooks configured", len(hooksCfg.Incoming), len(hooksCfg.Outgoing))
+	}
+	var irc *ircGateway
+	if flagIRCListen != "" {
+		if irc, err = startIRC(ctx, hub, flagIRCListen, flagName); err != nil {
+			return fmt.Errorf("irc listen: %w", err)
+		}
+		log.Info().Msgf("[chat] IRC gateway listening on %s", flagIRCListen)
+	}
+
 	// Prepare embedded static files
 	staticFS, err := fs.Sub(embeddedStatic, "static")
 	if err != nil {
@@ -157,6 +248,9 @@ func runChat(cmd *cobra.Command, args []string) error {
 	<-ctx.Done()
 	hub.closeAll()
 	hub.wait()
+	hooks.wait()
+	pruner.wait()
+	irc.wait()
 	if store != nil {
 		if err := store.Close(); err != nil {
 			log.Warn().Err(err).Msg("[chat] store close error")
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Prometheus metrics, served at GET /metrics to scrapers presenting the
+// --metrics-token as a bearer token. Counters and histograms are updated inline;
+// gauges read the hub at scrape time.
+var (
+	metricMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "chat_messages_total",
+		Help: "Messages posted, by kind: channel lines, direct messages (dm) and retained events.",
+	}, []string{"kind"})
+	metricFanout = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "chat_broadcast_fanout_seconds",
+		Help:    "Time to hand one broadcast to the send queue of every member of the channel.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10), // 100µs to ~26s
+	})
+	metricDroppedWrites = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "chat_dropped_writes_total",
+		Help: "Messages not delivered to a connection, by reason: write error or full send queue (queue_full).",
+	}, []string{"reason"})
+	metricSlowDisconnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "chat_slow_consumer_disconnects_total",
+		Help: "Connections closed for falling too far behind.",
+	})
+	metricAppend = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "chat_store_append_seconds",
+		Help:    "Latency of appending a message to the Pebble store.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+	})
+)
+
+// metricsHandler builds a registry with the chat metrics, gauges over h and
+// the standard Go and process collectors, and serves it to requests carrying
+// the metrics token. Without a token the endpoint does not exist.
+func metricsHandler(h *hub) http.Handler {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		metricMessages, metricFanout, metricDroppedWrites, metricSlowDisconnects, metricAppend,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "chat_connections",
+			Help: "Open client connections (websocket, event stream and IRC).",
+		}, func() float64 {
+			h.mu.RLock()
+			defer h.mu.RUnlock()
+			return float64(len(h.conns))
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "chat_users",
+			Help: "Distinct client UIDs with at least one open connection.",
+		}, func() float64 {
+			h.mu.RLock()
+			defer h.mu.RUnlock()
+			return float64(len(h.userConns))
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "chat_backlog_messages",
+			Help: "Messages held in the in-memory channel backlogs.",
+		}, func() float64 {
+			h.mu.RLock()
+			defer h.mu.RUnlock()
+			var n int
+			for _, ch := range h.channels {
+				n += len(ch.messages)
+			}
+			return float64(n)
+		}),
+	)
+	metrics := promhttp.HandlerFor(reg, promhttp.HandlerOpts{})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.mu.RLock()
+		want := h.metricsKey
+		h.mu.RUnlock()
+		if want == "" {
+			http.NotFound(w, r)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(want), []byte(token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		metrics.ServeHTTP(w, r)
+	})
+}
+
+// setMetricsToken sets the bearer token scrapers present at /metrics. It is
+// deliberately not the moderator key, so Prometheus never holds that.
+func (h *hub) setMetricsToken(token string) {
+	h.mu.Lock()
+	h.metricsKey = token
+	h.mu.Unlock()
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/pebble/v2"
+	"github.com/gorilla/websocket"
+)
+
+// Bans are stored under
+//
+//	ban:author:<authorID>
+//	ban:ip:<addr>
+//
+// with a JSON-encoded ban as the value.
+var banPrefix = []byte("ban:")
+
+var (
+	errNotModerator = errors.New("moderators only")
+	errNoSuchUser   = errors.New("no such user online")
+	errAmbiguous    = errors.New("several users have that name; use their author handle")
+)
+
+// ban excludes a user (by author handle, so the UID never leaves the
+// server) or a remote address until a point in time.
+type ban struct {
+	Kind   string    `json:"kind"` // "author" | "ip"
+	Value  string    `json:"value"`
+	Until  time.Time `json:"until,omitzero"` // zero means permanent
+	By     string    `json:"by,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+func (b ban) key() string { return b.Kind + ":" + b.Value }
+
+func (b ban) active(now time.Time) bool { return b.Until.IsZero() || now.Before(b.Until) }
+
+func (b ban) describe() string {
+	s := b.Kind + " " + b.Value
+	if b.Until.IsZero() {
+		s += " permanently"
+	} else {
+		s += " until " + b.Until.UTC().Format(time.RFC3339)
+	}
+	if b.Reason != "" {
+		s += " (" + b.Reason + ")"
+	}
+	return s
+}
+
+// SaveBan stores a ban, replacing an earlier one for the same target.
+func (s *messageStore) SaveBan(b ban) error {
+	if s == nil || s.db == nil {
+		return nil
+	}
+	v, _ := json.Marshal(b)
+	return s.db.Set(append(append([]byte(nil), banPrefix...), b.key()...), v, pebble.Sync)
+}
+
+// DeleteBan lifts a stored ban; key is "author:<id>" or "ip:<addr>".
+func (s *messageStore) DeleteBan(key string) error {
+	if s == nil || s.db == nil {
+		return nil
+	}
+	return s.db.Delete(append(append([]byte(nil), banPrefix...), key...), pebble.Sync)
+}
+
+// Bans returns all stored bans that have not yet expired, deleting the rest.
+func (s *messageStore) Bans() ([]ban, error) {
+	if s == nil || s.db == nil {
+		return nil, nil
+	}
+	it, err := s.db.NewIter(&pebble.IterOptions{LowerBound: banPrefix, UpperBound: prefixEnd(banPrefix)})
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var out []ban
+	var expired []string
+	for valid := it.First(); valid; valid = it.Next() {
+		var b ban
+		if err := json.Unmarshal(it.Value(), &b); err != nil {
+			continue
+		}
+		if b.active(now) {
+			out = append(out, b)
+		} else {
+			expired = append(expired, b.key())
+		}
+	}
+	_ = it.Close()
+	for _, key := range expired {
+		_ = s.DeleteBan(key)
+	}
+	return out, nil
+}
+
+// setModerators configures who may moderate: holders of key (via /op) and
+// the listed UIDs.
+func (h *hub) setModerators(key string, uids []string) {
+	h.mu.Lock()
+	h.adminKey = key
+	for _, uid := range uids {
+		if uid = strings.TrimSpace(uid); uid != "" {
+			h.mods[uid] = true
+		}
+	}
+	h.mu.Unlock()
+}
+
+// adminRequest reports whether an HTTP request carries the admin key as a
+// bearer token. Without --admin-key no request qualifies.
+func (h *hub) adminRequest(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	h.mu.RLock()
+	key := h.adminKey
+	h.mu.RUnlock()
+	return ok && key != "" && subtle.ConstantTimeCompare([]byte(key), []byte(token)) == 1
+}
+
+func (h *hub) isModerator(uid string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.mods[uid]
+}
+
+// bootstrapBan restores a ban loaded from the store.
+func (h *hub) bootstrapBan(b ban) {
+	h.mu.Lock()
+	h.bans[b.key()] = b
+	h.mu.Unlock()
+}
+
+// banned reports whether uid or ip is excluded, by a moderator or by the
+// flood limiter, and until when (zero for permanent bans).
+func (h *hub) banned(uid, ip string) (time.Time, bool) {
+	now := time.Now()
+	h.mu.RLock()
+	for _, key := range []string{"author:" + authorID(uid), "ip:" + ip} {
+		if b, ok := h.bans[key]; ok && b.active(now) {
+			h.mu.RUnlock()
+			return b.Until, true
+		}
+	}
+	h.mu.RUnlock()
+	return h.limits.banned(uid, ip)
+}
+
+func banNotice(until time.Time) string {
+	if until.IsZero() {
+		return "you are banned"
+	}
+	return "you are banned until " + until.UTC().Format(time.RFC3339)
+}
+
+// mutedUntil reports whether a moderator has muted uid.
+func (h *hub) mutedUntil(uid string) (time.Time, bool) {
+	h.mu.RLock()
+	until, ok := h.mutes[uid]
+	h.mu.RUnlock()
+	return until, ok && time.Now().Before(until)
+}
+
+// addBan records and persists a ban and disconnects everyone it covers.
+func (h *hub) addBan(b ban) error {
+	if err := h.store.SaveBan(b); err != nil {
+		return err
+	}
+	h.mu.Lock()
+	h.bans[b.key()] = b
+	var conns []client
+	for c := range h.conns {
+		if (b.Kind == "author" && authorID(h.connUID[c]) == b.Value) || (b.Kind == "ip" && h.connIP[c] == b.Value) {
+			conns = append(conns, c)
+		}
+	}
+	h.mu.Unlock()
+	for _, c := range conns {
+		h.disconnect(c, "banned: "+b.describe())
+	}
+	return nil
+}
+
+// liftBan removes a ban by key ("author:<id>" or "ip:<addr>").
+func (h *hub) liftBan(key string) (bool, error) {
+	h.mu.Lock()
+	_, ok := h.bans[key]
+	delete(h.bans, key)
+	h.mu.Unlock()
+	if !ok {
+		return false, nil
+	}
+	return true, h.store.DeleteBan(key)
+}
+
+// disconnect tells a connection why and closes it; its read loop then
+// cleans up as for any other disconnect.
+func (h *hub) disconnect(c client, reason string) {
+	h.send(c, message{TS: time.Now().UTC(), Event: "error", Text: reason})
+	h.closeAfterQueued(c, websocket.ClosePolicyViolation, reason)
+}
+
+// resolveUser finds the UID of a connected user by nickname or author handle.
+func (h *hub) resolveUser(who string) (string, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if uid, ok := h.authorUID[who]; ok {
+		return uid, nil
+	}
+	var found string
+	for uid, name := range h.userName {
+		if !strings.EqualFold(name, who) {
+			continue
+		}
+		if found != "" {
+			return "", errAmbiguous
+		}
+		found = uid
+	}
+	if found == "" {
+		return "", errNoSuchUser
+	}
+	return found, nil
+}
+
+// connsOf returns the live connections of uid.
+func (h *hub) connsOf(uid string) []client {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	out := make([]client, 0, len(h.userConns[uid]))
+	for c := range h.userConns[uid] {
+		out = append(out, c)
+	}
+	return out
+}
+
+// modCommand wraps a command so only moderators can run it.
+func modCommand(name, usage string, run func(ctx *commandContext, args string) error) command {
+	return funcCommand{name, usage, func(ctx *commandContext, args string) error {
+		if !ctx.hub.isModerator(ctx.uid) {
+			return errNotModerator
+		}
+		return run(ctx, args)
+	}}
+}
+
+func init() {
+	registerCommand(funcCommand{"op", "/op <key> — become a moderator", cmdOp})
+	registerCommand(modCommand("kick", "/kick <user> [reason] — disconnect a user (mod)", cmdKick))
+	registerCommand(modCommand("ban", "/ban <user|ip:addr> [duration] [reason] — ban a user or address (mod)", cmdBan))
+	registerCommand(modCommand("unban", "/unban <author:id|ip:addr> — lift a ban (mod)", cmdUnban))
+	registerCommand(modCommand("bans", "/bans — list active bans (mod)", cmdBans))
+	registerCommand(modCommand("mute", "/mute <user> [duration] — silence a user, 10m by default (mod)", cmdMute))
+	registerCommand(modCommand("unmute", "/unmute <user> — lift a mute (mod)", cmdUnmute))
+	registerCommand(modCommand("remove", "/remove <message id> — delete any message in this channel (mod)", cmdRemove))
+	registerCommand(modCommand("whois", "/whois <user> — show a user's handle and addresses (mod)", cmdWhois))
+}
+
+func cmdOp(ctx *commandContext, args string) error {
+	h := ctx.hub
+	h.mu.Lock()
+	ok := h.adminKey != "" && subtle.ConstantTimeCompare([]byte(h.adminKey), []byte(args)) == 1
+	if ok {
+		h.mods[ctx.uid] = true
+	}
+	h.mu.Unlock()
+	if !ok {
+		return errNotModerator
+	}
+	for _, c := range h.connsOf(ctx.uid) {
+		h.send(c, message{TS: time.Now().UTC(), Event: "op"})
+	}
+	ctx.reply("you are now a moderator")
+	return nil
+}
+
+// splitDuration takes an optional leading duration off args.
+func splitDuration(args string) (time.Duration, string) {
+	first, rest, _ := strings.Cut(args, " ")
+	if d, err := time.ParseDuration(first); err == nil && d > 0 {
+		return d, strings.TrimSpace(rest)
+	}
+	return 0, args
+}
+
+func cmdKick(ctx *commandContext, args string) error {
+	who, reason, _ := strings.Cut(args, " ")
+	if who == "" {
+		return errUsage
+	}
+	uid, err := ctx.hub.resolveUser(who)
+	if err != nil {
+		return err
+	}
+	text := "kicked by " + ctx.user
+	if reason = strings.TrimSpace(reason); reason != "" {
+		text += ": " + reason
+	}
+	for _, c := range ctx.hub.connsOf(uid) {
+		ctx.hub.disconnect(c, text)
+	}
+	ctx.reply("kicked %s", who)
+	return nil
+}
+
+func cmdBan(ctx *commandContext, args string) error {
+	who, rest, _ := strings.Cut(args, " ")
+	if who == "" {
+		return errUsage
+	}
+	d, reason := splitDuration(strings.TrimSpace(rest))
+	b := ban{By: ctx.user, Reason: sanitizeString(reason, 200)}
+	if addr, ok := strings.CutPrefix(who, "ip:"); ok {
+		b.Kind, b.Value = "ip", addr
+	} else {
+		uid, err := ctx.hub.resolveUser(who)
+		if err != nil {
+			return err
+		}
+		if uid == ctx.uid {
+			return errors.New("you cannot ban yourself")
+		}
+		b.Kind, b.Value = "author", authorID(uid)
+	}
+	if d > 0 {
+		b.Until = time.Now().Add(d).UTC()
+	}
+	if err := ctx.hub.addBan(b); err != nil {
+		return err
+	}
+	ctx.reply("banned %s — lift with /unban %s", who, b.key())
+	return nil
+}
+
+func cmdUnban(ctx *commandContext, args string) error {
+	if args == "" {
+		return errUsage
+	}
+	ok, err := ctx.hub.liftBan(args)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("no ban for %s", args)
+	}
+	ctx.reply("lifted ban on %s", args)
+	return nil
+}
+
+func cmdBans(ctx *commandContext, _ string) error {
+	h := ctx.hub
+	now := time.Now()
+	h.mu.RLock()
+	var lines []string
+	for key, b := range h.bans {
+		if b.active(now) {
+			lines = append(lines, key+" — "+b.describe())
+		}
+	}
+	h.mu.RUnlock()
+	if len(lines) == 0 {
+		ctx.reply("no active bans")
+		return nil
+	}
+	sort.Strings(lines)
+	ctx.reply("%d bans:\n%s", len(lines), strings.Join(lines, "\n"))
+	return nil
+}
+
+func cmdMute(ctx *commandContext, args string) error {
+	who, rest, _ := strings.Cut(args, " ")
+	if who == "" {
+		return errUsage
+	}
+	d, _ := splitDuration(strings.TrimSpace(rest))
+	if d == 0 {
+		d = 10 * time.Minute
+	}
+	uid, err := ctx.hub.resolveUser(who)
+	if err != nil {
+		return err
+	}
+	h := ctx.hub
+	h.mu.Lock()
+	h.mutes[uid] = time.Now().Add(d)
+	h.mu.Unlock()
+	for _, c := range h.connsOf(uid) {
+		h.send(c, message{TS: time.Now().UTC(), Channel: ctx.channel, Event: "system", Text: fmt.Sprintf("you were muted by %s for %s", ctx.user, d)})
+	}
+	ctx.reply("muted %s for %s", who, d)
+	return nil
+}
+
+func cmdUnmute(ctx *commandContext, args string) error {
+	if args == "" {
+		return errUsage
+	}
+	uid, err := ctx.hub.resolveUser(args)
+	if err != nil {
+		return err
+	}
+	ctx.hub.mu.Lock()
+	delete(ctx.hub.mutes, uid)
+	ctx.hub.mu.Unlock()
+	ctx.reply("unmuted %s", args)
+	return nil
+}
+
+func cmdRemove(ctx *commandContext, args string) error {
+	id, err := strconv.ParseUint(strings.TrimPrefix(args, "#"), 10, 64)
+	if err != nil {
+		return errUsage
+	}
+	return ctx.hub.deleteMessage(ctx.channel, id, ctx.uid)
+}
+
+func cmdWhois(ctx *commandContext, args string) error {
+	if args == "" {
+		return errUsage
+	}
+	uid, err := ctx.hub.resolveUser(args)
+	if err != nil {
+		return err
+	}
+	h := ctx.hub
+	h.mu.RLock()
+	name := h.userName[uid]
+	addrs := map[string]struct{}{}
+	for c := range h.userConns[uid] {
+		addrs[h.connIP[c]] = struct{}{}
+	}
+	mod := h.mods[uid]
+	h.mu.RUnlock()
+	list := make([]string, 0, len(addrs))
+	for a := range addrs {
+		list = append(list, a)
+	}
+	sort.Strings(list)
+	ctx.reply("%s: author:%s, %d connections from %s, moderator=%t", name, authorID(uid), len(h.connsOf(uid)), strings.Join(list, " "), mod)
+	return nil
+}
@@ -3,19 +3,49 @@ package main
 import (
 	"encoding/binary"
 	"encoding/json"
+	"math"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/cockroachdb/pebble/v2"
 )
 
+// Key layout:
+//
+//	m:<channel>\x00<seq>         chat message, seq is an 8-byte big-endian number
+//	d:<author>-<author>\x00<seq> direct message between two authors (sorted pair)
+//	dc:<author>\x00<peer>        conversation index entry for author's DM list
+//	t:<channel>                  channel topic
+//	x:...                        full-text index, see search.go
+//	a:<id>                       attachment metadata, see attach.go
+//	e:<channel>                  salt of an end-to-end encrypted room, see e2e.go
+//	meta:next                    next sequence number to hand out
+//
+// transfer.go moves these records between stores as JSON Lines.
+//
+// Sequence numbers are global across all keyspaces and increase monotonically,
+// so every channel's or conversation's history sorts chronologically under its
+// own prefix.
+var (
+	msgPrefix   = []byte("m:")
+	dmPrefix    = []byte("d:")
+	convPrefix  = []byte("dc:")
+	topicPrefix = []byte("t:")
+	metaNextKey = []byte("meta:next")
+)
+
 // messageStore persists chat messages in a PebbleDB key-value store.
-// Keys are 8-byte big-endian sequence numbers increasing monotonically.
 type messageStore struct {
-	db   *pebble.DB
-	mu   sync.Mutex
-	next uint64
+	db      *pebble.DB
+	mu      sync.Mutex
+	next    uint64
+	blobDir string // attachment files
+
+	statsMu sync.Mutex // serialises Stats so a burst of requests scans once
+	statsAt time.Time
+	stats   storeStats
 }
 
 func openMessageStore(dir string) (*messageStore, error) {
@@ -31,100 +61,348 @@ func openMessageStore(dir string) (*messageStore, error) {
 	if err != nil {
 		return nil, err
 	}
-	s := &messageStore{db: db}
-	// Discover next sequence by reading the last key.
-	it, err := db.NewIter(nil)
-	if err != nil {
+	s := &messageStore{db: db, blobDir: filepath.Join(filepath.Clean(dir), "attachments")}
+	if v, closer, err := db.Get(metaNextKey); err == nil {
+		if len(v) == 8 {
+			s.next = binary.BigEndian.Uint64(v)
+		}
+		_ = closer.Close()
+	} else if err != pebble.ErrNotFound {
+		_ = db.Close()
+		return nil, err
+	}
+	if err := s.migrateLegacy(); err != nil {
+		_ = db.Close()
 		return nil, err
 	}
+	if err := s.repairNext(); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	// ID 0 means "no cursor" to the history API, so sequences start at 1.
+	if s.next == 0 {
+		s.next = 1
+	}
+	if err := s.buildIndex(); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// migrateLegacy moves messages written before channels existed (bare 8-byte
+// sequence keys) into the default channel.
+func (s *messageStore) migrateLegacy() error {
+	it, err := s.db.NewIter(&pebble.IterOptions{UpperBound: []byte{1}})
+	if err != nil {
+		return err
+	}
 	defer func() { _ = it.Close() }()
-	if it.Last() {
-		if len(it.Key()) >= 8 {
-			s.next = binary.BigEndian.Uint64(it.Key()[:8]) + 1
+	b := s.db.NewBatch()
+	defer func() { _ = b.Close() }()
+	for it.First(); it.Valid(); it.Next() {
+		k := it.Key()
+		if len(k) != 8 {
+			continue
+		}
+		seq := binary.BigEndian.Uint64(k)
+		if err := b.Set(msgKey(defaultChannel, seq), it.Value(), nil); err != nil {
+			return err
+		}
+		if err := b.Delete(k, nil); err != nil {
+			return err
+		}
+		if seq >= s.next {
+			s.next = seq + 1
 		}
 	}
-	return s, nil
+	if b.Empty() {
+		return nil
+	}
+	if err := b.Set(metaNextKey, encodeSeq(s.next), nil); err != nil {
+		return err
+	}
+	return b.Commit(pebble.Sync)
+}
+
+func encodeSeq(seq uint64) []byte {
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, seq)
+	return v
 }
 
-func (s *messageStore) Append(m message) error {
+// channelPrefix returns the key prefix shared by all messages of a channel.
+func channelPrefix(channel string) []byte {
+	p := make([]byte, 0, len(msgPrefix)+len(channel)+1)
+	p = append(p, msgPrefix...)
+	p = append(p, channel...)
+	return append(p, 0)
+}
+
+func msgKey(channel string, seq uint64) []byte {
+	return append(channelPrefix(channel), encodeSeq(seq)...)
+}
+
+// prefixEnd returns the smallest key greater than every key starting with p.
+func prefixEnd(p []byte) []byte {
+	end := append([]byte(nil), p...)
+	for i := len(end) - 1; i >= 0; i-- {
+		end[i]++
+		if end[i] != 0 {
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// Append stores a message under the next sequence number and returns that
+// number, which doubles as the message ID.
+func (s *messageStore) Append(m message) (uint64, error) {
+	return s.appendWith(m, s.putChannel)
+}
+
+// putChannel adds a numbered channel message, its attachment link and its
+// search postings to b.
+func (s *messageStore) putChannel(b *pebble.Batch, m message, val []byte) error {
+	if err := b.Set(msgKey(m.Channel, m.ID), val, nil); err != nil {
+		return err
+	}
+	if m.Attachment != nil {
+		if err := s.linkAttachment(b, m.Attachment, m.ID); err != nil {
+			return err
+		}
+	}
+	return indexMessage(b, m, false)
+}
+
+// appendWith assigns the next sequence number to m and commits whatever write
+// puts m into the batch together with the bumped counter.
+func (s *messageStore) appendWith(m message, write func(b *pebble.Batch, m message, val []byte) error) (uint64, error) {
 	if s == nil || s.db == nil {
-		return nil
+		return 0, nil
 	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	key := make([]byte, 8)
-	binary.BigEndian.PutUint64(key, s.next)
-	s.next++
+	m.ID = s.next
 	val, _ := json.Marshal(m)
-	return s.db.Set(key, val, pebble.Sync)
+	b := s.db.NewBatch()
+	defer func() { _ = b.Close() }()
+	if err := write(b, m, val); err != nil {
+		return 0, err
+	}
+	if err := b.Set(metaNextKey, encodeSeq(m.ID+1), nil); err != nil {
+		return 0, err
+	}
+	if err := b.Commit(pebble.Sync); err != nil {
+		return 0, err
+	}
+	s.next++
+	return m.ID, nil
 }
 
-func (s *messageStore) LoadAll() ([]message, error) {
+// Update rewrites a stored message in place. fn receives the current record
+// and may reject the change by returning an error, which Update passes through.
+func (s *messageStore) Update(channel string, id uint64, fn func(*message) error) (message, error) {
+	if s == nil || s.db == nil {
+		return message{}, errMessageNotFound
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := msgKey(channel, id)
+	val, closer, err := s.db.Get(key)
+	if err == pebble.ErrNotFound {
+		return message{}, errMessageNotFound
+	} else if err != nil {
+		return message{}, err
+	}
+	m, ok := decodeMessage(key, val)
+	_ = closer.Close()
+	m.Channel = channel
+	if !ok {
+		return message{}, errMessageNotFound
+	}
+	old := m
+	if err := fn(&m); err != nil {
+		return message{}, err
+	}
+	out, _ := json.Marshal(m)
+	b := s.db.NewBatch()
+	defer func() { _ = b.Close() }()
+	if err := b.Set(key, out, nil); err != nil {
+		return message{}, err
+	}
+	// Re-index when the text changed (edits) or the message was tombstoned
+	if old.Text != m.Text || old.Deleted != m.Deleted {
+		if err := indexMessage(b, old, true); err != nil {
+			return message{}, err
+		}
+		if err := indexMessage(b, m, false); err != nil {
+			return message{}, err
+		}
+	}
+	if err := b.Commit(pebble.Sync); err != nil {
+		return message{}, err
+	}
+	return m, nil
+}
+
+// SetTopic stores a channel's topic; an empty topic removes it.
+func (s *messageStore) SetTopic(channel, topic string) error {
+	if s == nil || s.db == nil {
+		return nil
+	}
+	key := append(append([]byte(nil), topicPrefix...), channel...)
+	if topic == "" {
+		return s.db.Delete(key, pebble.Sync)
+	}
+	return s.db.Set(key, []byte(topic), pebble.Sync)
+}
+
+// Topics returns all stored channel topics keyed by channel name.
+func (s *messageStore) Topics() (map[string]string, error) {
 	if s == nil || s.db == nil {
 		return nil, nil
 	}
-	it, err := s.db.NewIter(nil)
+	it, err := s.db.NewIter(&pebble.IterOptions{LowerBound: topicPrefix, UpperBound: prefixEnd(topicPrefix)})
 	if err != nil {
 		return nil, err
 	}
 	defer func() { _ = it.Close() }()
-	out := make([]message, 0, 256)
-	for it.First(); it.Valid(); it.Next() {
-		var m message
-		if err := json.Unmarshal(it.Value(), &m); err == nil {
-			out = append(out, m)
-		}
+	out := map[string]string{}
+	for valid := it.First(); valid; valid = it.Next() {
+		out[string(it.Key()[len(topicPrefix):])] = string(it.Value())
 	}
 	return out, nil
 }
 
-// LoadRecent loads the most recent N messages from the store.
-// If limit <= 0, it loads all messages (same as LoadAll).
-func (s *messageStore) LoadRecent(limit int) ([]message, error) {
+// Channels lists every channel that has at least one stored message.
+func (s *messageStore) Channels() ([]string, error) {
 	if s == nil || s.db == nil {
 		return nil, nil
 	}
-	if limit <= 0 {
-		return s.LoadAll()
-	}
-	it, err := s.db.NewIter(nil)
+	it, err := s.db.NewIter(&pebble.IterOptions{LowerBound: msgPrefix, UpperBound: prefixEnd(msgPrefix)})
 	if err != nil {
 		return nil, err
 	}
 	defer func() { _ = it.Close() }()
+	var out []string
+	for valid := it.First(); valid; {
+		rest := it.Key()[len(msgPrefix):]
+		i := 0
+		for i < len(rest) && rest[i] != 0 {
+			i++
+		}
+		name := string(rest[:i])
+		out = append(out, name)
+		// Skip the rest of this channel's messages in one seek.
+		valid = it.SeekGE(prefixEnd(channelPrefix(name)))
+	}
+	return out, nil
+}
 
-	// First, count total messages to calculate where to start
-	var total int
-	for it.First(); it.Valid(); it.Next() {
-		total++
+func (s *messageStore) LoadAll(channel string) ([]message, error) {
+	msgs, _, err := s.LoadAfter(channel, 0, 0)
+	return msgs, err
+}
+
+// LoadRecent loads the most recent N messages of a channel from the store.
+// If limit <= 0, it loads the whole channel history.
+func (s *messageStore) LoadRecent(channel string, limit int) ([]message, error) {
+	msgs, _, err := s.LoadBefore(channel, math.MaxUint64, limit)
+	return msgs, err
+}
+
+// LoadBefore returns up to limit messages with IDs strictly below before, in
+// chronological order. more reports whether older messages remain.
+func (s *messageStore) LoadBefore(channel string, before uint64, limit int) ([]message, bool, error) {
+	msgs, more, err := s.pageBefore(channelPrefix(channel), before, limit)
+	for i := range msgs {
+		msgs[i].Channel = channel
 	}
+	return msgs, more, err
+}
 
-	// If total is less than limit, load all
-	if total <= limit {
-		out := make([]message, 0, total)
-		for it.First(); it.Valid(); it.Next() {
-			var m message
-			if err := json.Unmarshal(it.Value(), &m); err == nil {
-				out = append(out, m)
-			}
+// LoadAfter returns up to limit messages with IDs strictly above after, in
+// chronological order. more reports whether newer messages remain.
+func (s *messageStore) LoadAfter(channel string, after uint64, limit int) ([]message, bool, error) {
+	msgs, more, err := s.pageAfter(channelPrefix(channel), after, limit)
+	for i := range msgs {
+		msgs[i].Channel = channel
+	}
+	return msgs, more, err
+}
+
+// pageBefore reads up to limit records keyed prefix+<seq> with seq < before,
+// returned in ascending order.
+func (s *messageStore) pageBefore(prefix []byte, before uint64, limit int) (msgs []message, more bool, err error) {
+	if s == nil || s.db == nil {
+		return nil, false, nil
+	}
+	upper := prefixEnd(prefix)
+	if before != math.MaxUint64 {
+		upper = append(append([]byte(nil), prefix...), encodeSeq(before)...)
+	}
+	it, err := s.db.NewIter(&pebble.IterOptions{LowerBound: prefix, UpperBound: upper})
+	if err != nil {
+		return nil, false, err
+	}
+	defer func() { _ = it.Close() }()
+
+	// Walk backwards from the cursor so only the requested window is read.
+	for valid := it.Last(); valid; valid = it.Prev() {
+		if limit > 0 && len(msgs) >= limit {
+			more = true
+			break
 		}
-		return out, nil
+		if m, ok := decodeMessage(it.Key(), it.Value()); ok {
+			msgs = append(msgs, m)
+		}
+	}
+	for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
+		msgs[i], msgs[j] = msgs[j], msgs[i]
+	}
+	return msgs, more, nil
+}
+
+// pageAfter reads up to limit records keyed prefix+<seq> with seq > after,
+// returned in ascending order.
+func (s *messageStore) pageAfter(prefix []byte, after uint64, limit int) (msgs []message, more bool, err error) {
+	if s == nil || s.db == nil || after == math.MaxUint64 {
+		return nil, false, nil
 	}
+	lower := prefix
+	if after > 0 {
+		lower = append(append([]byte(nil), prefix...), encodeSeq(after+1)...)
+	}
+	it, err := s.db.NewIter(&pebble.IterOptions{LowerBound: lower, UpperBound: prefixEnd(prefix)})
+	if err != nil {
+		return nil, false, err
+	}
+	defer func() { _ = it.Close() }()
 
-	// Otherwise, skip to the position where we want to start
-	skip := total - limit
-	out := make([]message, 0, limit)
-	idx := 0
-	for it.First(); it.Valid(); it.Next() {
-		if idx >= skip {
-			var m message
-			if err := json.Unmarshal(it.Value(), &m); err == nil {
-				out = append(out, m)
-			}
+	for valid := it.First(); valid; valid = it.Next() {
+		if limit > 0 && len(msgs) >= limit {
+			more = true
+			break
+		}
+		if m, ok := decodeMessage(it.Key(), it.Value()); ok {
+			msgs = append(msgs, m)
 		}
-		idx++
 	}
-	return out, nil
+	return msgs, more, nil
+}
+
+// decodeMessage unmarshals a stored value. The ID is implied by the key, as
+// older records did not carry it.
+func decodeMessage(key, val []byte) (message, bool) {
+	var m message
+	if err := json.Unmarshal(val, &m); err != nil {
+		return m, false
+	}
+	if len(key) >= 8 {
+		m.ID = binary.BigEndian.Uint64(key[len(key)-8:])
+	}
+	return m, true
 }
 
 func (s *messageStore) Close() error {
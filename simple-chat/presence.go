@@ -0,0 +1,180 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// Presence states reported by clients. A user with no recorded state is
+// active; any chat line or direct message also marks them active again.
+const (
+	presenceActive = "active"
+	presenceIdle   = "idle" // no input for a while
+	presenceAway   = "away" // tab hidden or idle for long
+)
+
+// typingInterval is the minimum gap between fanned-out "typing" events per
+// user and target; clients send one every few seconds while composing.
+const typingInterval = 2 * time.Second
+
+// maxReadMarks bounds the read positions kept per user.
+const maxReadMarks = 256
+
+func validPresence(state string) bool {
+	return state == presenceActive || state == presenceIdle || state == presenceAway
+}
+
+// setPresence records uid's state and announces changes to every channel the
+// user is in. Unknown states are ignored.
+func (h *hub) setPresence(uid, state string) {
+	if !validPresence(state) {
+		return
+	}
+	h.mu.Lock()
+	prev := h.presence[uid]
+	if prev == "" {
+		prev = presenceActive
+	}
+	if state == presenceActive {
+		delete(h.presence, uid)
+	} else {
+		h.presence[uid] = state
+	}
+	name := h.userName[uid]
+	chans := map[string]struct{}{}
+	for c := range h.userConns[uid] {
+		for ch := range h.connChans[c] {
+			chans[ch] = struct{}{}
+		}
+	}
+	h.mu.Unlock()
+	if prev == state {
+		return
+	}
+	for ch := range chans {
+		h.broadcast(message{TS: time.Now().UTC(), Channel: ch, User: name, Author: authorID(uid), Event: "presence", State: state})
+	}
+}
+
+// presenceLocked returns uid's state. Callers must hold h.mu.
+func (h *hub) presenceLocked(uid string) string {
+	if s := h.presence[uid]; s != "" {
+		return s
+	}
+	return presenceActive
+}
+
+// typing tells the channel, or the DM peer when to is set, that uid is
+// composing a message. Repeats within typingInterval are dropped.
+func (h *hub) typing(uid, channel, to string) {
+	target := channel
+	if to != "" {
+		target = "@" + to
+	}
+	now := time.Now()
+	h.mu.Lock()
+	key := uid + "\x00" + target
+	if !h.validTargetLocked(uid, channel, to) || now.Sub(h.typingAt[key]) < typingInterval {
+		h.mu.Unlock()
+		return
+	}
+	h.typingAt[key] = now
+	name := h.userName[uid]
+	h.mu.Unlock()
+	m := message{TS: now.UTC(), User: name, Author: authorID(uid), Event: "typing"}
+	if to != "" {
+		m.To = to
+		h.sendToAuthor(to, m)
+		return
+	}
+	m.Channel = channel
+	h.broadcast(m)
+}
+
+// validTargetLocked reports whether uid may send typing and read events to
+// channel, or to the DM peer to when set: a channel the user is in, or a
+// connected user other than themselves. Callers must hold h.mu.
+func (h *hub) validTargetLocked(uid, channel, to string) bool {
+	if len(h.userConns[uid]) == 0 {
+		return false
+	}
+	if to != "" {
+		_, online := h.authorUID[to]
+		return isAuthorID(to) && online && to != authorID(uid)
+	}
+	ch, ok := h.channels[channel]
+	return ok && h.memberLocked(ch, uid, nil)
+}
+
+// markRead records that uid has read channel (or the DM with to) up to ref
+// and tells the other side. Read positions only move forwards.
+func (h *hub) markRead(uid, channel, to string, ref uint64) {
+	if ref == 0 {
+		return
+	}
+	target := channel
+	if to != "" {
+		target = "@" + to
+	}
+	h.mu.Lock()
+	if !h.validTargetLocked(uid, channel, to) {
+		h.mu.Unlock()
+		return
+	}
+	reads := h.lastRead[uid]
+	if reads == nil {
+		reads = map[string]uint64{}
+		h.lastRead[uid] = reads
+	}
+	if ref <= reads[target] {
+		h.mu.Unlock()
+		return
+	}
+	if _, ok := reads[target]; !ok && len(reads) >= maxReadMarks {
+		// Forget an arbitrary mark, preferring DMs over channels
+		evict := ""
+		for k := range reads {
+			if evict = k; strings.HasPrefix(k, "@") {
+				break
+			}
+		}
+		delete(reads, evict)
+	}
+	reads[target] = ref
+	name := h.userName[uid]
+	h.mu.Unlock()
+	m := message{TS: time.Now().UTC(), User: name, Author: authorID(uid), Event: "read", Ref: ref}
+	if to != "" {
+		m.To = to
+		h.sendToAuthor(to, m)
+		return
+	}
+	m.Channel = channel
+	h.broadcast(m)
+}
+
+// sendToAuthor delivers an ephemeral event to the connections of the user
+// behind an author handle, if they are online.
+func (h *hub) sendToAuthor(author string, m message) {
+	h.mu.RLock()
+	uid, online := h.authorUID[author]
+	h.mu.RUnlock()
+	if !online {
+		return
+	}
+	for _, c := range h.connsOf(uid) {
+		h.send(c, m)
+	}
+}
+
+// forgetPresenceLocked drops the ephemeral state of a user whose last connection
+// closed. Callers must hold h.mu.
+func (h *hub) forgetPresenceLocked(uid string) {
+	delete(h.presence, uid)
+	delete(h.lastRead, uid)
+	for key := range h.typingAt {
+		if strings.HasPrefix(key, uid+"\x00") {
+			delete(h.typingAt, key)
+		}
+	}
+}
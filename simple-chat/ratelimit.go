@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// limitConfig holds the flood-protection thresholds. A zero rate disables
+// the corresponding bucket; zero FloodRepeat or BanAfter disables duplicate
+// detection or banning respectively.
+type limitConfig struct {
+	Rate        float64       // messages per second per UID
+	Burst       int           // bucket size per UID
+	IPRate      float64       // messages per second per remote address
+	IPBurst     int           // bucket size per remote address
+	FloodRepeat int           // identical messages in a row that count as flooding
+	MuteFor     time.Duration // first mute; doubles with each further violation
+	BanAfter    int           // violations before a temporary ban
+	BanFor      time.Duration
+}
+
+// limitVerdict is the outcome of checking one incoming message.
+type limitVerdict int
+
+const (
+	limitOK     limitVerdict = iota
+	limitMuted               // dropped: the sender is (now) muted
+	limitBanned              // dropped: the sender is (now) banned; close the connection
+)
+
+const (
+	floodRepeatWindow = 30 * time.Second // identical messages further apart are not repeats
+	strikeDecay       = 10 * time.Minute // violations are forgotten after this long
+	limiterIdle       = 30 * time.Minute // state untouched this long is swept
+)
+
+// offender is the per-key limiter state. Keys are "uid:<uid>" or "ip:<addr>".
+type offender struct {
+	tokens      float64
+	refilled    time.Time
+	lastText    string
+	lastTextAt  time.Time
+	repeats     int
+	strikes     int
+	lastStrike  time.Time
+	mutedUntil  time.Time
+	bannedUntil time.Time
+}
+
+// limiter applies token buckets per UID and per remote address, detects
+// repeated identical messages and escalates violations from a mute to a
+// temporary ban.
+type limiter struct {
+	cfg       limitConfig
+	mu        sync.Mutex
+	state     map[string]*offender
+	lastSweep time.Time
+}
+
+func newLimiter(cfg limitConfig) *limiter {
+	return &limiter{cfg: cfg, state: map[string]*offender{}, lastSweep: time.Now()}
+}
+
+func (l *limiter) get(key string, burst int, now time.Time) *offender {
+	o, ok := l.state[key]
+	if !ok {
+		o = &offender{tokens: float64(burst), refilled: now}
+		l.state[key] = o
+	}
+	return o
+}
+
+// take refills o's bucket and removes one token, reporting whether one was available.
+func (o *offender) take(rate float64, burst int, now time.Time) bool {
+	if rate <= 0 {
+		return true
+	}
+	o.tokens = min(float64(burst), o.tokens+now.Sub(o.refilled).Seconds()*rate)
+	o.refilled = now
+	if o.tokens < 1 {
+		return false
+	}
+	o.tokens--
+	return true
+}
+
+// banned reports whether uid or ip is currently banned, and until when.
+func (l *limiter) banned(uid, ip string) (time.Time, bool) {
+	if l == nil {
+		return time.Time{}, false
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, key := range []string{"uid:" + uid, "ip:" + ip} {
+		if o, ok := l.state[key]; ok && now.Before(o.bannedUntil) {
+			return o.bannedUntil, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// allow checks one message-producing request. text is the chat text for
+// duplicate detection, empty for reactions and other non-text requests.
+// The returned time is when the mute or ban ends.
+func (l *limiter) allow(uid, ip, text string) (limitVerdict, time.Time) {
+	if l == nil {
+		return limitOK, time.Time{}
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+
+	u := l.get("uid:"+uid, l.cfg.Burst, now)
+	a := l.get("ip:"+ip, l.cfg.IPBurst, now)
+	for _, o := range []*offender{u, a} {
+		if now.Before(o.bannedUntil) {
+			return limitBanned, o.bannedUntil
+		}
+	}
+	// Tokens are spent even while muted, so a sender who keeps flooding
+	// through a mute is struck again as soon as it ends.
+	var over *offender
+	switch {
+	case !u.take(l.cfg.Rate, l.cfg.Burst, now):
+		over = u
+	case !a.take(l.cfg.IPRate, l.cfg.IPBurst, now):
+		over = a
+	}
+	for _, o := range []*offender{u, a} {
+		if now.Before(o.mutedUntil) {
+			return limitMuted, o.mutedUntil
+		}
+	}
+	if over != nil {
+		return l.strike(over, now)
+	}
+	if text != "" && l.cfg.FloodRepeat > 0 {
+		if text == u.lastText && now.Sub(u.lastTextAt) < floodRepeatWindow {
+			u.repeats++
+		} else {
+			u.lastText, u.repeats = text, 1
+		}
+		u.lastTextAt = now
+		if u.repeats >= l.cfg.FloodRepeat {
+			u.repeats = 0
+			return l.strike(u, now)
+		}
+	}
+	return limitOK, time.Time{}
+}
+
+// strike records a violation, muting for MuteFor doubled per earlier strike
+// or banning once BanAfter strikes accumulate.
+func (l *limiter) strike(o *offender, now time.Time) (limitVerdict, time.Time) {
+	if now.Sub(o.lastStrike) > strikeDecay {
+		o.strikes = 0
+	}
+	o.strikes++
+	o.lastStrike = now
+	if l.cfg.BanAfter > 0 && o.strikes >= l.cfg.BanAfter {
+		o.strikes = 0
+		o.bannedUntil = now.Add(l.cfg.BanFor)
+		return limitBanned, o.bannedUntil
+	}
+	mute := l.cfg.MuteFor << min(o.strikes-1, 6)
+	if until := now.Add(mute); until.After(o.mutedUntil) {
+		o.mutedUntil = until
+	}
+	return limitMuted, o.mutedUntil
+}
+
+// sweep drops idle state at most once a minute. Callers hold l.mu.
+func (l *limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for key, o := range l.state {
+		if now.Sub(o.refilled) > limiterIdle && now.After(o.mutedUntil) && now.After(o.bannedUntil) {
+			delete(l.state, key)
+		}
+	}
+}
+
+// trustedProxies are the peers allowed to report the client address in
+// X-Forwarded-For (--trusted-proxy). The header is ignored from anyone else,
+// since any client can set it.
+var trustedProxies []netip.Prefix
+
+// setTrustedProxies parses --trusted-proxy entries, each an IP or a CIDR.
+func setTrustedProxies(entries []string) error {
+	trustedProxies = nil
+	for _, e := range entries {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		if !strings.Contains(e, "/") {
+			addr, err := netip.ParseAddr(e)
+			if err != nil {
+				return fmt.Errorf("trusted proxy %q: %w", e, err)
+			}
+			trustedProxies = append(trustedProxies, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(e)
+		if err != nil {
+			return fmt.Errorf("trusted proxy %q: %w", e, err)
+		}
+		trustedProxies = append(trustedProxies, p.Masked())
+	}
+	return nil
+}
+
+func isTrustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range trustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the caller's address: the connection's peer, or, when
+// that peer is a trusted proxy, the nearest X-Forwarded-For entry that is
+// not itself a trusted proxy.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !isTrustedProxy(host) {
+		return host
+	}
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := strings.TrimSpace(hops[i])
+		if ip == "" {
+			continue
+		}
+		if !isTrustedProxy(ip) {
+			return ip
+		}
+		host = ip
+	}
+	return host
+}
+
+// attachLimiter enables flood protection on the hub.
+func (h *hub) attachLimiter(l *limiter) {
+	h.mu.Lock()
+	h.limits = l
+	h.mu.Unlock()
+}
+
+// throttle runs one message-producing request past the limiter and tells the
+// sender when it was dropped. limitBanned means the connection should close.
+func (h *hub) throttle(c client, uid, ip, channel, text string) limitVerdict {
+	verdict, until := h.limits.allow(uid, ip, text)
+	notice := "slow down: you are muted for %s"
+	if mutedUntil, muted := h.mutedUntil(uid); muted && verdict == limitOK {
+		verdict, until, notice = limitMuted, mutedUntil, "you are muted for %s"
+	}
+	if channel == "" {
+		channel = defaultChannel
+	}
+	switch verdict {
+	case limitMuted:
+		h.send(c, message{TS: time.Now().UTC(), Channel: channel, Event: "system",
+			Text: fmt.Sprintf(notice, time.Until(until).Round(time.Second))})
+	case limitBanned:
+		h.send(c, message{TS: time.Now().UTC(), Channel: channel, Event: "error",
+			Text: fmt.Sprintf("flooding: you are banned for %s", time.Until(until).Round(time.Second))})
+	}
+	return verdict
+}
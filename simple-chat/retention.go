@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/pebble/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// retentionConfig bounds how much history is kept. Zero values mean
+// "keep forever" and "no limit".
+type retentionConfig struct {
+	MaxAge   time.Duration // drop messages older than this
+	MaxCount int           // keep at most this many messages per channel or conversation
+	Every    time.Duration // how often to enforce the policy
+}
+
+func (c retentionConfig) enabled() bool { return c.MaxAge > 0 || c.MaxCount > 0 }
+
+// subPrefixes lists the distinct "<keyspace><name>\x00" prefixes under a
+// keyspace such as m: or d:, seeking past each one's records.
+func (s *messageStore) subPrefixes(keyspace []byte) ([][]byte, error) {
+	it, err := s.db.NewIter(&pebble.IterOptions{LowerBound: keyspace, UpperBound: prefixEnd(keyspace)})
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = it.Close() }()
+	var out [][]byte
+	for valid := it.First(); valid; {
+		k := it.Key()
+		i := bytes.IndexByte(k[len(keyspace):], 0)
+		if i < 0 {
+			valid = it.Next()
+			continue
+		}
+		p := append([]byte(nil), k[:len(keyspace)+i+1]...)
+		out = append(out, p)
+		valid = it.SeekGE(prefixEnd(p))
+	}
+	return out, nil
+}
+
+// repairNext makes sure next is above every stored sequence number, in case
+// meta:next was lost or lags behind records written by other tools.
+func (s *messageStore) repairNext() error {
+	var highest uint64
+	for _, keyspace := range [][]byte{msgPrefix, dmPrefix} {
+		prefixes, err := s.subPrefixes(keyspace)
+		if err != nil {
+			return err
+		}
+		for _, p := range prefixes {
+			it, err := s.db.NewIter(&pebble.IterOptions{LowerBound: p, UpperBound: prefixEnd(p)})
+			if err != nil {
+				return err
+			}
+			if it.Last() && len(it.Key()) == len(p)+8 {
+				highest = max(highest, binary.BigEndian.Uint64(it.Key()[len(p):]))
+			}
+			_ = it.Close()
+		}
+	}
+	if highest == 0 || highest < s.next {
+		return nil
+	}
+	log.Warn().Uint64("next", s.next).Uint64("highest", highest).Msg("[chat] repairing message sequence counter")
+	s.next = highest + 1
+	return s.db.Set(metaNextKey, encodeSeq(s.next), pebble.Sync)
+}
+
+// Prune deletes messages older than cutoff (when non-zero) and all but the
+// newest maxCount (when positive) of every channel and conversation, using one
+// range delete per prefix. It returns the number of messages removed.
+func (s *messageStore) Prune(cutoff time.Time, maxCount int) (int, error) {
+	if s == nil || s.db == nil {
+		return 0, nil
+	}
+	var removed int
+	for _, keyspace := range [][]byte{msgPrefix, dmPrefix} {
+		prefixes, err := s.subPrefixes(keyspace)
+		if err != nil {
+			return removed, err
+		}
+		for _, p := range prefixes {
+			n, err := s.prunePrefix(p, bytes.Equal(keyspace, msgPrefix), cutoff, maxCount)
+			removed += n
+			if err != nil {
+				return removed, err
+			}
+		}
+	}
+	if n, err := s.pruneAttachments(cutoff); err != nil {
+		return removed, err
+	} else if n > 0 {
+		log.Info().Msgf("[chat] retention removed %d attachments", n)
+	}
+	if removed > 0 {
+		// Range tombstones only hide data; compact so the space is reclaimed.
+		for _, keyspace := range [][]byte{msgPrefix, dmPrefix, indexPrefix} {
+			if err := s.db.Compact(context.Background(), keyspace, prefixEnd(keyspace), false); err != nil {
+				return removed, err
+			}
+		}
+	}
+	return removed, nil
+}
+
+func (s *messageStore) prunePrefix(p []byte, indexed bool, cutoff time.Time, maxCount int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	it, err := s.db.NewIter(&pebble.IterOptions{LowerBound: p, UpperBound: prefixEnd(p)})
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = it.Close() }()
+	var total int
+	for valid := it.First(); valid; valid = it.Next() {
+		total++
+	}
+
+	b := s.db.NewBatch()
+	defer func() { _ = b.Close() }()
+	channel := string(p[len(msgPrefix) : len(p)-1])
+	end := prefixEnd(p)
+	var n int
+	var attachments []string
+	for valid := it.First(); valid; valid = it.Next() {
+		m, ok := decodeMessage(it.Key(), it.Value())
+		overCount := maxCount > 0 && total-n > maxCount
+		tooOld := !cutoff.IsZero() && ok && m.TS.Before(cutoff)
+		if !overCount && !tooOld {
+			end = append([]byte(nil), it.Key()...)
+			break
+		}
+		if indexed && ok {
+			m.Channel = channel
+			if err := indexMessage(b, m, true); err != nil {
+				return 0, err
+			}
+		}
+		if ok && m.Attachment != nil {
+			attachments = append(attachments, m.Attachment.ID)
+		}
+		n++
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	if err := b.DeleteRange(p, end, nil); err != nil {
+		return 0, err
+	}
+	if err := b.Commit(pebble.Sync); err != nil {
+		return 0, err
+	}
+	return n, s.DeleteAttachments(attachments)
+}
+
+// storeStats summarises the message store for /api/stats.
+type storeStats struct {
+	DiskBytes      uint64         `json:"disk_bytes"`
+	Messages       int            `json:"messages"`
+	DirectMessages int            `json:"direct_messages"`
+	Attachments    int            `json:"attachments"`
+	AttachBytes    int64          `json:"attachment_bytes"`
+	Channels       map[string]int `json:"channels"`
+	NextID         uint64         `json:"next_id"`
+}
+
+// statsTTL is how long Stats reuses its last count. Counting reads every
+// stored message, and /api/stats is unauthenticated.
+const statsTTL = 30 * time.Second
+
+// Stats counts stored messages per channel and reports the on-disk size.
+// The counts may be up to statsTTL old; NextID is always current.
+func (s *messageStore) Stats() (storeStats, error) {
+	if s == nil || s.db == nil {
+		return storeStats{Channels: map[string]int{}}, nil
+	}
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	if time.Since(s.statsAt) >= statsTTL {
+		st, err := s.countStats()
+		if err != nil {
+			return st, err
+		}
+		s.stats, s.statsAt = st, time.Now()
+	}
+	st := s.stats
+	s.mu.Lock()
+	st.NextID = s.next
+	s.mu.Unlock()
+	return st, nil
+}
+
+// countStats scans the store for Stats.
+func (s *messageStore) countStats() (storeStats, error) {
+	st := storeStats{Channels: map[string]int{}}
+	for _, keyspace := range [][]byte{msgPrefix, dmPrefix} {
+		it, err := s.db.NewIter(&pebble.IterOptions{LowerBound: keyspace, UpperBound: prefixEnd(keyspace)})
+		if err != nil {
+			return st, err
+		}
+		for valid := it.First(); valid; valid = it.Next() {
+			if bytes.Equal(keyspace, dmPrefix) {
+				st.DirectMessages++
+				continue
+			}
+			k := it.Key()[len(msgPrefix):]
+			if i := bytes.IndexByte(k, 0); i >= 0 {
+				st.Channels[string(k[:i])]++
+				st.Messages++
+			}
+		}
+		_ = it.Close()
+	}
+	it, err := s.db.NewIter(&pebble.IterOptions{LowerBound: attachPrefix, UpperBound: prefixEnd(attachPrefix)})
+	if err != nil {
+		return st, err
+	}
+	for valid := it.First(); valid; valid = it.Next() {
+		var a attachment
+		if json.Unmarshal(it.Value(), &a) == nil {
+			st.Attachments++
+			st.AttachBytes += a.Size
+		}
+	}
+	_ = it.Close()
+	st.DiskBytes = s.db.Metrics().DiskSpaceUsage() + uint64(st.AttachBytes)
+	return st, nil
+}
+
+// trimBacklog applies the retention policy to the in-memory channel backlogs.
+func (h *hub) trimBacklog(cutoff time.Time, maxCount int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, ch := range h.channels {
+		msgs := ch.messages
+		if !cutoff.IsZero() {
+			i := 0
+			for i < len(msgs) && msgs[i].TS.Before(cutoff) {
+				i++
+			}
+			msgs = msgs[i:]
+		}
+		if maxCount > 0 && len(msgs) > maxCount {
+			msgs = msgs[len(msgs)-maxCount:]
+		}
+		ch.messages = append(ch.messages[:0:0], msgs...)
+	}
+}
+
+// retention enforces a retentionConfig in the background.
+type retention struct {
+	wg sync.WaitGroup
+}
+
+// startRetention prunes once immediately and then every cfg.Every until ctx
+// is cancelled. It returns nil when no limits are configured.
+func startRetention(ctx context.Context, h *hub, cfg retentionConfig) *retention {
+	if !cfg.enabled() {
+		return nil
+	}
+	if cfg.Every <= 0 {
+		cfg.Every = time.Hour
+	}
+	r := &retention{}
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		t := time.NewTicker(cfg.Every)
+		defer t.Stop()
+		for {
+			var cutoff time.Time
+			if cfg.MaxAge > 0 {
+				cutoff = time.Now().Add(-cfg.MaxAge)
+			}
+			h.trimBacklog(cutoff, cfg.MaxCount)
+			if n, err := h.store.Prune(cutoff, cfg.MaxCount); err != nil {
+				log.Warn().Err(err).Msg("[chat] retention prune failed")
+			} else if n > 0 {
+				log.Info().Msgf("[chat] retention removed %d messages", n)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+		}
+	}()
+	return r
+}
+
+func (r *retention) wait() {
+	if r != nil {
+		r.wg.Wait()
+	}
+}
+
+// handleStats reports store size and message counts, the latter cached for
+// statsTTL.
+//
+//	GET /api/stats
+func handleStats(w http.ResponseWriter, r *http.Request, h *hub) {
+	st, err := h.store.Stats()
+	if err != nil {
+		log.Warn().Err(err).Msg("[chat] store stats")
+		http.Error(w, "stats unavailable", http.StatusInternalServerError)
+		return
+	}
+	h.mu.RLock()
+	online := len(h.userConns)
+	conns := len(h.conns)
+	h.mu.RUnlock()
+	writeAPIJSON(w, http.StatusOK, map[string]any{
+		"persistent":  h.store != nil,
+		"store":       st,
+		"online":      online,
+		"connections": conns,
+	})
+}
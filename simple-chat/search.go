@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/cockroachdb/pebble/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// Inverted index over channel messages:
+//
+//	x:<term>\x00<channel>\x00<seq>   posting; empty value
+//	meta:indexed                     present once existing history was indexed
+//
+// Terms are lower-cased runs of letters and digits. Queries match terms by
+// prefix, so "서버" finds "서버가" and "deploy" finds "deployed".
+var (
+	indexPrefix    = []byte("x:")
+	metaIndexedKey = []byte("meta:indexed")
+)
+
+const (
+	maxIndexTermLen    = 32 // longer words are truncated before indexing
+	minQueryTermLen    = 2  // shorter query words would prefix-scan most of the index
+	maxPostingsScanned = 20000
+	defaultSearchLimit = 50
+	maxSearchLimit     = 200
+)
+
+var errShortQuery = errors.New("search words must be at least 2 characters")
+
+// searchTerms splits text into unique index terms.
+func searchTerms(text string) []string {
+	seen := map[string]struct{}{}
+	var out []string
+	for _, f := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if r := []rune(f); len(r) > maxIndexTermLen {
+			f = string(r[:maxIndexTermLen])
+		}
+		if _, dup := seen[f]; dup {
+			continue
+		}
+		seen[f] = struct{}{}
+		out = append(out, f)
+	}
+	return out
+}
+
+// indexable reports whether a stored message should be searchable.
+func indexable(m message) bool {
+	return (m.Event == "" || m.Event == "me") && !m.Deleted && !strings.HasPrefix(m.Text, "[IMAGE]") && !isCiphertext(m.Text)
+}
+
+func postingKey(term, channel string, seq uint64) []byte {
+	k := make([]byte, 0, len(indexPrefix)+len(term)+len(channel)+10)
+	k = append(k, indexPrefix...)
+	k = append(k, term...)
+	k = append(k, 0)
+	k = append(k, channel...)
+	k = append(k, 0)
+	return append(k, encodeSeq(seq)...)
+}
+
+// indexMessage adds (or with del, removes) the postings for m to the batch.
+func indexMessage(b *pebble.Batch, m message, del bool) error {
+	if !indexable(m) {
+		return nil
+	}
+	text := m.Text
+	if m.Attachment != nil {
+		text += " " + m.Attachment.Name
+	}
+	for _, term := range searchTerms(text) {
+		var err error
+		if del {
+			err = b.Delete(postingKey(term, m.Channel, m.ID), nil)
+		} else {
+			err = b.Set(postingKey(term, m.Channel, m.ID), nil, nil)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// buildIndex indexes all channel history once, for stores created before
+// search existed.
+func (s *messageStore) buildIndex() error {
+	if _, closer, err := s.db.Get(metaIndexedKey); err == nil {
+		return closer.Close()
+	} else if err != pebble.ErrNotFound {
+		return err
+	}
+	channels, err := s.Channels()
+	if err != nil {
+		return err
+	}
+	b := s.db.NewBatch()
+	defer func() { _ = b.Close() }()
+	var n int
+	for _, ch := range channels {
+		msgs, _, err := s.LoadAfter(ch, 0, 0)
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if err := indexMessage(b, m, false); err != nil {
+				return err
+			}
+			n++
+		}
+	}
+	if err := b.Set(metaIndexedKey, nil, nil); err != nil {
+		return err
+	}
+	if n > 0 {
+		log.Info().Msgf("[chat] indexed %d stored messages for search", n)
+	}
+	return b.Commit(pebble.Sync)
+}
+
+// searchQuery narrows a search. Zero values mean "no filter".
+type searchQuery struct {
+	Text    string
+	Channel string
+	User    string
+	From    time.Time
+	To      time.Time
+	Limit   int
+}
+
+type postingRef struct {
+	channel string
+	seq     uint64
+}
+
+// Search returns messages containing every query term (by prefix), newest
+// first, filtered by channel, user and time range. Query words shorter than
+// minQueryTermLen are ignored, and each term reads at most
+// maxPostingsScanned postings, so a very common prefix yields some of its
+// matches rather than all of them.
+func (s *messageStore) Search(q searchQuery) ([]message, error) {
+	if s == nil || s.db == nil {
+		return nil, nil
+	}
+	all := searchTerms(q.Text)
+	if len(all) == 0 {
+		return nil, nil
+	}
+	var terms []string
+	for _, term := range all {
+		if len([]rune(term)) >= minQueryTermLen {
+			terms = append(terms, term)
+		}
+	}
+	if len(terms) == 0 {
+		return nil, errShortQuery
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultSearchLimit
+	}
+	// Start from the longest (usually most selective) term so the candidate
+	// set shrinks early.
+	sort.Slice(terms, func(i, j int) bool { return len(terms[i]) > len(terms[j]) })
+	var hits map[postingRef]struct{}
+	for i, term := range terms {
+		// Without filters on the messages themselves, every posting of the
+		// last term is a result, so stop once there are enough.
+		want := 0
+		if i == len(terms)-1 && q.User == "" && q.From.IsZero() && q.To.IsZero() {
+			want = limit
+		}
+		next, err := s.postings(term, q.Channel, hits, want)
+		if err != nil {
+			return nil, err
+		}
+		hits = next
+		if len(hits) == 0 {
+			return nil, nil
+		}
+	}
+	refs := make([]postingRef, 0, len(hits))
+	for r := range hits {
+		refs = append(refs, r)
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].seq > refs[j].seq })
+
+	user := strings.ToLower(q.User)
+	var out []message
+	for _, r := range refs {
+		key := msgKey(r.channel, r.seq)
+		val, closer, err := s.db.Get(key)
+		if err == pebble.ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		m, ok := decodeMessage(key, val)
+		_ = closer.Close()
+		if !ok {
+			continue
+		}
+		m.Channel = r.channel
+		if user != "" && strings.ToLower(m.User) != user {
+			continue
+		}
+		if !q.From.IsZero() && m.TS.Before(q.From) {
+			continue
+		}
+		if !q.To.IsZero() && !m.TS.Before(q.To) {
+			continue
+		}
+		out = append(out, m)
+		if len(out) >= limit {
+			break
+		}
+	}
+	return out, nil
+}
+
+// postings collects the messages indexed under terms starting with prefix,
+// keeping only those already in within when within is non-nil. It stops
+// after want matches when want is positive, and after maxPostingsScanned
+// postings in any case.
+func (s *messageStore) postings(prefix, channel string, within map[postingRef]struct{}, want int) (map[postingRef]struct{}, error) {
+	lower := append(append([]byte(nil), indexPrefix...), prefix...)
+	it, err := s.db.NewIter(&pebble.IterOptions{LowerBound: lower, UpperBound: prefixEnd(lower)})
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = it.Close() }()
+	out := map[postingRef]struct{}{}
+	// Walk backwards so that, within a term and channel, newer postings
+	// are read before the scan cap or want cuts it short.
+	scanned := 0
+	for valid := it.Last(); valid && scanned < maxPostingsScanned && (want == 0 || len(out) < want); valid = it.Prev() {
+		scanned++
+		rest := it.Key()[len(indexPrefix):]
+		i := bytes.IndexByte(rest, 0)
+		if i < 0 || len(rest) < i+1+8 {
+			continue
+		}
+		chanAndSeq := rest[i+1:]
+		ref := postingRef{
+			channel: string(chanAndSeq[:len(chanAndSeq)-9]),
+			seq:     binary.BigEndian.Uint64(chanAndSeq[len(chanAndSeq)-8:]),
+		}
+		if channel != "" && ref.channel != channel {
+			continue
+		}
+		if within != nil {
+			if _, ok := within[ref]; !ok {
+				continue
+			}
+		}
+		out[ref] = struct{}{}
+	}
+	return out, nil
+}
+
+// parseSearchTime accepts RFC 3339 timestamps or plain dates (UTC).
+func parseSearchTime(v string) (time.Time, bool) {
+	if v == "" {
+		return time.Time{}, true
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, true
+	}
+	if t, err := time.Parse("2006-01-02", v); err == nil {
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+// handleSearch serves full-text search over persisted channel history.
+//
+//	GET /api/search?q=deploy&channel=ops&user=alice&from=2025-01-01&to=2025-02-01&limit=50
+//
+// from is inclusive and to exclusive; a plain date for to means midnight UTC.
+func handleSearch(w http.ResponseWriter, r *http.Request, h *hub) {
+	if h.store == nil {
+		http.Error(w, "search needs --data-path", http.StatusServiceUnavailable)
+		return
+	}
+	v := r.URL.Query()
+	from, ok1 := parseSearchTime(v.Get("from"))
+	to, ok2 := parseSearchTime(v.Get("to"))
+	limit, ok3 := queryUint(r, "limit")
+	if !ok1 || !ok2 || !ok3 {
+		http.Error(w, "bad filter", http.StatusBadRequest)
+		return
+	}
+	q := searchQuery{
+		Text:    v.Get("q"),
+		Channel: normalizeChannel(v.Get("channel")),
+		User:    strings.TrimSpace(v.Get("user")),
+		From:    from,
+		To:      to,
+		Limit:   int(min(limit, maxSearchLimit)),
+	}
+	results, err := h.store.Search(q)
+	if errors.Is(err, errShortQuery) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Warn().Err(err).Msg("[chat] search")
+		http.Error(w, "search failed", http.StatusInternalServerError)
+		return
+	}
+	if results == nil {
+		results = []message{}
+	}
+	writeAPIJSON(w, http.StatusOK, map[string]any{"query": q.Text, "results": results})
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog/log"
+)
+
+// sendConfig is the slow-consumer policy. Every connection gets a bounded
+// queue drained by its own writer goroutine, so a client on a laggy link only
+// delays itself. When its queue is full new messages for it are dropped;
+// after MaxDrops drops in a row it is disconnected.
+type sendConfig struct {
+	Queue    int // messages buffered per connection
+	MaxDrops int // consecutive drops before disconnecting; 0 only drops
+}
+
+const defaultSendQueue = 256
+
+// outgoing is one queued item: a message, or a request to close the
+// connection once everything queued before it has been written.
+type outgoing struct {
+	m      message
+	close  bool
+	code   int
+	reason string
+}
+
+// sendQueue buffers messages for one connection.
+type sendQueue struct {
+	ch      chan outgoing
+	done    chan struct{} // closed by unregister
+	stopped chan struct{} // closed when the writer has exited
+	drops   atomic.Int32  // consecutive drops
+	kicked  sync.Once
+}
+
+// attachSendPolicy sets the queue size and slow-consumer policy for
+// connections registered from now on.
+func (h *hub) attachSendPolicy(cfg sendConfig) {
+	h.mu.Lock()
+	h.sendCfg = cfg
+	h.mu.Unlock()
+}
+
+// startQueueLocked creates c's queue and starts its writer. Callers must hold
+// h.mu for writing.
+func (h *hub) startQueueLocked(c client) {
+	size := h.sendCfg.Queue
+	if size <= 0 {
+		size = defaultSendQueue
+	}
+	q := &sendQueue{ch: make(chan outgoing, size), done: make(chan struct{}), stopped: make(chan struct{})}
+	h.queues[c] = q
+	go h.writeLoop(c, q)
+}
+
+// stopQueue ends c's writer after it has flushed what is already queued, such
+// as a ban notice sent just before the connection was dropped.
+func (h *hub) stopQueue(q *sendQueue) {
+	if q == nil {
+		return
+	}
+	close(q.done)
+	<-q.stopped
+}
+
+// writeLoop writes queued items to c until the queue is stopped or a write
+// fails. A failed write closes the connection so its reader notices.
+func (h *hub) writeLoop(c client, q *sendQueue) {
+	defer close(q.stopped)
+	deliver := func(it outgoing) bool {
+		if it.close {
+			c.close(it.code, it.reason)
+			return false
+		}
+		if err := c.write(it.m); err != nil {
+			metricDroppedWrites.WithLabelValues("error").Inc()
+			c.close(websocket.CloseInternalServerErr, "write failed")
+			return false
+		}
+		return true
+	}
+	for {
+		select {
+		case it := <-q.ch:
+			if !deliver(it) {
+				return
+			}
+		case <-q.done:
+			for {
+				select {
+				case it := <-q.ch:
+					if !deliver(it) {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// enqueue adds an item to c's queue without blocking and applies the
+// slow-consumer policy when it is full. Dropping the newest item rather than
+// the oldest keeps what a client does receive in order, and never loses a
+// queued close.
+func (h *hub) enqueue(c client, it outgoing) {
+	h.mu.RLock()
+	q := h.queues[c]
+	maxDrops := h.sendCfg.MaxDrops
+	h.mu.RUnlock()
+	if q == nil {
+		return
+	}
+	select {
+	case q.ch <- it:
+		q.drops.Store(0)
+		return
+	default:
+	}
+	metricDroppedWrites.WithLabelValues("queue_full").Inc()
+	if it.close {
+		// Nothing more will be read from a queue this backed up
+		go c.close(it.code, it.reason)
+		return
+	}
+	if n := q.drops.Add(1); maxDrops > 0 && int(n) >= maxDrops {
+		q.kicked.Do(func() {
+			metricSlowDisconnects.Inc()
+			log.Debug().Int32("drops", n).Msg("[chat] disconnecting slow consumer")
+			go c.close(websocket.ClosePolicyViolation, "too slow: messages were dropped")
+		})
+	}
+}
+
+// closeAfterQueued closes c once the messages already queued for it are
+// written.
+func (h *hub) closeAfterQueued(c client, code int, reason string) {
+	h.enqueue(c, outgoing{close: true, code: code, reason: reason})
+}
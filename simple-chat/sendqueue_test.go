@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// benchClient is a connection whose writes either return at once or, for a
+// slow consumer, block until the benchmark releases them.
+type benchClient struct {
+	block <-chan struct{} // nil for a fast client
+}
+
+func (c *benchClient) write(message) error {
+	if c.block != nil {
+		<-c.block
+	}
+	return nil
+}
+
+func (c *benchClient) close(int, string) {}
+
+// BenchmarkBroadcast measures one broadcast to a 100-member channel. With
+// per-connection queues the cost must stay flat however many members have
+// stopped reading: their queues fill and further messages are dropped
+// instead of stalling the sender.
+func BenchmarkBroadcast(b *testing.B) {
+	const members = 100
+	for _, slow := range []int{0, 10, members / 2} {
+		b.Run(fmt.Sprintf("slow=%d", slow), func(b *testing.B) {
+			h := newHub()
+			h.attachSendPolicy(sendConfig{Queue: 64}) // drop only, never disconnect
+			release := make(chan struct{})
+			conns := make([]client, 0, members)
+			for i := 0; i < members; i++ {
+				c := &benchClient{}
+				if i < slow {
+					c.block = release
+				}
+				h.register(c, "127.0.0.1")
+				h.handle(c, "127.0.0.1", request{Type: "join", Channel: "bench", UID: "bench-" + strconv.Itoa(i), User: "u" + strconv.Itoa(i)})
+				conns = append(conns, c)
+			}
+			b.Cleanup(func() {
+				close(release)
+				for _, c := range conns {
+					h.unregister(c)
+				}
+			})
+			m := message{TS: time.Now().UTC(), Channel: "bench", User: "u0", Text: "hello"}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				h.broadcast(m)
+			}
+		})
+	}
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/cockroachdb/pebble/v2"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+// History moves between instances as JSON Lines, one record per line:
+//
+//	{"kind":"topic","channel":"general","topic":"release day"}
+//	{"kind":"room","channel":"secret","salt":"<hex>"}
+//	{"kind":"message","message":{"id":12,"channel":"general","user":"alice",...}}
+//	{"kind":"dm","message":{"id":13,"author":"<authorID>","to":"<authorID>",...}}
+//
+// Message IDs in an export are informational. Import assigns fresh sequence
+// numbers in timestamp order and skips messages the store already holds, so
+// importing the same file twice, or a store's own export, changes nothing.
+// A message counts as held when its channel (or DM pair), sender and
+// timestamp match; a later edit of it in the export is not applied.
+// History pages by sequence number, so imported messages list after the
+// ones already stored whatever their timestamps: import into an empty store
+// to keep one timeline.
+// Attachment files are not included; copy the attachments directory along.
+// Encrypted rooms travel as ciphertext with their salt, so existing
+// passphrases keep working after a move.
+
+const importBatchSize = 500 // records per committed batch
+
+type exportRecord struct {
+	Kind    string   `json:"kind"` // "topic" | "room" | "message" | "dm"
+	Channel string   `json:"channel,omitempty"`
+	Topic   string   `json:"topic,omitempty"`
+	Salt    string   `json:"salt,omitempty"`
+	Message *message `json:"message,omitempty"`
+}
+
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Write the stored chat history to stdout as JSON Lines",
+	Args:  cobra.NoArgs,
+	RunE:  runExport,
+}
+
+var importCmd = &cobra.Command{
+	Use:   "import [file]",
+	Short: "Merge JSON Lines history from export into the store (stdin by default)",
+	Args:  cobra.MaximumNArgs(1),
+	RunE:  runImport,
+}
+
+func init() {
+	rootCmd.AddCommand(exportCmd, importCmd)
+}
+
+// Export writes topics, channel messages and direct messages as JSON Lines
+// from a consistent snapshot and returns the number of records written.
+func (s *messageStore) Export(w io.Writer) (int, error) {
+	if s == nil || s.db == nil {
+		return 0, errors.New("export needs --data-path")
+	}
+	snap := s.db.NewSnapshot()
+	defer func() { _ = snap.Close() }()
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	var n int
+
+	for _, keyspace := range [][]byte{topicPrefix, roomPrefix} {
+		it, err := snap.NewIter(&pebble.IterOptions{LowerBound: keyspace, UpperBound: prefixEnd(keyspace)})
+		if err != nil {
+			return n, err
+		}
+		for valid := it.First(); valid; valid = it.Next() {
+			rec := exportRecord{Kind: "topic", Channel: string(it.Key()[len(keyspace):]), Topic: string(it.Value())}
+			if bytes.Equal(keyspace, roomPrefix) {
+				rec = exportRecord{Kind: "room", Channel: rec.Channel, Salt: rec.Topic}
+			}
+			if err := enc.Encode(rec); err != nil {
+				_ = it.Close()
+				return n, err
+			}
+			n++
+		}
+		_ = it.Close()
+	}
+
+	for _, keyspace := range [][]byte{msgPrefix, dmPrefix} {
+		it, err := snap.NewIter(&pebble.IterOptions{LowerBound: keyspace, UpperBound: prefixEnd(keyspace)})
+		if err != nil {
+			return n, err
+		}
+		for valid := it.First(); valid; valid = it.Next() {
+			m, ok := decodeMessage(it.Key(), it.Value())
+			if !ok {
+				continue
+			}
+			rec := exportRecord{Kind: "dm", Message: &m}
+			if bytes.Equal(keyspace, msgPrefix) {
+				rest := it.Key()[len(msgPrefix):]
+				m.Channel = string(rest[:bytes.IndexByte(rest, 0)])
+				rec.Kind = "message"
+			}
+			if err := enc.Encode(rec); err != nil {
+				_ = it.Close()
+				return n, err
+			}
+			n++
+		}
+		_ = it.Close()
+	}
+	return n, nil
+}
+
+// importStats summarises an Import.
+type importStats struct {
+	Messages   int `json:"messages"`
+	Duplicates int `json:"duplicates"`
+	Topics     int `json:"topics"`
+	Rooms      int `json:"rooms"`
+}
+
+// fingerprint identifies a message by where, who and when rather than by
+// sequence number. Text is left out so an edited copy still matches.
+func fingerprint(m message) [32]byte {
+	h := sha256.New()
+	for _, f := range []string{m.Channel, m.Author, m.To, strconv.FormatInt(m.TS.UnixNano(), 10), m.User} {
+		_, _ = io.WriteString(h, f)
+		_, _ = h.Write([]byte{0})
+	}
+	var out [32]byte
+	h.Sum(out[:0])
+	return out
+}
+
+// fingerprints collects the fingerprints of every stored message.
+func (s *messageStore) fingerprints() (map[[32]byte]struct{}, error) {
+	out := map[[32]byte]struct{}{}
+	for _, keyspace := range [][]byte{msgPrefix, dmPrefix} {
+		it, err := s.db.NewIter(&pebble.IterOptions{LowerBound: keyspace, UpperBound: prefixEnd(keyspace)})
+		if err != nil {
+			return nil, err
+		}
+		for valid := it.First(); valid; valid = it.Next() {
+			m, ok := decodeMessage(it.Key(), it.Value())
+			if !ok {
+				continue
+			}
+			if bytes.Equal(keyspace, msgPrefix) {
+				rest := it.Key()[len(msgPrefix):]
+				m.Channel = string(rest[:bytes.IndexByte(rest, 0)])
+			}
+			out[fingerprint(m)] = struct{}{}
+		}
+		_ = it.Close()
+	}
+	return out, nil
+}
+
+// readExport parses and validates a JSON Lines export.
+func readExport(r io.Reader) (msgs []exportRecord, topics []exportRecord, err error) {
+	dec := json.NewDecoder(r)
+	for line := 1; ; line++ {
+		var rec exportRecord
+		if err := dec.Decode(&rec); err == io.EOF {
+			return msgs, topics, nil
+		} else if err != nil {
+			return nil, nil, fmt.Errorf("record %d: %w", line, err)
+		}
+		switch rec.Kind {
+		case "topic", "room":
+			rec.Channel = normalizeChannel(rec.Channel)
+			if rec.Channel == "" {
+				return nil, nil, fmt.Errorf("record %d: %s without channel", line, rec.Kind)
+			}
+			if rec.Kind == "room" && rec.Salt == "" {
+				return nil, nil, fmt.Errorf("record %d: room without salt", line)
+			}
+			topics = append(topics, rec)
+		case "message":
+			if rec.Message == nil || normalizeChannel(rec.Message.Channel) == "" {
+				return nil, nil, fmt.Errorf("record %d: message without channel", line)
+			}
+			rec.Message.Channel = normalizeChannel(rec.Message.Channel)
+			msgs = append(msgs, rec)
+		case "dm":
+			m := rec.Message
+			if m == nil || !isAuthorID(m.Author) || !isAuthorID(m.To) || m.Author == m.To {
+				return nil, nil, fmt.Errorf("record %d: direct message needs author and to", line)
+			}
+			m.Channel = ""
+			msgs = append(msgs, rec)
+		default:
+			return nil, nil, fmt.Errorf("record %d: unknown kind %q", line, rec.Kind)
+		}
+	}
+}
+
+// Import merges an export into the store. Messages are renumbered from the
+// store's sequence in timestamp order, after everything already stored; ones
+// already present are skipped. Imported topics and room salts only fill
+// channels that have none.
+func (s *messageStore) Import(r io.Reader) (importStats, error) {
+	var st importStats
+	if s == nil || s.db == nil {
+		return st, errors.New("import needs --data-path")
+	}
+	recs, topics, err := readExport(r)
+	if err != nil {
+		return st, err
+	}
+	sort.SliceStable(recs, func(i, j int) bool { return recs[i].Message.TS.Before(recs[j].Message.TS) })
+	seen, err := s.fingerprints()
+	if err != nil {
+		return st, err
+	}
+	// Latest nickname per author, for conversation list entries
+	names := map[string]string{}
+	for _, rec := range recs {
+		if rec.Message.Author != "" && rec.Message.User != "" {
+			names[rec.Message.Author] = rec.Message.User
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	next := s.next
+	b := s.db.NewBatch()
+	commit := func() error {
+		done := b
+		b = s.db.NewBatch()
+		defer func() { _ = done.Close() }()
+		if err := done.Set(metaNextKey, encodeSeq(next), nil); err != nil {
+			return err
+		}
+		if err := done.Commit(pebble.Sync); err != nil {
+			return err
+		}
+		s.next = next
+		return nil
+	}
+	defer func() { _ = b.Close() }()
+	pending := 0
+	for _, rec := range recs {
+		m := *rec.Message
+		fp := fingerprint(m)
+		if _, dup := seen[fp]; dup {
+			st.Duplicates++
+			continue
+		}
+		seen[fp] = struct{}{}
+		m.ID = next
+		val, _ := json.Marshal(m)
+		if rec.Kind == "dm" {
+			err = s.putDirect(b, m, val, names[m.To])
+		} else {
+			err = s.putChannel(b, m, val)
+		}
+		if err != nil {
+			return st, err
+		}
+		next++
+		st.Messages++
+		if pending++; pending >= importBatchSize {
+			if err := commit(); err != nil {
+				return st, err
+			}
+			pending = 0
+		}
+	}
+	for _, rec := range topics {
+		key, val := append(append([]byte(nil), topicPrefix...), rec.Channel...), rec.Topic
+		if rec.Kind == "room" {
+			key, val = roomKey(rec.Channel), rec.Salt
+		}
+		if _, closer, err := s.db.Get(key); err == nil {
+			_ = closer.Close()
+			continue
+		} else if err != pebble.ErrNotFound {
+			return st, err
+		}
+		if err := b.Set(key, []byte(val), nil); err != nil {
+			return st, err
+		}
+		if rec.Kind == "room" {
+			st.Rooms++
+		} else {
+			st.Topics++
+		}
+	}
+	return st, commit()
+}
+
+func runExport(cmd *cobra.Command, args []string) error {
+	if flagDataPath == "" {
+		return errors.New("export needs --data-path")
+	}
+	store, err := openMessageStore(flagDataPath)
+	if err != nil {
+		return fmt.Errorf("open store: %w", err)
+	}
+	defer func() { _ = store.Close() }()
+	w := bufio.NewWriter(os.Stdout)
+	n, err := store.Export(w)
+	if err != nil {
+		return fmt.Errorf("export: %w", err)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	log.Info().Msgf("[chat] exported %d records", n)
+	return nil
+}
+
+func runImport(cmd *cobra.Command, args []string) error {
+	if flagDataPath == "" {
+		return errors.New("import needs --data-path")
+	}
+	in := io.Reader(os.Stdin)
+	if len(args) == 1 && args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer func() { _ = f.Close() }()
+		in = f
+	}
+	store, err := openMessageStore(flagDataPath)
+	if err != nil {
+		return fmt.Errorf("open store: %w", err)
+	}
+	defer func() { _ = store.Close() }()
+	existing := store.next > 1
+	st, err := store.Import(bufio.NewReader(in))
+	if err != nil {
+		return fmt.Errorf("import: %w", err)
+	}
+	if existing && st.Messages > 0 {
+		log.Warn().Msg("[chat] the store already had messages; imported history pages after them")
+	}
+	log.Info().Msgf("[chat] imported %d messages, %d topics and %d encrypted rooms, skipped %d duplicates", st.Messages, st.Topics, st.Rooms, st.Duplicates)
+	return nil
+}
+
+// handleExport streams the whole store in the export format. It requires the
+// --admin-key as a bearer token.
+//
+//	GET /api/admin/export   Authorization: Bearer <admin-key>
+func handleExport(w http.ResponseWriter, r *http.Request, h *hub) {
+	if !h.adminRequest(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if h.store == nil {
+		http.Error(w, "export needs --data-path", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="history.jsonl"`)
+	bw := bufio.NewWriter(w)
+	n, err := h.store.Export(bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		// Headers are gone; the truncated body is all we can signal
+		log.Warn().Err(err).Msg("[chat] export stream")
+		return
+	}
+	log.Info().Str("remote", clientIP(r)).Msgf("[chat] exported %d records over HTTP", n)
+}
@@ -2,8 +2,10 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"html/template"
 	"io/fs"
+	"math"
 	"net/http"
 	"sort"
 	"strconv"
@@ -67,94 +69,509 @@ func writeJSON(conn *websocket.Conn, v interface{}) error {
 	return w.Close()
 }
 
+// client is one connection to the hub: a websocket, or an event stream fed
+// by POST /send (events.go). The hub keys all per-connection state by it.
+type client interface {
+	// write delivers one message. Implementations serialise concurrent calls.
+	write(m message) error
+	// close ends the connection with a websocket close code and reason. The
+	// transport's own goroutine then unregisters it.
+	close(code int, reason string)
+}
+
+// wsClient is a client on a websocket connection.
+type wsClient struct {
+	conn *websocket.Conn
+	mu   sync.Mutex // serialises writes
+}
+
+func (c *wsClient) write(m message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_ = c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return writeJSON(c.conn, m)
+}
+
+func (c *wsClient) ping() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_ = c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return c.conn.WriteMessage(websocket.PingMessage, nil)
+}
+
+func (c *wsClient) close(code int, reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_ = c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_ = c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason))
+	_ = c.conn.Close()
+}
+
+// defaultChannel is joined automatically by clients that never ask for a channel.
+const defaultChannel = "general"
+
+// maxChannels bounds how many channels clients may create; joining a new
+// channel beyond it is refused.
+const maxChannels = 500
+
+var errTooManyChannels = errors.New("too many channels; join an existing one")
+
+// normalizeChannel folds a user-supplied channel name ("#Ops", "ops") into its
+// canonical form. It returns "" when nothing usable remains.
+func normalizeChannel(s string) string {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "#")
+	var builder strings.Builder
+	for _, r := range strings.ToLower(s) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '-' || r == '_' {
+			builder.WriteRune(r)
+		}
+		if builder.Len() >= 32 {
+			break
+		}
+	}
+	return builder.String()
+}
+
+// channel is a named room with its own members and backlog.
+type channel struct {
+	name     string
+	topic    string
+	salt     string // key derivation salt; non-empty for end-to-end encrypted rooms, see e2e.go
+	messages []message
+	conns    map[client]struct{}
+}
+
 // simple in-memory chat hub
 type hub struct {
 	mu         sync.RWMutex
-	messages   []message
-	maxBacklog int // maximum messages to keep in memory (0 = unlimited)
-	conns      map[*websocket.Conn]struct{}
-	connUID    map[*websocket.Conn]string
-	userConns  map[string]map[*websocket.Conn]struct{}
+	seqMu      sync.Mutex // held from ID assignment to backlog append, see broadcast
+	channels   map[string]*channel
+	maxBacklog int // maximum messages to keep in memory per channel (0 = unlimited)
+	conns      map[client]struct{}
+	connUID    map[client]string
+	connChans  map[client]map[string]struct{}
+	userConns  map[string]map[client]struct{}
 	userName   map[string]string
+	authorUID  map[string]string // authorID -> UID of connected users, for DM routing
 	wg         sync.WaitGroup
 	store      *messageStore
-	connMu     map[*websocket.Conn]*sync.Mutex // per-connection write locks
+	hooks      *webhooks
+	limits     *limiter                 // flood protection; nil disables it
+	listeners  []func(message)          // observers of every retained message, called after fan-out
+	lastID     uint64                   // highest message ID handed out (in-memory fallback without a store)
+	connIP     map[client]string        // remote address per connection
+	streams    map[string]*streamClient // event stream sessions by ID
+	queues     map[client]*sendQueue    // per-connection send queues, see sendqueue.go
+	sendCfg    sendConfig
+	adminKey   string               // /op password; empty disables it
+	metricsKey string               // bearer token for /metrics; empty disables it
+	mods       map[string]bool      // moderator UIDs
+	bans       map[string]ban       // by ban.key()
+	mutes      map[string]time.Time // UID -> end of a moderator mute
+	uploads    uploadConfig
+	presence   map[string]string            // UID -> "idle" | "away"; absent means active
+	lastRead   map[string]map[string]uint64 // UID -> channel (or "@"+peer) -> last read message ID
+	typingAt   map[string]time.Time         // UID + "\x00" + target -> last "typing" fanned out
 }
 
 type message struct {
-	TS    time.Time `json:"ts"`
-	User  string    `json:"user"`
-	Text  string    `json:"text"`
-	Event string    `json:"event,omitempty"` // "joined" | "left" | "roster"
-	UID   string    `json:"uid,omitempty"`
-	Users []string  `json:"users,omitempty"`
+	ID      uint64    `json:"id,omitempty"` // store sequence number; cursor for history paging
+	TS      time.Time `json:"ts"`
+	Channel string    `json:"channel,omitempty"`
+	User    string    `json:"user"`
+	Text    string    `json:"text"`
+	Event   string    `json:"event,omitempty"` // "joined" | "left" | "roster" | "channels" | "history" | "edit" | "delete" | "react" | "error" | "dm" | "conversations" | "system" | "me" | "topic" | "nick" | "clear" | "op" | "typing" | "presence" | "read" | "encrypted"
+	UID     string    `json:"uid,omitempty"`
+	Users   []string  `json:"users,omitempty"`
+	Names   []string  `json:"names,omitempty"`   // channel names for "channels" events
+	History []message `json:"history,omitempty"` // page of messages for "history" events
+	More    bool      `json:"more,omitempty"`    // "history": further pages exist in the requested direction
+
+	Author    string              `json:"author,omitempty"`    // authorID of the sender's UID
+	Ref       uint64              `json:"ref,omitempty"`       // target message ID for "edit" | "delete" | "react"
+	Edited    bool                `json:"edited,omitempty"`    // text was changed after posting
+	Bot       bool                `json:"bot,omitempty"`       // posted by an incoming webhook
+	Deleted   bool                `json:"deleted,omitempty"`   // tombstone: removed by its author
+	Reactions map[string][]string `json:"reactions,omitempty"` // emoji -> authorIDs that reacted
+
+	To            string         `json:"to,omitempty"`            // "dm": recipient authorID; "history": DM peer
+	Members       []member       `json:"members,omitempty"`       // "roster": names with author handles
+	Conversations []conversation `json:"conversations,omitempty"` // "conversations": caller's DM list
+	Attachment    *attachment    `json:"attachment,omitempty"`    // uploaded file posted with the message
+	State         string         `json:"state,omitempty"`         // "presence": "active" | "idle" | "away"
 }
 
+// member is a roster entry; Author lets clients address direct messages.
+type member struct {
+	Name   string `json:"name"`
+	Author string `json:"author"`
+	State  string `json:"state"`          // presence: "active" | "idle" | "away"
+	Read   uint64 `json:"read,omitempty"` // last message ID read in this channel
+}
+
+// ephemeralEvents are fanned out to channel members but never retained in the
+// backlog or appended to the store. Edits, deletions and reactions are applied
+// to their target message instead of being kept as entries of their own.
+var ephemeralEvents = map[string]bool{
+	"roster": true,
+	"edit":   true,
+	"delete": true,
+	"react":  true,
+	// Typing, presence and read receipts are live UI state only.
+	"typing":   true,
+	"presence": true,
+	"read":     true,
+}
+
+const (
+	defaultHistoryPage = 50
+	maxHistoryPage     = 200
+)
+
 func newHub() *hub {
 	return &hub{
-		conns:      map[*websocket.Conn]struct{}{},
-		connUID:    map[*websocket.Conn]string{},
-		userConns:  map[string]map[*websocket.Conn]struct{}{},
+		channels:   map[string]*channel{},
+		conns:      map[client]struct{}{},
+		connUID:    map[client]string{},
+		connChans:  map[client]map[string]struct{}{},
+		userConns:  map[string]map[client]struct{}{},
 		userName:   map[string]string{},
-		messages:   make([]message, 0, 64),
-		maxBacklog: 100, // keep last 100 messages in memory
-		connMu:     map[*websocket.Conn]*sync.Mutex{},
+		authorUID:  map[string]string{},
+		maxBacklog: 100, // keep last 100 messages per channel in memory
+		connIP:     map[client]string{},
+		mods:       map[string]bool{},
+		bans:       map[string]ban{},
+		mutes:      map[string]time.Time{},
+		presence:   map[string]string{},
+		lastRead:   map[string]map[string]uint64{},
+		typingAt:   map[string]time.Time{},
+		streams:    map[string]*streamClient{},
+		queues:     map[client]*sendQueue{},
 	}
 }
 
+// channelLocked returns the named channel, creating it on first use.
+// Callers must hold h.mu for writing.
+func (h *hub) channelLocked(name string) *channel {
+	ch, ok := h.channels[name]
+	if !ok {
+		ch = &channel{name: name, messages: make([]message, 0, 64), conns: map[client]struct{}{}}
+		h.channels[name] = ch
+	}
+	return ch
+}
+
+// memberLocked reports whether any connection of uid other than except is in the channel.
+// Callers must hold h.mu.
+func (h *hub) memberLocked(ch *channel, uid string, except client) bool {
+	for c := range h.userConns[uid] {
+		if c == except {
+			continue
+		}
+		if _, ok := ch.conns[c]; ok {
+			return true
+		}
+	}
+	return false
+}
+
 func (h *hub) broadcast(m message) {
+	// Persist first so the message goes out carrying its stable ID. seqMu
+	// keeps racing broadcasts from reaching the backlog out of ID order; it
+	// is separate from h.mu so a store write does not stall the whole hub.
+	retained := !ephemeralEvents[m.Event]
+	if retained {
+		h.seqMu.Lock()
+		m.ID = h.persist(m)
+	}
 	h.mu.Lock()
-	// Do not persist/retain roster messages in backlog; they are ephemeral UI state
-	if m.Event != "roster" {
-		h.messages = append(h.messages, m)
+	if _, ok := h.channels[m.Channel]; !ok && !retained {
+		// UI state for a channel nobody is in; do not create it
+		h.mu.Unlock()
+		return
+	}
+	ch := h.channelLocked(m.Channel)
+	// Do not persist/retain ephemeral messages in backlog; they are UI state
+	if retained {
+		ch.messages = append(ch.messages, m)
 		// Trim old messages if we exceed maxBacklog
-		if h.maxBacklog > 0 && len(h.messages) > h.maxBacklog {
+		if h.maxBacklog > 0 && len(ch.messages) > h.maxBacklog {
 			// Keep only the most recent maxBacklog messages
-			copy(h.messages, h.messages[len(h.messages)-h.maxBacklog:])
-			h.messages = h.messages[:h.maxBacklog]
+			copy(ch.messages, ch.messages[len(ch.messages)-h.maxBacklog:])
+			ch.messages = ch.messages[:h.maxBacklog]
 		}
 	}
-	conns := make([]*websocket.Conn, 0, len(h.conns))
-	for c := range h.conns {
+	conns := make([]client, 0, len(ch.conns))
+	for c := range ch.conns {
 		conns = append(conns, c)
 	}
+	listeners := h.listeners
 	h.mu.Unlock()
-	if h.store != nil && m.Event != "roster" {
-		if err := h.store.Append(m); err != nil {
+	if retained {
+		h.seqMu.Unlock()
+	}
+	start := time.Now()
+	for _, c := range conns {
+		h.send(c, m)
+	}
+	metricFanout.Observe(time.Since(start).Seconds())
+	if retained {
+		kind := "channel"
+		if m.Event != "" && m.Event != "me" {
+			kind = "event" // joins, topics and other retained notices
+		}
+		metricMessages.WithLabelValues(kind).Inc()
+		for _, fn := range listeners {
+			fn(m)
+		}
+	}
+}
+
+// addListener registers fn to observe every message retained in a channel
+// backlog. fn runs on the broadcasting goroutine and must not block.
+func (h *hub) addListener(fn func(message)) {
+	h.mu.Lock()
+	h.listeners = append(h.listeners, fn)
+	h.mu.Unlock()
+}
+
+// persist appends a message to the store and returns its ID. Without a store
+// IDs come from an in-memory counter so paging still works for the backlog.
+func (h *hub) persist(m message) uint64 {
+	if h.store != nil {
+		start := time.Now()
+		id, err := h.store.Append(m)
+		metricAppend.Observe(time.Since(start).Seconds())
+		if err != nil {
 			log.Debug().Err(err).Msg("persist message")
+			return 0
 		}
+		h.mu.Lock()
+		if id > h.lastID {
+			h.lastID = id
+		}
+		h.mu.Unlock()
+		return id
 	}
-	for _, c := range conns {
-		h.mu.RLock()
-		mu := h.connMu[c]
-		h.mu.RUnlock()
-		if mu != nil {
-			mu.Lock()
-			_ = c.SetWriteDeadline(time.Now().Add(10 * time.Second))
-			_ = writeJSON(c, m)
-			mu.Unlock()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastID++
+	return h.lastID
+}
+
+// history returns a page of a channel's messages older than before or, when
+// after is non-zero, newer than after. It reads the store when one is attached
+// and falls back to the in-memory backlog otherwise.
+func (h *hub) history(name string, before, after uint64, limit int) ([]message, bool, error) {
+	if limit <= 0 {
+		limit = defaultHistoryPage
+	}
+	if limit > maxHistoryPage {
+		limit = maxHistoryPage
+	}
+	if before == 0 {
+		before = math.MaxUint64
+	}
+	if h.store != nil {
+		if after > 0 {
+			return h.store.LoadAfter(name, after, limit)
+		}
+		return h.store.LoadBefore(name, before, limit)
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	ch, ok := h.channels[name]
+	if !ok {
+		return nil, false, nil
+	}
+	var page []message
+	if after > 0 {
+		for _, m := range ch.messages {
+			if m.ID > after {
+				page = append(page, m)
+			}
+		}
+		if len(page) > limit {
+			return append([]message(nil), page[:limit]...), true, nil
+		}
+		return page, false, nil
+	}
+	for _, m := range ch.messages {
+		if m.ID != 0 && m.ID < before {
+			page = append(page, m)
 		}
 	}
+	if len(page) > limit {
+		return append([]message(nil), page[len(page)-limit:]...), true, nil
+	}
+	return page, false, nil
+}
+
+// send queues a single message for one connection if it is still registered.
+// It never blocks on the network.
+func (h *hub) send(c client, m message) {
+	h.enqueue(c, outgoing{m: m})
 }
 
-// broadcastRoster sends the current list of connected user names to all clients.
-func (h *hub) broadcastRoster() {
+// broadcastRoster sends the list of user names present in a channel to its members.
+func (h *hub) broadcastRoster(name string) {
 	// Build roster snapshot
 	h.mu.RLock()
-	users := make([]string, 0, len(h.userName))
-	for uid, name := range h.userName {
-		if set, ok := h.userConns[uid]; !ok || len(set) == 0 {
-			continue
-		}
-		if name == "" {
-			name = "anon"
+	var users []string
+	var members []member
+	if ch, ok := h.channels[name]; ok {
+		seen := map[string]struct{}{}
+		for c := range ch.conns {
+			uid := h.connUID[c]
+			if _, dup := seen[uid]; dup {
+				continue
+			}
+			seen[uid] = struct{}{}
+			n := h.userName[uid]
+			if n == "" {
+				n = "anon"
+			}
+			users = append(users, n)
+			members = append(members, member{Name: n, Author: authorID(uid), State: h.presenceLocked(uid), Read: h.lastRead[uid][name]})
 		}
-		users = append(users, name)
 	}
 	h.mu.RUnlock()
 	// Sort for stable UI order
 	sort.Strings(users)
-	h.broadcast(message{TS: time.Now().UTC(), Event: "roster", Users: users})
+	sort.Slice(members, func(i, j int) bool { return members[i].Name < members[j].Name })
+	h.broadcast(message{TS: time.Now().UTC(), Channel: name, Event: "roster", Users: users, Members: members})
+}
+
+// channelNames returns all known channel names in sorted order.
+func (h *hub) channelNames() []string {
+	h.mu.RLock()
+	names := make([]string, 0, len(h.channels))
+	for name := range h.channels {
+		names = append(names, name)
+	}
+	h.mu.RUnlock()
+	sort.Strings(names)
+	return names
+}
+
+// join subscribes a connection to a channel and replays the channel backlog to
+// it. It returns false when the channel does not exist and may not be created.
+func (h *hub) join(c client, name string) bool {
+	h.mu.Lock()
+	if _, live := h.conns[c]; !live {
+		h.mu.Unlock()
+		return false
+	}
+	if _, ok := h.connChans[c][name]; ok {
+		h.mu.Unlock()
+		return true
+	}
+	if _, ok := h.channels[name]; !ok && name != defaultChannel && len(h.channels) >= maxChannels {
+		h.mu.Unlock()
+		h.send(c, message{TS: time.Now().UTC(), Channel: name, Event: "error", Text: errTooManyChannels.Error()})
+		return false
+	}
+	ch := h.channelLocked(name)
+	uid := h.connUID[c]
+	announce := !h.memberLocked(ch, uid, c)
+	ch.conns[c] = struct{}{}
+	if h.connChans[c] == nil {
+		h.connChans[c] = map[string]struct{}{}
+	}
+	h.connChans[c][name] = struct{}{}
+	user := h.userName[uid]
+	topic := ch.topic
+	salt := ch.salt
+	backlog := append([]message(nil), ch.messages...)
+	h.mu.Unlock()
+
+	for _, m := range backlog {
+		h.send(c, m)
+	}
+	h.send(c, message{TS: time.Now().UTC(), Event: "channels", Names: h.channelNames()})
+	if topic != "" {
+		h.send(c, message{TS: time.Now().UTC(), Channel: name, Event: "topic", Text: topic})
+	}
+	if salt != "" {
+		h.send(c, message{TS: time.Now().UTC(), Channel: name, Event: "encrypted", Text: salt})
+	}
+	if announce {
+		h.broadcast(message{TS: time.Now().UTC(), Channel: name, User: user, Event: "joined"})
+	}
+	h.broadcastRoster(name)
+	return true
+}
+
+// leave unsubscribes a connection from a channel.
+func (h *hub) leave(c client, name string) {
+	h.mu.Lock()
+	ch, ok := h.channels[name]
+	if _, joined := h.connChans[c][name]; !ok || !joined {
+		h.mu.Unlock()
+		return
+	}
+	delete(ch.conns, c)
+	delete(h.connChans[c], name)
+	uid := h.connUID[c]
+	announce := !h.memberLocked(ch, uid, nil)
+	user := h.userName[uid]
+	h.mu.Unlock()
+
+	if announce {
+		h.broadcast(message{TS: time.Now().UTC(), Channel: name, User: user, Event: "left"})
+	}
+	h.broadcastRoster(name)
+
+	// Without a store an empty channel is only a name and a backlog nobody
+	// can page back to; drop it so made-up names do not pile up.
+	h.mu.Lock()
+	if ch, ok := h.channels[name]; ok && h.store == nil && len(ch.conns) == 0 &&
+		name != defaultChannel && ch.topic == "" && ch.salt == "" {
+		delete(h.channels, name)
+	}
+	h.mu.Unlock()
+}
+
+// topic returns a channel's current topic.
+func (h *hub) topic(name string) string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if ch, ok := h.channels[name]; ok {
+		return ch.topic
+	}
+	return ""
+}
+
+// setTopic changes a channel's topic, persists it and announces the change.
+func (h *hub) setTopic(name, user, topic string) error {
+	h.mu.Lock()
+	h.channelLocked(name).topic = topic
+	h.mu.Unlock()
+	if err := h.store.SetTopic(name, topic); err != nil {
+		return err
+	}
+	h.broadcast(message{TS: time.Now().UTC(), Channel: name, User: user, Event: "topic", Text: topic})
+	return nil
+}
+
+// joinedChannels returns the channels a connection is currently subscribed to.
+func (h *hub) joinedChannels(c client) []string {
+	h.mu.RLock()
+	names := make([]string, 0, len(h.connChans[c]))
+	for name := range h.connChans[c] {
+		names = append(names, name)
+	}
+	h.mu.RUnlock()
+	sort.Strings(names)
+	return names
+}
+
+// attachHooks connects webhook configuration to the hub.
+func (h *hub) attachHooks(w *webhooks) {
+	h.mu.Lock()
+	h.hooks = w
+	h.mu.Unlock()
 }
 
 // attachStore connects a persistent store to the hub.
@@ -164,39 +581,104 @@ func (h *hub) attachStore(s *messageStore) {
 	h.mu.Unlock()
 }
 
-// bootstrap preloads history into the in-memory buffer.
-func (h *hub) bootstrap(msgs []message) {
+// bootstrap preloads a channel's history into the in-memory buffer.
+func (h *hub) bootstrap(name string, msgs []message) {
+	h.mu.Lock()
+	ch := h.channelLocked(name)
+	ch.messages = append(ch.messages, msgs...)
+	for _, m := range msgs {
+		if m.ID > h.lastID {
+			h.lastID = m.ID
+		}
+	}
+	h.mu.Unlock()
+}
+
+// bootstrapTopic restores a channel topic loaded from the store.
+func (h *hub) bootstrapTopic(name, topic string) {
 	h.mu.Lock()
-	h.messages = append(h.messages, msgs...)
+	h.channelLocked(name).topic = topic
 	h.mu.Unlock()
 }
 
-// closeAll force-closes all active websocket connections (used during shutdown).
+// closeAll force-closes all active connections (used during shutdown).
 func (h *hub) closeAll() {
 	h.mu.Lock()
-	conns := make([]*websocket.Conn, 0, len(h.conns))
+	conns := make([]client, 0, len(h.conns))
 	for c := range h.conns {
 		conns = append(conns, c)
 	}
 	h.mu.Unlock()
 	for _, c := range conns {
-		h.mu.RLock()
-		mu := h.connMu[c]
-		h.mu.RUnlock()
-		if mu != nil {
-			mu.Lock()
-			_ = c.SetWriteDeadline(time.Now().Add(10 * time.Second))
-			_ = c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutdown"))
-			mu.Unlock()
+		c.close(websocket.CloseGoingAway, "server shutdown")
+	}
+}
+
+// register adds a new connection from ip to the hub.
+func (h *hub) register(c client, ip string) {
+	h.mu.Lock()
+	h.conns[c] = struct{}{}
+	h.connIP[c] = ip
+	h.startQueueLocked(c)
+	h.mu.Unlock()
+}
+
+// unregister removes a closed connection: it leaves its channels and, with
+// the user's last connection, their per-user state goes too.
+func (h *hub) unregister(c client) {
+	// Mark the connection dead first so a request still being handled
+	// cannot join it to a channel after it has left them all.
+	h.mu.Lock()
+	delete(h.conns, c)
+	h.mu.Unlock()
+	for _, name := range h.joinedChannels(c) {
+		h.leave(c, name)
+	}
+	h.mu.Lock()
+	if uid := h.connUID[c]; uid != "" {
+		if set, ok := h.userConns[uid]; ok {
+			delete(set, c)
+			if len(set) == 0 {
+				delete(h.userConns, uid)
+				delete(h.userName, uid)
+				delete(h.authorUID, authorID(uid))
+				h.forgetPresenceLocked(uid)
+			}
 		}
+		delete(h.connUID, c)
 	}
+	delete(h.connChans, c)
+	delete(h.conns, c)
+	delete(h.connIP, c)
+	q := h.queues[c]
+	delete(h.queues, c)
+	h.mu.Unlock()
+	h.stopQueue(q)
 }
 
-// wait blocks until all websocket handler goroutines have finished.
+// wait blocks until all connection handler goroutines have finished.
 func (h *hub) wait() {
 	h.wg.Wait()
 }
 
+// request is one client request, a JSON object per websocket frame or per
+// POST /send.
+type request struct {
+	Type       string `json:"type"` // "" (chat line) | "join" | "leave" | "history" | "edit" | "delete" | "react" | "dm" | "conversations" | "typing" | "presence" | "read"
+	Channel    string `json:"channel"`
+	User       string `json:"user"`
+	Text       string `json:"text"`
+	UID        string `json:"uid"`
+	Before     uint64 `json:"before,omitempty"` // "history": page backwards from this ID
+	After      uint64 `json:"after,omitempty"`  // "history": page forwards from this ID
+	Limit      int    `json:"limit,omitempty"`
+	Ref        uint64 `json:"ref,omitempty"`        // "edit" | "delete" | "react": target message ID; "read": last message seen
+	Emoji      string `json:"emoji,omitempty"`      // "react"
+	To         string `json:"to,omitempty"`         // "dm": recipient authorID; "history": DM peer instead of a channel
+	Attachment string `json:"attachment,omitempty"` // chat line or "dm": ID returned by POST /api/attachments
+	State      string `json:"state,omitempty"`      // "presence": "active" | "idle" | "away"
+}
+
 func handleWS(w http.ResponseWriter, r *http.Request, h *hub) {
 	upgrader := websocket.Upgrader{
 		CheckOrigin:      func(r *http.Request) bool { return true },
@@ -204,6 +686,11 @@ func handleWS(w http.ResponseWriter, r *http.Request, h *hub) {
 		WriteBufferSize:  1024,
 		HandshakeTimeout: 10 * time.Second,
 	}
+	ip := clientIP(r)
+	if until, banned := h.banned("", ip); banned {
+		http.Error(w, banNotice(until), http.StatusForbidden)
+		return
+	}
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		return
@@ -217,19 +704,8 @@ func handleWS(w http.ResponseWriter, r *http.Request, h *hub) {
 		return nil
 	})
 
-	mu := &sync.Mutex{}
-	h.mu.Lock()
-	h.conns[conn] = struct{}{}
-	h.connMu[conn] = mu
-	backlog := append([]message(nil), h.messages...)
-	h.mu.Unlock()
-
-	for _, m := range backlog {
-		mu.Lock()
-		_ = conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-		_ = writeJSON(conn, m)
-		mu.Unlock()
-	}
+	c := &wsClient{conn: conn}
+	h.register(c, ip)
 
 	// Start ping ticker to keep connection alive
 	ticker := time.NewTicker(20 * time.Second)
@@ -243,13 +719,9 @@ func handleWS(w http.ResponseWriter, r *http.Request, h *hub) {
 		for {
 			select {
 			case <-ticker.C:
-				mu.Lock()
-				_ = conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-				if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
-					mu.Unlock()
+				if err := c.ping(); err != nil {
 					return
 				}
-				mu.Unlock()
 			case <-done:
 				return
 			}
@@ -260,98 +732,235 @@ func handleWS(w http.ResponseWriter, r *http.Request, h *hub) {
 	go func() {
 		defer func() {
 			close(done)
-			var leftUser string
-			var uid string
-			var lastConn bool
-			h.mu.Lock()
-			uid = h.connUID[conn]
-			if uid != "" {
-				if set, ok := h.userConns[uid]; ok {
-					delete(set, conn)
-					if len(set) == 0 {
-						lastConn = true
-						delete(h.userConns, uid)
-					} else {
-						h.userConns[uid] = set
-					}
-				}
-				leftUser = h.userName[uid]
-				if lastConn {
-					delete(h.userName, uid)
-				}
-				delete(h.connUID, conn)
-			}
-			delete(h.conns, conn)
-			delete(h.connMu, conn)
-			h.mu.Unlock()
-			if leftUser != "" && lastConn {
-				h.broadcast(message{TS: time.Now().UTC(), User: leftUser, Event: "left"})
-				h.broadcastRoster()
-			}
-			mu.Lock()
-			_ = conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-			_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
-			_ = conn.Close()
-			mu.Unlock()
+			h.unregister(c)
+			c.close(websocket.CloseNormalClosure, "")
 			h.wg.Done()
 		}()
 		for {
-			var req struct {
-				User string `json:"user"`
-				Text string `json:"text"`
-				UID  string `json:"uid"`
-			}
+			var req request
 			// Reset read deadline on each message
 			_ = conn.SetReadDeadline(time.Now().Add(60 * time.Second))
 			if err := conn.ReadJSON(&req); err != nil {
 				log.Debug().Err(err).Msg("[chat] failed to read JSON from client")
 				return
 			}
-			// Sanitize nickname: limit length and remove control characters
-			req.User = sanitizeString(req.User, 100)
-			if req.User == "" {
-				req.User = "anon"
+			if !h.handle(c, ip, req) {
+				return
 			}
-			// Sanitize message text: limit length and remove control characters
-			req.Text = sanitizeString(req.Text, 10000)
-			if req.UID == "" {
-				// Fallback to a per-connection unique id if client didn't provide one
-				req.UID = strconv.FormatInt(time.Now().UnixNano(), 10)
+		}
+	}()
+}
+
+// handle processes one request from connection c. It returns false when the
+// connection must be closed.
+func (h *hub) handle(c client, ip string, req request) bool {
+	// Sanitize nickname: limit length and remove control characters
+	req.User = sanitizeString(req.User, 100)
+	if req.User == "" {
+		req.User = "anon"
+	}
+	if req.UID == "" {
+		// Fallback to a per-connection unique id if client didn't provide one
+		req.UID = strconv.FormatInt(time.Now().UnixNano(), 10)
+	}
+	req.Channel = normalizeChannel(req.Channel)
+	// Sanitize message text: limit length and remove control characters
+	req.Text = h.sanitizeText(req.Channel, req.Text)
+	// map connection to uid and maintain per-user state
+	var renamed, identified bool
+	h.mu.Lock()
+	if _, live := h.conns[c]; !live {
+		// unregister already ran, e.g. an event stream closed while its
+		// POST /send was on the way; recording anything would leave a ghost
+		h.mu.Unlock()
+		return false
+	}
+	if _, ok := h.connUID[c]; !ok {
+		identified = true
+		h.connUID[c] = req.UID
+		if _, ok := h.userConns[req.UID]; !ok {
+			h.userConns[req.UID] = map[client]struct{}{}
+		}
+		h.userConns[req.UID][c] = struct{}{}
+		h.authorUID[authorID(req.UID)] = req.UID
+	}
+	if cur, ok := h.userName[req.UID]; !ok {
+		h.userName[req.UID] = req.User
+	} else if cur != req.User {
+		h.userName[req.UID] = req.User
+		renamed = true
+	}
+	joinedAny := len(h.connChans[c]) > 0
+	// A connection keeps the UID it first identified with
+	uid := h.connUID[c]
+	h.mu.Unlock()
+	if until, banned := h.banned(uid, ip); banned {
+		h.send(c, message{TS: time.Now().UTC(), Event: "error", Text: banNotice(until)})
+		return false
+	}
+	if identified && h.isModerator(uid) {
+		h.send(c, message{TS: time.Now().UTC(), Event: "op"})
+	}
+	if renamed {
+		// Only update rosters, don't announce rename in chat
+		for _, name := range h.joinedChannels(c) {
+			h.broadcastRoster(name)
+		}
+	}
+
+	switch req.Type {
+	case "join":
+		if req.Channel != "" {
+			h.join(c, req.Channel)
+		}
+		return true
+	case "leave":
+		if req.Channel != "" {
+			h.leave(c, req.Channel)
+		}
+		return true
+	case "dm":
+		if req.Text != "" || req.Attachment != "" {
+			switch h.throttle(c, uid, ip, "", req.Text) {
+			case limitMuted:
+				return true
+			case limitBanned:
+				return false
 			}
-			// map connection to uid and maintain per-user state
-			var announce bool
-			var renamed bool
-			h.mu.Lock()
-			if _, ok := h.connUID[conn]; !ok {
-				h.connUID[conn] = req.UID
-				if _, ok := h.userConns[req.UID]; !ok {
-					h.userConns[req.UID] = map[*websocket.Conn]struct{}{}
-				}
-				if len(h.userConns[req.UID]) == 0 {
-					announce = true
-				}
-				h.userConns[req.UID][conn] = struct{}{}
+			// Commands typed in a DM tab run rather than reaching the peer;
+			// /op would otherwise leak the admin key.
+			var handled bool
+			if req.Text, handled = h.runCommand(c, uid, req.User, "", req.Text); handled {
+				return true
+			}
+			var att *attachment
+			var err error
+			if req.Attachment != "" {
+				att, err = h.resolveAttachment(req.Attachment, authorID(uid))
 			}
-			if cur, ok := h.userName[req.UID]; !ok {
-				h.userName[req.UID] = req.User
-			} else if cur != req.User {
-				h.userName[req.UID] = req.User
-				renamed = true
+			if err == nil {
+				err = h.sendDirect(uid, req.To, req.Text, att)
 			}
-			h.mu.Unlock()
-			if announce {
-				h.broadcast(message{TS: time.Now().UTC(), User: req.User, Event: "joined"})
-				h.broadcastRoster()
-			} else if renamed {
-				// Only update roster, don't announce rename in chat
-				h.broadcastRoster()
+			if err == nil {
+				h.setPresence(uid, presenceActive)
 			}
+			if err != nil {
+				h.send(c, message{TS: time.Now().UTC(), Event: "error", Text: err.Error()})
+			}
+		}
+		return true
+	case "typing", "read":
+		if req.Channel == "" {
+			req.Channel = defaultChannel
+		}
+		if req.Type == "typing" {
+			h.typing(uid, req.Channel, req.To)
+		} else {
+			h.markRead(uid, req.Channel, req.To, req.Ref)
+		}
+		return true
+	case "presence":
+		h.setPresence(uid, req.State)
+		return true
+	case "conversations":
+		convs, err := h.conversations(uid)
+		if err != nil {
+			log.Debug().Err(err).Msg("[chat] load conversations")
+			return true
+		}
+		h.send(c, message{TS: time.Now().UTC(), Event: "conversations", Conversations: convs})
+		return true
+	case "history":
+		if req.To != "" {
+			page, more, err := h.directHistory(uid, req.To, req.Before, req.Limit)
+			if err != nil {
+				log.Debug().Err(err).Msg("[chat] load direct history page")
+				return true
+			}
+			h.send(c, message{TS: time.Now().UTC(), Event: "history", To: req.To, History: page, More: more})
+			return true
+		}
+		if req.Channel == "" {
+			req.Channel = defaultChannel
+		}
+		page, more, err := h.history(req.Channel, req.Before, req.After, req.Limit)
+		if err != nil {
+			log.Debug().Err(err).Msg("[chat] load history page")
+			return true
+		}
+		h.send(c, message{TS: time.Now().UTC(), Channel: req.Channel, Event: "history", History: page, More: more})
+		return true
+	case "edit", "delete", "react":
+		if req.Channel == "" {
+			req.Channel = defaultChannel
+		}
+		switch h.throttle(c, uid, ip, req.Channel, "") {
+		case limitMuted:
+			return true
+		case limitBanned:
+			return false
+		}
+		var err error
+		switch req.Type {
+		case "edit":
 			if req.Text == "" {
-				continue
+				err = h.deleteMessage(req.Channel, req.Ref, uid)
+			} else {
+				err = h.editMessage(req.Channel, req.Ref, uid, req.Text)
 			}
-			h.broadcast(message{TS: time.Now().UTC(), User: req.User, Text: req.Text})
+		case "delete":
+			err = h.deleteMessage(req.Channel, req.Ref, uid)
+		case "react":
+			err = h.toggleReaction(req.Channel, req.Ref, uid, strings.TrimSpace(sanitizeString(req.Emoji, maxReactionRunes)))
 		}
-	}()
+		if err != nil {
+			h.send(c, message{TS: time.Now().UTC(), Channel: req.Channel, Event: "error", Text: err.Error()})
+		}
+		return true
+	}
+	// Clients that never join explicitly land in the default channel.
+	if !joinedAny && req.Channel == "" {
+		h.join(c, defaultChannel)
+	}
+	if req.Text == "" && req.Attachment == "" {
+		return true
+	}
+	if req.Channel == "" {
+		req.Channel = defaultChannel
+	}
+	if !h.join(c, req.Channel) {
+		return true
+	}
+	switch h.throttle(c, uid, ip, req.Channel, req.Text) {
+	case limitMuted:
+		return true
+	case limitBanned:
+		return false
+	}
+	var handled bool
+	if req.Text, handled = h.runCommand(c, uid, req.User, req.Channel, req.Text); handled {
+		return true
+	}
+	if err := h.checkText(req.Channel, req.Text); err != nil {
+		h.send(c, message{TS: time.Now().UTC(), Channel: req.Channel, Event: "error", Text: err.Error()})
+		return true
+	}
+	var att *attachment
+	if req.Attachment != "" {
+		var err error
+		if h.roomSalt(req.Channel) != "" {
+			err = errEncryptedAttachment
+		} else {
+			att, err = h.resolveAttachment(req.Attachment, authorID(uid))
+		}
+		if err != nil {
+			h.send(c, message{TS: time.Now().UTC(), Channel: req.Channel, Event: "error", Text: err.Error()})
+			return true
+		}
+	}
+	h.setPresence(uid, presenceActive)
+	h.broadcast(message{TS: time.Now().UTC(), Channel: req.Channel, User: req.User, Text: req.Text, Author: authorID(uid), Attachment: att})
+	return true
 }
 
 func serveIndex(w http.ResponseWriter, r *http.Request, name string) {
@@ -366,6 +975,16 @@ func NewHandler(name string, h *hub, staticFS fs.FS) http.Handler {
 	r := chi.NewRouter()
 	r.Get("/", func(w http.ResponseWriter, r *http.Request) { serveIndex(w, r, name) })
 	r.Get("/ws", func(w http.ResponseWriter, r *http.Request) { handleWS(w, r, h) })
+	r.Get("/events", func(w http.ResponseWriter, r *http.Request) { handleEvents(w, r, h) })
+	r.Post("/send", func(w http.ResponseWriter, r *http.Request) { handleSend(w, r, h) })
+	r.Get("/api/history", func(w http.ResponseWriter, r *http.Request) { handleHistory(w, r, h) })
+	r.Get("/api/search", func(w http.ResponseWriter, r *http.Request) { handleSearch(w, r, h) })
+	r.Get("/api/stats", func(w http.ResponseWriter, r *http.Request) { handleStats(w, r, h) })
+	r.Handle("/metrics", metricsHandler(h))
+	r.Post("/api/attachments", func(w http.ResponseWriter, r *http.Request) { handleUpload(w, r, h, h.uploads) })
+	r.Get("/api/attachments/{id}", func(w http.ResponseWriter, r *http.Request) { handleDownload(w, r, h) })
+	r.Get("/api/admin/export", func(w http.ResponseWriter, r *http.Request) { handleExport(w, r, h) })
+	r.Post("/hooks/{token}", func(w http.ResponseWriter, r *http.Request) { handleIncomingHook(w, r, h) })
 	// Serve embedded static files
 	staticHandler := http.FileServer(http.FS(staticFS))
 	r.Handle("/static/*", http.StripPrefix("/static/", staticHandler))
@@ -438,6 +1057,9 @@ var indexTmpl = template.Must(template.New("chat").Parse(`<!DOCTYPE html>
     .line .image-controls { display: flex; gap: 4px; margin-top: 4px; }
     .line .image-controls button { padding: 4px 8px; background: var(--panel); border: 1px solid var(--border); border-radius: 4px; color: var(--fg); font-size: 12px; cursor: pointer; }
     .line .image-controls button:hover { border-color: var(--accent); }
+    .line img.attachment-img { display: block; }
+    .line .attachment-file { display: inline-block; margin-top: 4px; padding: 4px 10px; background: var(--panel); border: 1px solid var(--border); border-radius: 6px; color: var(--fg); text-decoration: none; font-size: 13px; }
+    .line .attachment-file:hover { border-color: var(--accent); }
     .image-modal { display: none; position: fixed; top: 0; left: 0; width: 100%; height: 100%; background: rgba(0, 0, 0, 0.95); z-index: 9999; justify-content: center; align-items: center; cursor: pointer; }
     .image-modal.show { display: flex; }
     .image-modal img { max-width: 95%; max-height: 95%; object-fit: contain; border-radius: 4px; }
@@ -456,6 +1078,41 @@ var indexTmpl = template.Must(template.New("chat").Parse(`<!DOCTYPE html>
     .users-list::-webkit-scrollbar-thumb { background: var(--border); border-radius: 4px; }
     .users-list::-webkit-scrollbar-thumb:hover { background: var(--muted); }
     .userspill { cursor: pointer; }
+    .chanbar { display:flex; align-items:center; gap:6px; padding:6px 12px; border-bottom:1px solid var(--border); overflow-x:auto; font-family: 'D2Coding', ui-monospace, SFMono-Regular, Menlo, Consolas, monospace; font-size:13px }
+    .chan { display:inline-flex; align-items:center; gap:4px; border:1px solid var(--border); border-radius:999px; padding:2px 10px; color:var(--muted); cursor:pointer; white-space:nowrap }
+    .chan.active { color:var(--fg); border-color:var(--accent) }
+    .chan .unread { background:#d97706; color:#fef3c7; border-radius:999px; padding:0 6px; font-size:11px }
+    .chan .close { color:var(--muted); cursor:pointer }
+    .chan .close:hover { color:#ef4444 }
+    .chan-add { background:transparent; border:1px dashed var(--border); color:var(--muted); border-radius:999px; padding:2px 10px; font-family:inherit; font-size:13px; cursor:pointer }
+    .chan-add:hover { color:var(--fg); border-color:var(--accent) }
+    .line { position: relative }
+    .line .actions { display:none; position:absolute; right:4px; top:0; gap:2px; background:var(--panel); border:1px solid var(--border); border-radius:6px; padding:1px 2px }
+    .line:hover .actions { display:inline-flex }
+    .line .actions button { background:transparent; border:none; color:var(--muted); cursor:pointer; font-size:12px; padding:1px 4px }
+    .line .actions button:hover { color:var(--fg) }
+    .line .edited { color:var(--muted); font-size:11px }
+    .line .deleted { color:var(--muted); font-style:italic }
+    .line .locked { color:var(--muted); font-style:italic; cursor:pointer }
+    .line .lock { font-size:11px }
+    .topicbar.locked { cursor:pointer }
+    .reactions { display:flex; flex-wrap:wrap; gap:4px; margin:2px 0 2px 0 }
+    .reaction { border:1px solid var(--border); border-radius:999px; padding:0 6px; font-size:12px; cursor:pointer; color:var(--fg); background:transparent }
+    .reaction.mine { border-color:var(--accent) }
+    .line.notice { color:#f59e0b }
+    .line.me { color:#c084fc; font-style:italic }
+    .line .bot { border:1px solid var(--border); border-radius:4px; padding:0 4px; font-size:11px; color:var(--muted) }
+    .searchbtn { background:transparent; border:1px solid var(--border); border-radius:999px; padding:2px 8px; color:var(--fg); font-size:12px; cursor:pointer; margin-right:6px }
+    .searchbtn:hover { border-color:var(--accent) }
+    .search-form { display:flex; flex-wrap:wrap; gap:6px; margin-bottom:10px }
+    .search-form input { flex:1 1 120px; min-width:0; background:var(--bg); border:1px solid var(--border); border-radius:6px; color:var(--fg); padding:6px 8px; font-family:inherit; font-size:13px }
+    .search-form input[type=date] { flex:1 1 45% }
+    .search-result { cursor:pointer }
+    .search-result:hover { border-color:var(--accent) }
+    .search-result .where { color:var(--muted); font-size:12px }
+    .line.focus { background:rgba(217,119,6,0.18); transition:background 2s ease }
+    .topicbar { padding:4px 14px; border-bottom:1px solid var(--border); color:var(--muted); font-size:12px; white-space:nowrap; overflow:hidden; text-overflow:ellipsis }
+    .topicbar:empty { display:none }
     .promptline { display:flex; align-items:center; gap:8px; padding:12px 14px; border-top:1px solid var(--border); font-family: 'D2Coding', ui-monospace, SFMono-Regular, Menlo, Consolas, monospace; background: var(--panel); }
 
     /* Mobile: Fixed input at bottom */
@@ -506,6 +1163,11 @@ var indexTmpl = template.Must(template.New("chat").Parse(`<!DOCTYPE html>
       text-overflow:ellipsis;
     }
     .new-message-bubble.show { opacity:1; pointer-events:auto; }
+    .typing { min-height: 16px; padding: 0 12px; color: var(--muted); font-size: 12px; font-style: italic; }
+    .line .receipts { color: var(--muted); font-size: 11px; text-align: right; }
+    .presence { display: inline-block; width: 8px; height: 8px; border-radius: 50%; margin-right: 8px; background: #22c55e; }
+    .presence.idle { background: #eab308; }
+    .presence.away { background: var(--muted); }
 
     /* Mobile responsiveness */
     @media (max-width: 640px) {
@@ -550,25 +1212,28 @@ var indexTmpl = template.Must(template.New("chat").Parse(`<!DOCTYPE html>
             <button id="roll" title="randomize nickname">🎲</button>
           </div>
         </div>
-        <div class="term-actions"><span class="userspill"><span id="users-count">0</span> Online</span></div>
+        <div class="term-actions"><button id="search-open" class="searchbtn" title="search history">🔍</button><span class="userspill"><span id="users-count">0</span> Online</span></div>
       </div>
+      <div id="channels" class="chanbar"></div>
+      <div id="topic" class="topicbar"></div>
       <div id="log" class="screen"></div>
       <div id="resizer" class="resizer" role="separator" aria-orientation="horizontal" aria-label="Resize chat"></div>
       <div id="new-message-bubble" class="new-message-bubble"></div>
+      <div id="typing" class="typing" aria-live="polite"></div>
       <div class="promptline">
         <span id="prompt"></span>
-        <button class="image-upload-btn" id="image-upload-btn" title="Upload image">
+        <button class="image-upload-btn" id="image-upload-btn" title="Attach a file">
           <svg viewBox="0 0 24 24" fill="none" stroke="currentColor" stroke-width="2">
             <rect x="3" y="3" width="18" height="18" rx="2" ry="2"></rect>
             <circle cx="8.5" cy="8.5" r="1.5"></circle>
             <polyline points="21 15 16 10 5 21"></polyline>
           </svg>
         </button>
-        <input type="file" id="image-input" accept="image/*" />
+        <input type="file" id="image-input" />
         <textarea id="cmd" autocomplete="off" spellcheck="false" placeholder="type a message and press Enter" enterkeyhint="send" inputmode="text" rows="1"></textarea>
       </div>
     </div>
-    <small>Tip: Enter to send • Shift+Enter for new line • Nickname persists locally</small>
+    <small>Tip: Enter to send • Shift+Enter for new line • Nickname persists locally • /help lists commands</small>
   </div>
   <div id="image-modal" class="image-modal">
     <img id="modal-image" src="" alt="Full size image" />
@@ -576,11 +1241,24 @@ var indexTmpl = template.Must(template.New("chat").Parse(`<!DOCTYPE html>
   <div id="users-modal-overlay" class="users-modal-overlay"></div>
   <div id="users-modal" class="users-modal">
     <div class="users-modal-header">
-      <h3>Online Users</h3>
+      <h3 id="users-modal-title">Online Users</h3>
       <button id="users-modal-close" class="users-modal-close">&times;</button>
     </div>
     <div id="users-list" class="users-list"></div>
   </div>
+  <div id="search-modal" class="users-modal">
+    <div class="users-modal-header">
+      <h3>Search</h3>
+      <button id="search-close" class="users-modal-close">&times;</button>
+    </div>
+    <form id="search-form" class="search-form">
+      <input id="search-q" type="search" placeholder="words to find" />
+      <input id="search-user" type="text" placeholder="from user" />
+      <input id="search-from" type="date" title="on or after" />
+      <input id="search-to" type="date" title="before" />
+    </form>
+    <div id="search-results" class="users-list"></div>
+  </div>
   <script>
     const log = document.getElementById('log');
     const resizer = document.getElementById('resizer');
@@ -598,6 +1276,9 @@ var indexTmpl = template.Must(template.New("chat").Parse(`<!DOCTYPE html>
     const usersModalOverlay = document.getElementById('users-modal-overlay');
     const usersModalClose = document.getElementById('users-modal-close');
     const usersList = document.getElementById('users-list');
+    const channelBar = document.getElementById('channels');
+    const topicBar = document.getElementById('topic');
+    const usersModalTitle = document.getElementById('users-modal-title');
 
     // Persisted chat height
     const CHAT_HEIGHT_KEY = 'chatHeightPx';
@@ -680,6 +1361,256 @@ var indexTmpl = template.Must(template.New("chat").Parse(`<!DOCTYPE html>
     // Store current online users
     let onlineUsers = [];
 
+    // Channels: joined list and active tab persist locally; logs/rosters are per channel
+    const DEFAULT_CHANNEL = 'general';
+    const maxChannelLog = 200;
+    let joinedChannels = [DEFAULT_CHANNEL];
+    try {
+      const saved = JSON.parse(localStorage.getItem('channels') || 'null');
+      if (Array.isArray(saved) && saved.length > 0) joinedChannels = saved;
+    } catch(_) {}
+    let activeChannel = joinedChannels[0];
+    try {
+      const saved = localStorage.getItem('channel');
+      if (saved && joinedChannels.includes(saved)) activeChannel = saved;
+    } catch(_) {}
+    let knownChannels = [];
+    const channelLogs = {};
+    const channelRosters = {};
+    const channelMembers = {};
+    const channelTopics = {};
+    function renderTopic(){
+      const topic = isDM(activeChannel) ? '' : (channelTopics[activeChannel] || '');
+      const sealed = !isDM(activeChannel) && roomSalts[activeChannel];
+      topicBar.classList.toggle('locked', !!sealed && !roomKeys[activeChannel]);
+      if (!sealed) {
+        topicBar.textContent = topic;
+        return;
+      }
+      topicBar.textContent = '🔒 end-to-end encrypted' + (roomKeys[activeChannel] ? '' : ' — click to enter the passphrase') + (topic ? ' · ' + topic : '');
+    }
+    topicBar.addEventListener('click', () => {
+      if (!isDM(activeChannel) && roomSalts[activeChannel] && !roomKeys[activeChannel]) unlockRoom(activeChannel);
+    });
+    const unreadCounts = {};
+    // Direct messages live in pseudo-channels keyed '@' + peer author handle
+    const dmPeers = {};   // author -> nickname
+    let openDMs = [];     // peers shown in the tab bar, most recent first
+    function isDM(key){ return key.charAt(0) === '@'; }
+    function channelLabel(key){ return isDM(key) ? '@' + (dmPeers[key.slice(1)] || key.slice(1, 7)) : (roomSalts[key] ? '🔒#' : '#') + key; }
+
+    // End-to-end encrypted rooms: the server only ever sees 'e2e:v1:' envelopes.
+    // Keys are derived from the room passphrase and kept in memory for this tab.
+    const roomSalts = {}; // channel -> salt announced by the server
+    const roomKeys = {};  // channel -> AES-GCM CryptoKey
+    const CIPHER_PREFIX = 'e2e:v1:';
+    function isCipher(text){ return typeof text === 'string' && text.startsWith(CIPHER_PREFIX); }
+    function toBase64(bytes){
+      let s = '';
+      for (let i = 0; i < bytes.length; i++) s += String.fromCharCode(bytes[i]);
+      return btoa(s);
+    }
+    function fromBase64(s){
+      const bin = atob(s);
+      const out = new Uint8Array(bin.length);
+      for (let i = 0; i < bin.length; i++) out[i] = bin.charCodeAt(i);
+      return out;
+    }
+    function deriveRoomKey(ch, pass){
+      const enc = new TextEncoder();
+      return crypto.subtle.importKey('raw', enc.encode(pass), 'PBKDF2', false, ['deriveKey']).then(base =>
+        crypto.subtle.deriveKey({ name: 'PBKDF2', hash: 'SHA-256', salt: enc.encode(ch + ':' + roomSalts[ch]), iterations: 250000 },
+          base, { name: 'AES-GCM', length: 256 }, false, ['encrypt', 'decrypt']));
+    }
+    // The channel name is authenticated too, so ciphertext cannot be replayed into another room
+    function sealText(ch, text){
+      const iv = crypto.getRandomValues(new Uint8Array(12));
+      const enc = new TextEncoder();
+      return crypto.subtle.encrypt({ name: 'AES-GCM', iv: iv, additionalData: enc.encode(ch) }, roomKeys[ch], enc.encode(text)).then((ct) => {
+        const out = new Uint8Array(12 + ct.byteLength);
+        out.set(iv);
+        out.set(new Uint8Array(ct), 12);
+        return CIPHER_PREFIX + toBase64(out);
+      });
+    }
+    function openText(ch, cipher){
+      const raw = fromBase64(cipher.slice(CIPHER_PREFIX.length));
+      return crypto.subtle.decrypt({ name: 'AES-GCM', iv: raw.slice(0, 12), additionalData: new TextEncoder().encode(ch) }, roomKeys[ch], raw.slice(12))
+        .then(pt => new TextDecoder().decode(pt));
+    }
+    function unlockRoom(ch){
+      if (!roomSalts[ch]) return Promise.resolve(false);
+      if (!(window.crypto && crypto.subtle)) {
+        showConnectionMessage('end-to-end encryption needs a secure (https) page');
+        return Promise.resolve(false);
+      }
+      const pass = prompt('Passphrase for 🔒#' + ch);
+      if (!pass) return Promise.resolve(false);
+      return deriveRoomKey(ch, pass).then((key) => {
+        roomKeys[ch] = key;
+        (channelLogs[ch] || []).forEach((m) => { if (m.cipher) openSealed(ch, m); });
+        if (ch === activeChannel) renderTopic();
+        return true;
+      });
+    }
+    // unseal moves ciphertext aside and decrypts it when the room key is known
+    function unseal(ch, msg){
+      if (!isCipher(msg.text)) {
+        msg.sealed = false;
+        return;
+      }
+      msg.cipher = msg.text;
+      msg.text = '';
+      msg.locked = true;
+      openSealed(ch, msg);
+    }
+    function openSealed(ch, msg){
+      if (!roomKeys[ch]) return;
+      openText(ch, msg.cipher).then((text) => {
+        msg.text = text;
+        msg.locked = false;
+        msg.sealed = true;
+        msg.badKey = false;
+      }).catch(() => {
+        msg.locked = true;
+        msg.badKey = true;
+      }).then(() => refreshLine(ch, msg));
+    }
+    // refreshLine redraws one message whether it is on screen or still waiting to be appended
+    function refreshLine(ch, msg){
+      if (ch !== activeChannel || !msg.id) return;
+      const next = buildLine(msg);
+      if (!next) return;
+      const i = pendingAppends.findIndex(d => d.dataset.id === String(msg.id));
+      if (i >= 0) {
+        pendingAppends[i] = next;
+        return;
+      }
+      const old = log.querySelector('.line[data-id="' + msg.id + '"]');
+      if (old) {
+        old.replaceWith(next);
+        renderReceipts();
+      }
+    }
+    function messageBody(msg){
+      if (msg.locked) {
+        return '<span class="locked" title="enter the room passphrase to read">🔒 ' + (msg.badKey ? 'cannot decrypt — wrong passphrase?' : 'encrypted message') + '</span>';
+      }
+      return (msg.sealed ? '<span class="lock" title="end-to-end encrypted">🔒</span> ' : '') + linkifyText(msg.text || '');
+    }
+
+    function normalizeChannel(name){
+      return String(name || '').trim().replace(/^#/, '').toLowerCase().replace(/[^a-z0-9_-]/g, '').slice(0, 32);
+    }
+    function saveChannels(){
+      try {
+        localStorage.setItem('channels', JSON.stringify(joinedChannels));
+        localStorage.setItem('channel', activeChannel);
+      } catch(_) {}
+    }
+    function renderChannels(){
+      channelBar.innerHTML = '';
+      joinedChannels.concat(openDMs.map(p => '@' + p)).forEach((name) => {
+        const tab = document.createElement('span');
+        tab.className = 'chan' + (name === activeChannel ? ' active' : '');
+        tab.textContent = channelLabel(name);
+        if (unreadCounts[name]) {
+          const badge = document.createElement('span');
+          badge.className = 'unread';
+          badge.textContent = String(unreadCounts[name]);
+          tab.appendChild(badge);
+        }
+        if (isDM(name) || joinedChannels.length > 1) {
+          const close = document.createElement('span');
+          close.className = 'close';
+          close.title = isDM(name) ? 'close conversation' : 'leave #' + name;
+          close.textContent = '×';
+          close.addEventListener('click', (e) => { e.stopPropagation(); isDM(name) ? closeDM(name.slice(1)) : leaveChannel(name); });
+          tab.appendChild(close);
+        }
+        tab.addEventListener('click', () => switchChannel(name));
+        channelBar.appendChild(tab);
+      });
+      const add = document.createElement('button');
+      add.className = 'chan-add';
+      add.textContent = '+ channel';
+      add.title = knownChannels.length ? 'channels: ' + knownChannels.map(n => '#' + n).join(' ') : 'join a channel';
+      add.addEventListener('click', () => {
+        const name = normalizeChannel(prompt('Join channel', knownChannels.find(n => !joinedChannels.includes(n)) || ''));
+        if (name) joinChannel(name);
+      });
+      channelBar.appendChild(add);
+    }
+    function sendJoin(name){
+      // Server replays the channel backlog on join, so start from an empty log
+      channelLogs[name] = [];
+      historyState[name] = {};
+      if (name === activeChannel) log.innerHTML = '';
+      if (ws && ws.readyState === WebSocket.OPEN) {
+        try { ws.send(JSON.stringify({ type: 'join', channel: name, user: (user.value || 'anon'), uid: clientUID })); } catch(_) {}
+      }
+    }
+    function joinChannel(name){
+      if (!joinedChannels.includes(name)) {
+        joinedChannels.push(name);
+        sendJoin(name);
+      }
+      switchChannel(name);
+    }
+    function leaveChannel(name){
+      if (joinedChannels.length <= 1) return;
+      joinedChannels = joinedChannels.filter(n => n !== name);
+      delete channelLogs[name];
+      delete channelRosters[name];
+      delete unreadCounts[name];
+      if (ws && ws.readyState === WebSocket.OPEN) {
+        try { ws.send(JSON.stringify({ type: 'leave', channel: name, user: (user.value || 'anon'), uid: clientUID })); } catch(_) {}
+      }
+      if (activeChannel === name) {
+        switchChannel(joinedChannels[0]);
+      } else {
+        saveChannels();
+        renderChannels();
+      }
+    }
+    function openDM(peer, name){
+      if (!peer || peer === myAuthor) return;
+      if (name) dmPeers[peer] = name;
+      openDMs = [peer].concat(openDMs.filter(p => p !== peer));
+      switchChannel('@' + peer);
+    }
+    function closeDM(peer){
+      openDMs = openDMs.filter(p => p !== peer);
+      if (activeChannel === '@' + peer) {
+        switchChannel(joinedChannels[0]);
+      } else {
+        renderChannels();
+      }
+    }
+    function switchChannel(name){
+      if (isDM(name) && !channelLogs[name]) {
+        // First open: load the latest page of the conversation
+        channelLogs[name] = [];
+        historyState[name] = { loading: true };
+        if (ws && ws.readyState === WebSocket.OPEN) {
+          try { ws.send(JSON.stringify({ type: 'history', to: name.slice(1), limit: 50, user: (user.value || 'anon'), uid: clientUID })); } catch(_) {}
+        }
+      }
+      activeChannel = name;
+      unreadCounts[name] = 0;
+      saveChannels();
+      renderChannels();
+      log.innerHTML = '';
+      (channelLogs[name] || []).forEach(renderLine);
+      renderRoster(channelRosters[name] || []);
+      renderTopic();
+      renderTyping();
+      renderReceipts();
+      scrollToBottom();
+      setPrompt();
+      sendRead();
+    }
+
     // Smart scroll functions
     function isScrolledToBottom() {
       const threshold = 50;
@@ -703,7 +1634,7 @@ var indexTmpl = template.Must(template.New("chat").Parse(`<!DOCTYPE html>
 
     function setPrompt(){
       const nick = (user.value || 'anon').replace(/\s+/g,'') || 'anon';
-      promptEl.innerHTML = sanitizeNickname(nick) + '<span style="color:var(--fg)">@chat:~$</span>';
+      promptEl.innerHTML = sanitizeNickname(nick) + '<span style="color:var(--fg)">@' + escapeHTML(channelLabel(activeChannel)) + ':~$</span>';
     }
     function randomNick(){
       // Short nickname: one word + 4-digit number
@@ -719,6 +1650,16 @@ var indexTmpl = template.Must(template.New("chat").Parse(`<!DOCTYPE html>
     try { clientUID = localStorage.getItem('uid'); } catch(_) {}
     if(!clientUID || clientUID.length < 8){ clientUID = genUID() || fallbackUID(); try { localStorage.setItem('uid', clientUID); } catch(_) {} }
 
+    // Public author handle: first 8 bytes of SHA-256(uid), matching the server's authorID.
+    // Used to recognise our own messages (edit/delete) and our own reactions.
+    let myAuthor = null;
+    try {
+      crypto.subtle.digest('SHA-256', new TextEncoder().encode(clientUID)).then((buf) => {
+        myAuthor = Array.from(new Uint8Array(buf).slice(0, 8)).map(b => b.toString(16).padStart(2, '0')).join('');
+        if (typeof switchChannel === 'function') switchChannel(activeChannel);
+      });
+    } catch(_) {}
+
     // Restore nickname or initialize randomly
     let savedNick = null;
     try { savedNick = localStorage.getItem('nick'); } catch(_) {}
@@ -765,13 +1706,23 @@ var indexTmpl = template.Must(template.New("chat").Parse(`<!DOCTYPE html>
       if (onlineUsers.length === 0) {
         usersList.innerHTML = '<div class="users-list-item">No users online</div>';
       } else {
-        onlineUsers.forEach((username) => {
+        const members = channelMembers[activeChannel] || [];
+        onlineUsers.forEach((username, i) => {
           const item = document.createElement('div');
           item.className = 'users-list-item';
-          item.innerHTML = sanitizeNickname(username);
+          const m = members[i];
+          const state = m && (m.state === 'idle' || m.state === 'away') ? m.state : 'active';
+          item.innerHTML = '<span class="presence ' + state + '" title="' + state + '"></span>' + sanitizeNickname(username);
+          if (m && m.author && m.author !== myAuthor) {
+            // Click a teammate to open a private conversation
+            item.style.cursor = 'pointer';
+            item.title = 'send a direct message';
+            item.addEventListener('click', () => { hideUsersModal(); openDM(m.author, m.name); });
+          }
           usersList.appendChild(item);
         });
       }
+      usersModalTitle.textContent = 'Online in ' + channelLabel(activeChannel);
       usersModal.classList.add('show');
       usersModalOverlay.classList.add('show');
     }
@@ -790,45 +1741,408 @@ var indexTmpl = template.Must(template.New("chat").Parse(`<!DOCTYPE html>
 
     // Close modal on overlay click
     usersModalOverlay.addEventListener('click', hideUsersModal);
+
+    // Search: query /api/search and jump to a result's place in its channel
+    const searchModal = document.getElementById('search-modal');
+    const searchForm = document.getElementById('search-form');
+    const searchResults = document.getElementById('search-results');
+    function showSearch(){
+      searchModal.classList.add('show');
+      usersModalOverlay.classList.add('show');
+      document.getElementById('search-q').focus();
+    }
+    function hideSearch(){
+      searchModal.classList.remove('show');
+      usersModalOverlay.classList.remove('show');
+    }
+    async function runSearch(){
+      const params = new URLSearchParams();
+      const q = document.getElementById('search-q').value.trim();
+      if (!q) return;
+      params.set('q', q);
+      const who = document.getElementById('search-user').value.trim();
+      if (who) params.set('user', who);
+      const from = document.getElementById('search-from').value;
+      if (from) params.set('from', from);
+      const to = document.getElementById('search-to').value;
+      if (to) params.set('to', to);
+      searchResults.innerHTML = '<div class="users-list-item">searching…</div>';
+      let results = [];
+      try {
+        const res = await fetch('/api/search?' + params.toString());
+        if (!res.ok) throw new Error(await res.text());
+        results = (await res.json()).results || [];
+      } catch(e) {
+        searchResults.innerHTML = '';
+        const item = document.createElement('div');
+        item.className = 'users-list-item';
+        item.textContent = 'search failed: ' + (e.message || e);
+        searchResults.appendChild(item);
+        return;
+      }
+      searchResults.innerHTML = '';
+      if (results.length === 0) {
+        searchResults.innerHTML = '<div class="users-list-item">No matches</div>';
+        return;
+      }
+      results.forEach((m) => {
+        const item = document.createElement('div');
+        item.className = 'users-list-item search-result';
+        const when = new Date(m.ts).toLocaleString([], { hour12: false });
+        item.innerHTML = '<div class="where">#' + escapeHTML(m.channel) + ' · ' + escapeHTML(when) + '</div>' +
+          '<span class="usr" style="color:' + colorFor(m.user || 'anon') + '">' + sanitizeNickname(m.user || 'anon') + '</span>: ' + escapeHTML(m.text || '');
+        item.addEventListener('click', () => { hideSearch(); jumpTo(m.channel, m.id); });
+        searchResults.appendChild(item);
+      });
+    }
+    document.getElementById('search-open').addEventListener('click', showSearch);
+    document.getElementById('search-close').addEventListener('click', hideSearch);
+    usersModalOverlay.addEventListener('click', hideSearch);
+    searchForm.addEventListener('submit', (e) => { e.preventDefault(); runSearch(); });
+    searchForm.addEventListener('change', runSearch);
     // Batch DOM updates for better performance
     let pendingAppends = [];
     let pendingMessages = [];
     let appendTimer = null;
 
     function append(msg){
+      const ch = msg.channel || DEFAULT_CHANNEL;
+      if (msg.event === 'channels') {
+        knownChannels = msg.names || [];
+        renderChannels();
+        return;
+      }
+      if (msg.event === 'op') {
+        // Moderators may delete anyone's messages
+        isModerator = true;
+        return;
+      }
+      if (msg.event === 'conversations') {
+        (msg.conversations || []).forEach((c) => {
+          if (c.name) dmPeers[c.peer] = c.name;
+          if (!openDMs.includes(c.peer) && openDMs.length < 8) openDMs.push(c.peer);
+        });
+        renderChannels();
+        return;
+      }
+      if (msg.event === 'dm' || (msg.event === 'history' && msg.to)) {
+        routeDirect(msg);
+        return;
+      }
       if (msg.event === 'roster') {
-        logWS('DEBUG', 'Roster event received with ' + (msg.users ? msg.users.length : 0) + ' users', msg.users);
-        renderRoster(msg.users || []);
+        logWS('DEBUG', 'Roster event for #' + ch + ' received with ' + (msg.users ? msg.users.length : 0) + ' users', msg.users);
+        channelRosters[ch] = msg.users || [];
+        channelMembers[ch] = msg.members || [];
+        channelReads[ch] = {};
+        channelMembers[ch].forEach((m) => { if (m.read) channelReads[ch][m.author] = { name: m.name, ref: m.read }; });
+        if (ch === activeChannel) {
+          renderRoster(channelRosters[ch]);
+          renderReceipts();
+        }
         return;
       }
+      if (msg.event === 'typing' || msg.event === 'presence' || msg.event === 'read') {
+        liveEvent(msg);
+        return;
+      }
+      if (!joinedChannels.includes(ch)) return;
+      if (msg.event === 'history') {
+        mergeHistory(ch, msg.history || [], !!msg.more);
+        return;
+      }
+      if (msg.event === 'edit' || msg.event === 'delete' || msg.event === 'react') {
+        applyMutation(ch, msg);
+        return;
+      }
+      if (msg.event === 'error') {
+        showConnectionMessage(msg.text || 'error');
+        return;
+      }
+      if (msg.event === 'nick') {
+        // Server-side /nick: keep the local nickname field in sync
+        user.value = msg.user || 'anon';
+        try { localStorage.setItem('nick', user.value); } catch(_) {}
+        setPrompt();
+        return;
+      }
+      if (msg.event === 'clear') {
+        channelLogs[ch] = [];
+        historyState[ch] = { exhausted: true };
+        if (ch === activeChannel) log.innerHTML = '';
+        return;
+      }
+      if (msg.event === 'topic') {
+        channelTopics[ch] = msg.text || '';
+        if (ch === activeChannel) renderTopic();
+        // Only announced changes (with a user) become log lines
+        if (!msg.user) return;
+      }
+      if (msg.event === 'encrypted') {
+        roomSalts[ch] = msg.text;
+        renderChannels();
+        if (ch === activeChannel) {
+          renderTopic();
+          setPrompt();
+        }
+        if (!msg.user) return;
+      }
+      unseal(ch, msg);
+
+      if (!msg.event && msg.author) stopTyping(ch, msg.author);
+      const entries = channelLogs[ch] || (channelLogs[ch] = []);
+      entries.push(msg);
+      if (entries.length > maxChannelLog) entries.splice(0, entries.length - maxChannelLog);
+      if (ch !== activeChannel) {
+        if (!msg.event) {
+          unreadCounts[ch] = (unreadCounts[ch] || 0) + 1;
+          renderChannels();
+        }
+        return;
+      }
+      renderLine(msg);
+    }
 
+    // buildLine turns a message into its log line element (null if not displayed)
+    function buildLine(msg){
       const div = document.createElement('div');
       div.className = 'line';
+      if (msg.id) div.dataset.id = String(msg.id);
       const ts = new Date(msg.ts).toLocaleTimeString([], { hour12: false, hour: '2-digit', minute: '2-digit', second: '2-digit' });
       const nick = (msg.user || 'anon');
       const color = colorFor(nick);
 
-      let isActualMessage = false;
-
       if (msg.event === 'rename') {
         logWS('DEBUG', 'Rename event (not displayed): ' + nick);
         // Don't show rename events
-        return;
+        return null;
       } else if (msg.event === 'joined' || msg.event === 'left') {
         const verb = msg.event === 'joined' ? 'joined' : 'left';
-        logWS('INFO', 'User ' + verb + ': ' + nick);
         div.className = 'line event';
         div.innerHTML = '<span class="ts">[' + ts + ']</span> system: ' + sanitizeNickname(nick) + ' ' + verb;
+      } else if (msg.event === 'system') {
+        div.className = 'line event';
+        div.innerHTML = '<span class="ts">[' + ts + ']</span> system: ' + escapeHTML(msg.text || '').replace(/\n/g, '<br>');
+      } else if (msg.deleted) {
+        div.innerHTML = '<span class="ts">[' + ts + ']</span> <span class="usr" style="color:' + color + '">' +
+          sanitizeNickname(nick) + '</span>: <span class="deleted">message deleted</span>';
+      } else if (msg.event === 'me') {
+        div.className = 'line me';
+        div.innerHTML = '<span class="ts">[' + ts + ']</span> * ' + sanitizeNickname(nick) + ' ' +
+          (msg.locked || msg.sealed ? messageBody(msg) : escapeHTML(msg.text || ''));
+      } else if (msg.event === 'encrypted') {
+        div.className = 'line event';
+        div.innerHTML = '<span class="ts">[' + ts + ']</span> system: ' + sanitizeNickname(nick) + ' turned on end-to-end encryption 🔒';
+      } else if (msg.event === 'topic') {
+        div.className = 'line event';
+        div.innerHTML = '<span class="ts">[' + ts + ']</span> system: ' + sanitizeNickname(nick) + ' set the topic: ' + escapeHTML(msg.text || '');
       } else {
         div.innerHTML = '<span class="ts">[' + ts + ']</span> <span class="usr" style="color:' + color + '">' +
-          sanitizeNickname(nick) + '</span>: ' + linkifyText(msg.text || '');
-        isActualMessage = true;
+          sanitizeNickname(nick) + '</span>' + (msg.bot ? ' <span class="bot">bot</span>' : '') + ': ' + messageBody(msg) +
+          (msg.edited ? ' <span class="edited">(edited)</span>' : '') + renderAttachment(msg.attachment);
+        if (msg.id && !msg.event) decorateLine(div, msg);
       }
+      return div;
+    }
 
+    // Reactions and per-message actions (react, and edit/delete for our own messages)
+    const QUICK_REACTIONS = ['👍', '❤️', '😂', '🎉', '😮', '😢'];
+    let isModerator = false;
+    function sendMutation(type, msg, extra){
+      if (!ws || ws.readyState !== WebSocket.OPEN) {
+        showConnectionMessage('연결되지 않았습니다. 연결 후 다시 시도하세요.');
+        return;
+      }
+      const payload = Object.assign({ type: type, channel: msg.channel || DEFAULT_CHANNEL, ref: msg.id, user: (user.value || 'anon'), uid: clientUID }, extra || {});
+      try { ws.send(JSON.stringify(payload)); } catch(e) { logWS('ERROR', 'Failed to send ' + type, e); }
+    }
+    function decorateLine(div, msg){
+      const reactions = msg.reactions || {};
+      const emojis = Object.keys(reactions);
+      if (emojis.length > 0) {
+        const row = document.createElement('div');
+        row.className = 'reactions';
+        emojis.forEach((emoji) => {
+          const who = reactions[emoji] || [];
+          const chip = document.createElement('button');
+          chip.className = 'reaction' + (myAuthor && who.includes(myAuthor) ? ' mine' : '');
+          chip.textContent = emoji + ' ' + who.length;
+          chip.addEventListener('click', () => sendMutation('react', msg, { emoji: emoji }));
+          row.appendChild(chip);
+        });
+        div.appendChild(row);
+      }
+      const actions = document.createElement('span');
+      actions.className = 'actions';
+      QUICK_REACTIONS.forEach((emoji) => {
+        const b = document.createElement('button');
+        b.textContent = emoji;
+        b.title = 'react ' + emoji;
+        b.addEventListener('click', () => sendMutation('react', msg, { emoji: emoji }));
+        actions.appendChild(b);
+      });
+      const mine = myAuthor && msg.author === myAuthor;
+      if (mine && !msg.locked) {
+        const edit = document.createElement('button');
+        edit.textContent = '✎';
+        edit.title = 'edit';
+        edit.addEventListener('click', () => {
+          const text = prompt('Edit message', msg.text || '');
+          if (text === null || !text.trim() || text === msg.text) return;
+          const ch = msg.channel || DEFAULT_CHANNEL;
+          if (roomKeys[ch]) {
+            sealText(ch, text).then(sealed => sendMutation('edit', msg, { text: sealed }));
+          } else {
+            sendMutation('edit', msg, { text: text });
+          }
+        });
+        actions.appendChild(edit);
+      }
+      if (mine || isModerator) {
+        const del = document.createElement('button');
+        del.textContent = '🗑';
+        del.title = mine ? 'delete' : 'delete (moderator)';
+        del.addEventListener('click', () => {
+          if (confirm('Delete this message?')) sendMutation('delete', msg);
+        });
+        actions.appendChild(del);
+      }
+      div.appendChild(actions);
+    }
+    function applyMutation(ch, ev){
+      const target = (channelLogs[ch] || []).find(m => m.id === ev.ref);
+      if (!target) return;
+      if (ev.event === 'edit') {
+        target.text = ev.text;
+        target.edited = true;
+        unseal(ch, target);
+      } else if (ev.event === 'delete') {
+        target.text = '';
+        target.deleted = true;
+        target.edited = false;
+        target.reactions = null;
+      } else if (ev.event === 'react') {
+        target.reactions = ev.reactions || null;
+      }
+      if (ch !== activeChannel) return;
+      const old = log.querySelector('.line[data-id="' + ev.ref + '"]');
+      const next = buildLine(target);
+      if (old && next) {
+        old.replaceWith(next);
+        renderReceipts();
+      }
+    }
+    function showConnectionMessage(text){
+      const div = document.createElement('div');
+      div.className = 'line notice';
+      div.textContent = '[' + new Date().toLocaleTimeString([], { hour12: false }) + '] system: ' + text;
+      log.appendChild(div);
+      if (isScrolledToBottom()) log.scrollTop = log.scrollHeight;
+    }
+
+    // Infinite scroll: page older messages in by ID cursor when the log reaches the top
+    const historyState = {};
+    function loadOlder(){
+      const ch = activeChannel;
+      const st = historyState[ch] || (historyState[ch] = {});
+      if (st.loading || st.exhausted) return;
+      const oldest = (channelLogs[ch] || []).find(m => m.id);
+      if (!oldest || !ws || ws.readyState !== WebSocket.OPEN) return;
+      st.loading = true;
+      const req = isDM(ch) ? { to: ch.slice(1) } : { channel: ch };
+      try {
+        ws.send(JSON.stringify(Object.assign({ type: 'history', before: oldest.id, limit: 50, user: (user.value || 'anon'), uid: clientUID }, req)));
+      } catch(_) { st.loading = false; }
+    }
+    // mergeHistory adds a history page to a channel log. Older pages are
+    // prepended in place; pages that land in the middle (after a jump) are
+    // merged by ID and the log is redrawn.
+    function mergeHistory(ch, msgs, more){
+      msgs.forEach(m => unseal(ch, m));
+      const st = historyState[ch] || (historyState[ch] = {});
+      st.loading = false;
+      const entries = channelLogs[ch] || (channelLogs[ch] = []);
+      const seen = new Set(entries.map(m => m.id).filter(Boolean));
+      const fresh = msgs.filter(m => !seen.has(m.id));
+      const first = entries.find(m => m.id);
+      const older = !first || msgs.length === 0 || msgs[msgs.length - 1].id < first.id;
+      if (older) st.exhausted = !more;
+      if (fresh.length > 0 && older) {
+        entries.unshift(...fresh);
+        if (ch === activeChannel) {
+          const prevHeight = log.scrollHeight;
+          const fragment = document.createDocumentFragment();
+          fresh.forEach(m => { const d = buildLine(m); if (d) fragment.appendChild(d); });
+          log.insertBefore(fragment, log.firstChild);
+          log.scrollTop += log.scrollHeight - prevHeight;
+        }
+      } else if (fresh.length > 0) {
+        const merged = entries.filter(m => m.id).concat(fresh).sort((a, b) => a.id - b.id);
+        channelLogs[ch] = merged.concat(entries.filter(m => !m.id));
+        if (ch === activeChannel) {
+          log.innerHTML = '';
+          const fragment = document.createDocumentFragment();
+          channelLogs[ch].forEach(m => { const d = buildLine(m); if (d) fragment.appendChild(d); });
+          log.appendChild(fragment);
+        }
+      }
+      if (ch === activeChannel) renderReceipts();
+      if (st.focus && ch === activeChannel) {
+        const line = log.querySelector('.line[data-id="' + st.focus + '"]');
+        if (line) {
+          line.classList.add('focus');
+          line.scrollIntoView({ block: 'center' });
+          setTimeout(() => line.classList.remove('focus'), 2500);
+        }
+        if (--st.pending <= 0) st.focus = 0;
+      }
+    }
+    // jumpTo shows a channel's history around message id and highlights it
+    function jumpTo(ch, id){
+      if (!ch || !id || !ws || ws.readyState !== WebSocket.OPEN) return;
+      if (!joinedChannels.includes(ch)) joinChannel(ch); else switchChannel(ch);
+      channelLogs[ch] = [];
+      historyState[ch] = { loading: true, focus: id, pending: 2 };
+      log.innerHTML = '';
+      const base = { type: 'history', channel: ch, user: (user.value || 'anon'), uid: clientUID };
+      try {
+        ws.send(JSON.stringify(Object.assign({ before: id + 1, limit: 25 }, base)));
+        ws.send(JSON.stringify(Object.assign({ after: id, limit: 100 }, base)));
+      } catch(_) { historyState[ch] = {}; }
+    }
+    log.addEventListener('scroll', () => { if (log.scrollTop < 40) loadOlder(); });
+
+    function routeDirect(msg){
+      if (msg.event === 'history') {
+        mergeHistory('@' + msg.to, msg.history || [], !!msg.more);
+        return;
+      }
+      const peer = msg.author === myAuthor ? msg.to : msg.author;
+      const key = '@' + peer;
+      stopTyping(key, msg.author);
+      if (peer !== msg.to && msg.user) dmPeers[peer] = msg.user;
+      if (!openDMs.includes(peer)) openDMs.unshift(peer);
+      if (!channelLogs[key]) {
+        // Unopened conversation: load its history when the tab is first viewed
+        unreadCounts[key] = (unreadCounts[key] || 0) + 1;
+        renderChannels();
+        return;
+      }
+      channelLogs[key].push(msg);
+      if (key !== activeChannel) {
+        unreadCounts[key] = (unreadCounts[key] || 0) + 1;
+        renderChannels();
+        return;
+      }
+      renderLine(msg);
+    }
+
+    function renderLine(msg){
+      const div = buildLine(msg);
+      if (!div) return;
       pendingAppends.push(div);
 
       // Store actual chat messages for bubble
-      if (isActualMessage && msg.text) {
+      if (!msg.event && msg.text) {
         pendingMessages.push({ username: nick, text: msg.text });
       }
 
@@ -841,10 +2155,10 @@ var indexTmpl = template.Must(template.New("chat").Parse(`<!DOCTYPE html>
         pendingAppends.forEach(d => fragment.appendChild(d));
         log.appendChild(fragment);
 
-        // Trim old messages to keep DOM size manageable
+        // Trim old messages to keep DOM size manageable (unless the user scrolled back through history)
         const maxDOMMessages = 200;
         const messageLines = log.querySelectorAll('.line');
-        if (messageLines.length > maxDOMMessages) {
+        if (wasAtBottom && messageLines.length > maxDOMMessages) {
           const toRemove = messageLines.length - maxDOMMessages;
           for (let i = 0; i < toRemove; i++) {
             if (messageLines[i] && messageLines[i].parentNode === log) {
@@ -853,9 +2167,11 @@ var indexTmpl = template.Must(template.New("chat").Parse(`<!DOCTYPE html>
           }
         }
 
+        renderReceipts();
         if (wasAtBottom) {
           log.scrollTop = log.scrollHeight;
           newMessageBubble.classList.remove('show');
+          sendRead();
         } else {
           if (pendingMessages.length > 0) {
             const latestMsg = pendingMessages[pendingMessages.length - 1];
@@ -867,12 +2183,143 @@ var indexTmpl = template.Must(template.New("chat").Parse(`<!DOCTYPE html>
         pendingMessages = [];
       }, 0);
     }
+
+    // Live state from ephemeral events, keyed like channelLogs (channel or '@' + peer)
+    const typingState = {};   // key -> author -> { name, until }
+    const channelReads = {};  // key -> author -> { name, ref }
+    const lastSentRead = {};  // key -> last message ID we reported as read
+    const TYPING_SHOWN_MS = 5000;
+    const TYPING_SEND_MS = 3000;
+    const IDLE_AFTER_MS = 2 * 60 * 1000;
+    const AWAY_AFTER_MS = 10 * 60 * 1000;
+    const typingBar = document.getElementById('typing');
+    function liveEvent(msg){
+      if (!msg.author || msg.author === myAuthor) return;
+      // Direct events carry the recipient in 'to'; they belong to the sender's conversation
+      const key = msg.to ? '@' + msg.author : (msg.channel || DEFAULT_CHANNEL);
+      if (msg.event === 'typing') {
+        (typingState[key] || (typingState[key] = {}))[msg.author] = { name: msg.user || 'anon', until: Date.now() + TYPING_SHOWN_MS };
+        if (key === activeChannel) renderTyping();
+      } else if (msg.event === 'read') {
+        (channelReads[key] || (channelReads[key] = {}))[msg.author] = { name: msg.user || 'anon', ref: msg.ref };
+        if (key === activeChannel) renderReceipts();
+      } else if (msg.event === 'presence') {
+        (channelMembers[key] || []).forEach((m) => { if (m.author === msg.author) m.state = msg.state; });
+      }
+    }
+    function stopTyping(key, author){
+      if (typingState[key] && typingState[key][author]) {
+        delete typingState[key][author];
+        if (key === activeChannel) renderTyping();
+      }
+    }
+    function renderTyping(){
+      const now = Date.now();
+      const who = typingState[activeChannel] || {};
+      const names = [];
+      Object.keys(who).forEach((a) => { if (who[a].until > now) names.push(who[a].name); else delete who[a]; });
+      if (names.length === 0) typingBar.textContent = '';
+      else if (names.length === 1) typingBar.textContent = names[0] + ' is typing…';
+      else if (names.length <= 3) typingBar.textContent = names.join(', ') + ' are typing…';
+      else typingBar.textContent = 'several people are typing…';
+    }
+    setInterval(renderTyping, 1000);
+    // Readers are listed under the newest line at or before their read position
+    function renderReceipts(){
+      log.querySelectorAll('.receipts').forEach(el => el.remove());
+      const reads = channelReads[activeChannel] || {};
+      const lines = Array.from(log.querySelectorAll('.line[data-id]'));
+      const byLine = new Map();
+      Object.keys(reads).forEach((a) => {
+        if (a === myAuthor) return;
+        let at = null;
+        lines.forEach((l) => { if (Number(l.dataset.id) <= reads[a].ref) at = l; });
+        if (!at) return;
+        if (!byLine.has(at)) byLine.set(at, []);
+        byLine.get(at).push(reads[a].name);
+      });
+      byLine.forEach((names, line) => {
+        const el = document.createElement('div');
+        el.className = 'receipts';
+        el.textContent = '✓ read by ' + names.join(', ');
+        line.appendChild(el);
+      });
+    }
+    function liveTarget(payload){
+      if (isDM(activeChannel)) payload.to = activeChannel.slice(1); else payload.channel = activeChannel;
+      return payload;
+    }
+    // Report the newest message in view as read, once things settle
+    let readTimer = null;
+    function sendRead(){
+      if (readTimer) clearTimeout(readTimer);
+      readTimer = setTimeout(() => {
+        if (document.hidden || !ws || ws.readyState !== WebSocket.OPEN) return;
+        let last = 0;
+        (channelLogs[activeChannel] || []).forEach((m) => { if (m.id && m.id > last) last = m.id; });
+        if (!last || (lastSentRead[activeChannel] || 0) >= last) return;
+        lastSentRead[activeChannel] = last;
+        try { ws.send(JSON.stringify(liveTarget({ type: 'read', ref: last, user: (user.value || 'anon'), uid: clientUID }))); } catch(_) {}
+      }, 1000);
+    }
+    let lastTypingSent = 0;
+    cmd.addEventListener('input', () => {
+      const text = cmd.value.trim();
+      if (!text || text.charAt(0) === '/' || Date.now() - lastTypingSent < TYPING_SEND_MS) return;
+      if (!ws || ws.readyState !== WebSocket.OPEN) return;
+      lastTypingSent = Date.now();
+      try { ws.send(JSON.stringify(liveTarget({ type: 'typing', user: (user.value || 'anon'), uid: clientUID }))); } catch(_) {}
+    });
+    // Presence: idle after a quiet spell, away when the tab is hidden or quiet for long
+    let myPresence = 'active';
+    let lastActivity = Date.now();
+    function reportPresence(state){
+      if (state === myPresence) return;
+      myPresence = state;
+      if (ws && ws.readyState === WebSocket.OPEN) {
+        try { ws.send(JSON.stringify({ type: 'presence', state: state, user: (user.value || 'anon'), uid: clientUID })); } catch(_) {}
+      }
+    }
+    function noteActivity(){
+      lastActivity = Date.now();
+      if (!document.hidden) reportPresence('active');
+    }
+    ['keydown', 'mousemove', 'touchstart', 'focus'].forEach(ev => window.addEventListener(ev, noteActivity, { passive: true }));
+    document.addEventListener('visibilitychange', () => {
+      if (document.hidden) {
+        reportPresence('away');
+      } else {
+        noteActivity();
+        sendRead();
+      }
+    });
+    setInterval(() => {
+      const quiet = Date.now() - lastActivity;
+      if (document.hidden || quiet > AWAY_AFTER_MS) reportPresence('away');
+      else if (quiet > IDLE_AFTER_MS) reportPresence('idle');
+    }, 15000);
     function escapeHTML(s){
       // Block alert() function
       s = s.replace(/alert\(/gi, '');
       return s.replace(/[&<>\"]/g, c => ({'&':'&amp;','<':'&lt;','>':'&gt;','\"':'&quot;'}[c]));
     }
 
+    function formatSize(n){
+      if (n < 1024) return n + ' B';
+      if (n < 1024 * 1024) return (n / 1024).toFixed(1) + ' KB';
+      return (n / 1024 / 1024).toFixed(1) + ' MB';
+    }
+    // Uploaded files: images inline (click for fullscreen), others as a download link
+    function renderAttachment(a){
+      if (!a || !/^[0-9a-f]{32}$/.test(a.id || '')) return '';
+      const url = '/api/attachments/' + a.id;
+      const name = escapeHTML(a.name || 'file');
+      if ((a.type || '').startsWith('image/')) {
+        return '<img class="attachment-img" loading="lazy" src="' + url + '" alt="' + name + '" title="' + name + '" />';
+      }
+      return '<br><a class="attachment-file" href="' + url + '" download="' + name + '">📎 ' + name + ' (' + formatSize(a.size || 0) + ')</a>';
+    }
+
     // Convert URLs in text to clickable links and display images
     // Also renders markdown-like code blocks
     function linkifyText(text) {
@@ -978,6 +2425,9 @@ var indexTmpl = template.Must(template.New("chat").Parse(`<!DOCTYPE html>
     const wsURL = wsProto + '://' + location.host + basePath + 'ws';
 
     let ws = null;
+    // Proxies that refuse websocket upgrades get an event stream plus POSTs
+    let useEvents = false;
+    let failedOpens = 0;
     let reconnectTimer = null;
     let reconnectAttempts = 0;
     let heartbeatTimer = null;
@@ -1063,6 +2513,41 @@ var indexTmpl = template.Must(template.New("chat").Parse(`<!DOCTYPE html>
       }
     }
 
+    // eventTransport offers the WebSocket interface the rest of the page uses
+    // on top of GET /events for receiving and POST /send for sending.
+    function eventTransport() {
+      const t = { readyState: WebSocket.CONNECTING, onopen: null, onmessage: null, onerror: null, onclose: null };
+      const es = new EventSource(basePath + 'events');
+      let session = '';
+      let posts = Promise.resolve();
+      function finish(code) {
+        if (t.readyState === WebSocket.CLOSED) return;
+        t.readyState = WebSocket.CLOSED;
+        es.close();
+        if (t.onclose) t.onclose({ code: code, reason: '', wasClean: code === 1000 });
+      }
+      es.addEventListener('session', (e) => {
+        session = e.data;
+        t.readyState = WebSocket.OPEN;
+        if (t.onopen) t.onopen();
+      });
+      es.onmessage = (e) => { if (t.onmessage) t.onmessage({ data: e.data }); };
+      // EventSource would retry on its own; reconnect through the usual path instead
+      es.onerror = (err) => {
+        if (t.onerror) t.onerror(err);
+        finish(1006);
+      };
+      t.send = (data) => {
+        if (t.readyState !== WebSocket.OPEN) throw new Error('event stream not open');
+        // One request at a time so the server sees them in order
+        posts = posts.then(() => fetch(basePath + 'send?session=' + encodeURIComponent(session), {
+          method: 'POST', headers: { 'Content-Type': 'application/json' }, body: data
+        })).then((r) => { if (r.status === 404) finish(1006); }).catch(() => finish(1006));
+      };
+      t.close = () => finish(1000);
+      return t;
+    }
+
     function connectWebSocket() {
       logWS('INFO', '=== connectWebSocket() called ===');
       logWS('DEBUG', 'Current state: reconnectAttempts=' + reconnectAttempts + ', reconnectTimer=' + (reconnectTimer ? 'active' : 'null'));
@@ -1074,10 +2559,11 @@ var indexTmpl = template.Must(template.New("chat").Parse(`<!DOCTYPE html>
 
       connectionStartTime = Date.now();
       messageCount = 0;
-      logWS('INFO', 'Creating new WebSocket connection to: ' + wsURL);
+      logWS('INFO', 'Creating new ' + (useEvents ? 'event stream' : 'WebSocket') + ' connection to: ' + (useEvents ? basePath + 'events' : wsURL));
+      let opened = false;
 
       try {
-        ws = new WebSocket(wsURL);
+        ws = useEvents ? eventTransport() : new WebSocket(wsURL);
         logWS('INFO', 'WebSocket object created, readyState: ' + ws.readyState);
       } catch(e) {
         logWS('ERROR', 'Failed to create WebSocket', e);
@@ -1087,17 +2573,23 @@ var indexTmpl = template.Must(template.New("chat").Parse(`<!DOCTYPE html>
       ws.onopen = () => {
         const connectionTime = Date.now() - connectionStartTime;
         logWS('INFO', '✓ WebSocket OPENED (took ' + connectionTime + 'ms)');
+        opened = true;
+        failedOpens = 0;
         reconnectAttempts = 0;
         updateConnectionStatus(true);
         startHeartbeat();
 
-        logWS('DEBUG', 'Sending initial user info message');
-        try{
-          ws.send(JSON.stringify({ user: (user.value || 'anon'), text: '', uid: clientUID }));
-          logWS('DEBUG', 'Initial message sent successfully');
-        }catch(e){
-          logWS('ERROR', 'Failed to send initial message', e);
+        logWS('DEBUG', 'Joining channels: ' + joinedChannels.join(', '));
+        joinedChannels.forEach(sendJoin);
+        // The server forgets live state when our last connection drops
+        Object.keys(lastSentRead).forEach((key) => { delete lastSentRead[key]; });
+        if (myPresence !== 'active') {
+          try { ws.send(JSON.stringify({ type: 'presence', state: myPresence, user: (user.value || 'anon'), uid: clientUID })); } catch(_) {}
         }
+        // Reload open conversations from the server on (re)connect
+        Object.keys(channelLogs).filter(isDM).forEach((key) => { delete channelLogs[key]; });
+        try { ws.send(JSON.stringify({ type: 'conversations', user: (user.value || 'anon'), uid: clientUID })); } catch(_) {}
+        if (isDM(activeChannel)) switchChannel(activeChannel);
       };
 
       ws.onmessage = (e) => {
@@ -1144,6 +2636,12 @@ var indexTmpl = template.Must(template.New("chat").Parse(`<!DOCTYPE html>
 
         updateConnectionStatus(false, false);
         stopHeartbeat();
+        // Two attempts in a row that never opened: try the other transport
+        if (!opened && ++failedOpens >= 2) {
+          useEvents = !useEvents;
+          failedOpens = 0;
+          logWS('WARN', 'Switching transport to ' + (useEvents ? 'event stream' : 'WebSocket'));
+        }
 
         // Always attempt to reconnect regardless of close code
         const delay = getReconnectDelay();
@@ -1168,10 +2666,16 @@ var indexTmpl = template.Must(template.New("chat").Parse(`<!DOCTYPE html>
     logWS('INFO', 'Client UID: ' + clientUID);
     logWS('INFO', 'WebSocket URL: ' + wsURL);
     logWS('INFO', 'Heartbeat interval: ' + heartbeatInterval + 'ms');
+    renderChannels();
     connectWebSocket();
 
     function send(){
-      const payload = { user: (user.value || 'anon'), text: cmd.value.trim(), uid: clientUID };
+      const payload = { user: (user.value || 'anon'), text: cmd.value.trim(), uid: clientUID, channel: activeChannel };
+      if (isDM(activeChannel)) {
+        payload.type = 'dm';
+        payload.to = activeChannel.slice(1);
+        delete payload.channel;
+      }
       if(!payload.text) {
         logWS('DEBUG', 'send() called with empty text, ignoring');
         return;
@@ -1186,6 +2690,24 @@ var indexTmpl = template.Must(template.New("chat").Parse(`<!DOCTYPE html>
         return;
       }
 
+      // Encrypted rooms: chat lines and /me actions are sealed; other commands go out as typed
+      const room = payload.channel;
+      const text = payload.text;
+      if (room && roomSalts[room] && (text.charAt(0) !== '/' || text.startsWith('//') || text.startsWith('/me '))) {
+        if (!roomKeys[room]) {
+          unlockRoom(room).then((ok) => { if (ok) send(); });
+          return;
+        }
+        const action = text.startsWith('/me ');
+        const plain = action ? text.slice(4) : (text.startsWith('//') ? text.slice(1) : text);
+        sealText(room, plain).then((sealed) => {
+          payload.text = (action ? '/me ' : '') + sealed;
+          ws.send(JSON.stringify(payload));
+          cmd.value = '';
+        }).catch((e) => showConnectionMessage('encryption failed: ' + e.message));
+        return;
+      }
+
       try {
         ws.send(JSON.stringify(payload));
         logWS('INFO', 'Message sent successfully');
@@ -1244,10 +2766,70 @@ var indexTmpl = template.Must(template.New("chat").Parse(`<!DOCTYPE html>
       reader.readAsDataURL(file);
     }
 
+    // Upload a file to the server and post it with whatever is typed in the
+    // prompt. Servers without --data-path answer 503; images then fall back
+    // to the inline base64 path below.
+    function uploadAttachment(file){
+      if (!isDM(activeChannel) && roomSalts[activeChannel]) {
+        alert('Files are not encrypted, so they cannot be posted in an end-to-end encrypted channel');
+        imageInput.value = '';
+        return;
+      }
+      if (!ws || ws.readyState !== WebSocket.OPEN) {
+        alert('Not connected to server');
+        return;
+      }
+      const form = new FormData();
+      form.append('uid', clientUID);
+      form.append('file', file, file.name || 'pasted');
+      cmd.placeholder = '[Uploading ' + (file.name || 'file') + '...]';
+      cmd.disabled = true;
+      const done = () => {
+        cmd.placeholder = 'type a message and press Enter';
+        cmd.disabled = false;
+        imageInput.value = '';
+        cmd.focus();
+      };
+      fetch('/api/attachments', { method: 'POST', body: form }).then(res => {
+        if (res.status === 503 && file.type.startsWith('image/')) {
+          done();
+          sendInlineImage(file);
+          return;
+        }
+        if (!res.ok) {
+          return res.text().then(t => { throw new Error(t.trim() || res.statusText); });
+        }
+        return res.json().then(a => {
+          const payload = { user: (user.value || 'anon'), text: cmd.value.trim(), attachment: a.id, uid: clientUID, channel: activeChannel };
+          if (isDM(activeChannel)) {
+            payload.type = 'dm';
+            payload.to = activeChannel.slice(1);
+            delete payload.channel;
+          }
+          ws.send(JSON.stringify(payload));
+          cmd.value = '';
+          done();
+        });
+      }).catch(e => {
+        done();
+        alert('Upload failed: ' + e.message);
+      });
+    }
+
     imageInput.addEventListener('change', (e) => {
       const file = e.target.files[0];
-      if (!file) return;
+      if (file) uploadAttachment(file);
+    });
 
+    cmd.addEventListener('paste', (e) => {
+      const files = (e.clipboardData && e.clipboardData.files) || [];
+      if (files.length > 0) {
+        e.preventDefault();
+        uploadAttachment(files[0]);
+      }
+    });
+
+    function sendInlineImage(file){
       // Check if file is an image
       if (!file.type.startsWith('image/')) {
         alert('Please select an image file');
@@ -1289,8 +2871,14 @@ var indexTmpl = template.Must(template.New("chat").Parse(`<!DOCTYPE html>
           const payload = {
             user: (user.value || 'anon'),
             text: '[IMAGE]' + resizedBase64,
-            uid: clientUID
+            uid: clientUID,
+            channel: activeChannel
           };
+          if (isDM(activeChannel)) {
+            payload.type = 'dm';
+            payload.to = activeChannel.slice(1);
+            delete payload.channel;
+          }
           ws.send(JSON.stringify(payload));
 
           // Reset input
@@ -1305,7 +2893,7 @@ var indexTmpl = template.Must(template.New("chat").Parse(`<!DOCTYPE html>
           imageInput.value = '';
         }
       });
-    });
+    }
 
     // Debounced notify of nickname changes to server so roster updates without sending a chat
     let nickTimer = null;
@@ -1385,6 +2973,21 @@ var indexTmpl = template.Must(template.New("chat").Parse(`<!DOCTYPE html>
         return;
       }
 
+      // Locked messages in encrypted rooms ask for the passphrase
+      if (target.classList && target.classList.contains('locked')) {
+        unlockRoom(activeChannel);
+        e.preventDefault();
+        return;
+      }
+
+      // Uploaded images open fullscreen directly
+      if (target.classList && target.classList.contains('attachment-img')) {
+        modalImage.src = target.src;
+        imageModal.classList.add('show');
+        e.preventDefault();
+        return;
+      }
+
       // If clicked on fullscreen button - show modal
       if (target.classList && target.classList.contains('fullscreen-img')) {
         const imgId = target.getAttribute('data-img-id');
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestBroadcastBacklogOrder checks that concurrent broadcasts land in the
+// backlog in ID order, which history paging relies on.
+func TestBroadcastBacklogOrder(t *testing.T) {
+	store, err := openMessageStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = store.Close() }()
+	h := newHub()
+	h.attachStore(store)
+	h.maxBacklog = 0
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				h.broadcast(message{TS: time.Now().UTC(), Channel: "race", User: "u" + strconv.Itoa(i), Text: "hi"})
+			}
+		}()
+	}
+	wg.Wait()
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	msgs := h.channels["race"].messages
+	if len(msgs) != 8*50 {
+		t.Fatalf("backlog holds %d messages, want %d", len(msgs), 8*50)
+	}
+	for i := 1; i < len(msgs); i++ {
+		if msgs[i].ID <= msgs[i-1].ID {
+			t.Fatalf("backlog[%d].ID = %d after %d", i, msgs[i].ID, msgs[i-1].ID)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog/log"
+)
+
+// hooksConfig is the --hooks-file format.
+//
+//	{
+//	  "incoming": [{"token": "s3cret", "name": "ci-bot", "channel": "ops"}],
+//	  "outgoing": [{"url": "https://example.com/chat", "secret": "k", "channels": ["ops"]}]
+//	}
+type hooksConfig struct {
+	Incoming []incomingHook `json:"incoming"`
+	Outgoing []outgoingHook `json:"outgoing"`
+}
+
+// incomingHook lets an external system post into a channel as a named bot via
+// POST /hooks/{token}.
+type incomingHook struct {
+	Token   string `json:"token"`
+	Name    string `json:"name"`
+	Channel string `json:"channel,omitempty"` // default channel when the payload names none
+}
+
+// outgoingHook receives a POST for every new chat line. Channels restricts
+// delivery to the listed channels (all when empty). When Secret is set the body
+// is signed with HMAC-SHA256 in the X-Chat-Signature header ("sha256=<hex>").
+type outgoingHook struct {
+	URL      string   `json:"url"`
+	Secret   string   `json:"secret,omitempty"`
+	Channels []string `json:"channels,omitempty"`
+}
+
+const (
+	hookQueueSize   = 256
+	hookMaxAttempts = 4
+	hookMaxBody     = 16 << 10
+)
+
+// hookBackoff is the wait before the first retry; it doubles per attempt.
+var hookBackoff = time.Second
+
+// webhooks owns the incoming hook table and one delivery worker per outgoing hook.
+type webhooks struct {
+	incoming []incomingHook
+	outgoing []*hookWorker
+	wg       sync.WaitGroup
+}
+
+type hookWorker struct {
+	hook   outgoingHook
+	queue  chan message
+	client *http.Client
+}
+
+// parseIncomingHookFlag parses "token=name[#channel]".
+func parseIncomingHookFlag(v string) (incomingHook, error) {
+	token, rest, ok := strings.Cut(v, "=")
+	if !ok || token == "" || rest == "" {
+		return incomingHook{}, fmt.Errorf("incoming hook %q: want token=name[#channel]", v)
+	}
+	name, ch, _ := strings.Cut(rest, "#")
+	return incomingHook{Token: token, Name: name, Channel: ch}, nil
+}
+
+// loadHooks merges the optional hooks file with hooks given as flags.
+func loadHooks(path string, inFlags, outFlags []string, secret string) (*hooksConfig, error) {
+	cfg := &hooksConfig{}
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read hooks file: %w", err)
+		}
+		if err := json.Unmarshal(b, cfg); err != nil {
+			return nil, fmt.Errorf("parse hooks file: %w", err)
+		}
+	}
+	for _, v := range inFlags {
+		h, err := parseIncomingHookFlag(v)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Incoming = append(cfg.Incoming, h)
+	}
+	for _, u := range outFlags {
+		cfg.Outgoing = append(cfg.Outgoing, outgoingHook{URL: u, Secret: secret})
+	}
+	for i := range cfg.Incoming {
+		in := &cfg.Incoming[i]
+		in.Name = sanitizeString(in.Name, 100)
+		in.Channel = normalizeChannel(in.Channel)
+		if len(in.Token) < 8 || in.Name == "" {
+			return nil, fmt.Errorf("incoming hook %q: token must be at least 8 characters and name non-empty", in.Name)
+		}
+	}
+	for i := range cfg.Outgoing {
+		out := &cfg.Outgoing[i]
+		if !strings.HasPrefix(out.URL, "http://") && !strings.HasPrefix(out.URL, "https://") {
+			return nil, fmt.Errorf("outgoing hook %q: url must be http(s)", out.URL)
+		}
+		for j, ch := range out.Channels {
+			out.Channels[j] = normalizeChannel(ch)
+		}
+	}
+	return cfg, nil
+}
+
+// startWebhooks launches the delivery workers and subscribes them to the hub.
+// Workers stop when ctx is cancelled; call wait to let them drain.
+func startWebhooks(ctx context.Context, h *hub, cfg *hooksConfig) *webhooks {
+	w := &webhooks{incoming: cfg.Incoming}
+	for _, hook := range cfg.Outgoing {
+		hw := &hookWorker{hook: hook, queue: make(chan message, hookQueueSize), client: &http.Client{Timeout: 10 * time.Second}}
+		w.outgoing = append(w.outgoing, hw)
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			hw.run(ctx)
+		}()
+	}
+	if len(w.outgoing) > 0 {
+		h.addListener(w.enqueue)
+	}
+	return w
+}
+
+func (w *webhooks) wait() {
+	if w != nil {
+		w.wg.Wait()
+	}
+}
+
+// enqueue hands a new message to every interested outgoing hook. Only public
+// chat lines are forwarded, and bot posts are skipped so a bot wired to both
+// directions cannot loop.
+func (w *webhooks) enqueue(m message) {
+	if (m.Event != "" && m.Event != "me") || m.Bot || m.Channel == "" {
+		return
+	}
+	for _, hw := range w.outgoing {
+		if len(hw.hook.Channels) > 0 && !slices.Contains(hw.hook.Channels, m.Channel) {
+			continue
+		}
+		select {
+		case hw.queue <- m:
+		default:
+			log.Warn().Str("url", hw.hook.URL).Msg("[chat] outgoing hook queue full; dropping message")
+		}
+	}
+}
+
+func (hw *hookWorker) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case m := <-hw.queue:
+			hw.deliver(ctx, m)
+		}
+	}
+}
+
+// deliver POSTs one message, retrying with exponential backoff on network
+// errors and 5xx/429 responses.
+func (hw *hookWorker) deliver(ctx context.Context, m message) {
+	body, _ := json.Marshal(m)
+	backoff := hookBackoff
+	for attempt := 1; attempt <= hookMaxAttempts; attempt++ {
+		retry, err := hw.post(ctx, body)
+		if err == nil {
+			return
+		}
+		if !retry || attempt == hookMaxAttempts {
+			log.Warn().Err(err).Str("url", hw.hook.URL).Int("attempt", attempt).Msg("[chat] outgoing hook failed")
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (hw *hookWorker) post(ctx context.Context, body []byte) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hw.hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "simple-chat-webhook")
+	if hw.hook.Secret != "" {
+		req.Header.Set("X-Chat-Signature", "sha256="+signHookBody(hw.hook.Secret, body))
+	}
+	resp, err := hw.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	switch {
+	case resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("status %d", resp.StatusCode)
+	default:
+		return false, fmt.Errorf("status %d", resp.StatusCode)
+	}
+}
+
+// signHookBody returns the hex HMAC-SHA256 of body under secret. Receivers
+// recompute it over the raw request body and compare in constant time.
+func signHookBody(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (w *webhooks) lookup(token string) (incomingHook, bool) {
+	if w == nil {
+		return incomingHook{}, false
+	}
+	for _, in := range w.incoming {
+		if subtle.ConstantTimeCompare([]byte(in.Token), []byte(token)) == 1 {
+			return in, true
+		}
+	}
+	return incomingHook{}, false
+}
+
+// handleIncomingHook posts a bot message into a channel.
+//
+//	POST /hooks/{token}  {"text": "...", "channel": "ops"}   (or a text/plain body)
+func handleIncomingHook(w http.ResponseWriter, r *http.Request, h *hub) {
+	hook, ok := h.hooks.lookup(chi.URLParam(r, "token"))
+	if !ok {
+		http.Error(w, "unknown hook", http.StatusNotFound)
+		return
+	}
+	raw, err := io.ReadAll(io.LimitReader(r.Body, hookMaxBody+1))
+	if err != nil || len(raw) > hookMaxBody {
+		http.Error(w, "body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	var req struct {
+		Text    string `json:"text"`
+		Channel string `json:"channel"`
+	}
+	if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct == "text/plain" {
+		req.Text = string(raw)
+	} else if err := json.Unmarshal(raw, &req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	req.Text = sanitizeString(req.Text, 10000)
+	if req.Text == "" {
+		http.Error(w, "empty text", http.StatusBadRequest)
+		return
+	}
+	ch := normalizeChannel(req.Channel)
+	if ch == "" {
+		ch = hook.Channel
+	}
+	if ch == "" {
+		ch = defaultChannel
+	}
+	if err := h.checkText(ch, req.Text); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	h.broadcast(message{TS: time.Now().UTC(), Channel: ch, User: hook.Name, Text: req.Text, Bot: true})
+	w.WriteHeader(http.StatusNoContent)
+}
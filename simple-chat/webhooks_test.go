@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestOutgoingHookSignature(t *testing.T) {
+	const secret = "hook-secret"
+	var got []byte
+	var sig string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = io.ReadAll(r.Body)
+		sig = r.Header.Get("X-Chat-Signature")
+	}))
+	defer srv.Close()
+
+	hw := &hookWorker{hook: outgoingHook{URL: srv.URL, Secret: secret}, client: srv.Client()}
+	m := message{TS: time.Unix(0, 0).UTC(), Channel: "ops", User: "alice", Text: "deploy done"}
+	hw.deliver(context.Background(), m)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(got)
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); sig != want {
+		t.Fatalf("X-Chat-Signature = %q, want %q", sig, want)
+	}
+	var sent message
+	if err := json.Unmarshal(got, &sent); err != nil || sent.Text != m.Text || sent.Channel != m.Channel {
+		t.Fatalf("delivered body %s (%v), want the message", got, err)
+	}
+}
+
+func TestSignHookBody(t *testing.T) {
+	// RFC 4231 test case 2
+	const want = "5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843"
+	if got := signHookBody("Jefe", []byte("what do ya want for nothing?")); got != want {
+		t.Fatalf("signHookBody = %s, want %s", got, want)
+	}
+}
+
+func TestOutgoingHookUnsigned(t *testing.T) {
+	var sig atomic.Value
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sig.Store(r.Header.Get("X-Chat-Signature"))
+	}))
+	defer srv.Close()
+
+	hw := &hookWorker{hook: outgoingHook{URL: srv.URL}, client: srv.Client()}
+	hw.deliver(context.Background(), message{Channel: "ops", Text: "hi"})
+	if s := sig.Load(); s != "" {
+		t.Fatalf("unsigned hook sent X-Chat-Signature %q", s)
+	}
+}
+
+func TestOutgoingHookRetries(t *testing.T) {
+	defer func(d time.Duration) { hookBackoff = d }(hookBackoff)
+	hookBackoff = time.Millisecond
+
+	for _, tc := range []struct {
+		name     string
+		statuses []int // response per attempt; the last repeats
+		attempts int32
+	}{
+		{"success", []int{http.StatusOK}, 1},
+		{"retry then success", []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK}, 3},
+		{"client error is final", []int{http.StatusBadRequest}, 1},
+		{"gives up", []int{http.StatusInternalServerError}, hookMaxAttempts},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var n atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				i := int(n.Add(1)) - 1
+				w.WriteHeader(tc.statuses[min(i, len(tc.statuses)-1)])
+			}))
+			defer srv.Close()
+
+			hw := &hookWorker{hook: outgoingHook{URL: srv.URL}, client: srv.Client()}
+			hw.deliver(context.Background(), message{Channel: "ops", Text: "hi"})
+			if got := n.Load(); got != tc.attempts {
+				t.Fatalf("%d attempts, want %d", got, tc.attempts)
+			}
+		})
+	}
+}
+
+func TestIncomingHook(t *testing.T) {
+	h := newHub()
+	h.attachHooks(&webhooks{incoming: []incomingHook{
+		{Token: "ops-token", Name: "deploybot", Channel: "ops"},
+		{Token: "any-token", Name: "pager"},
+	}})
+	var mu sync.Mutex
+	var posted []message
+	h.addListener(func(m message) {
+		mu.Lock()
+		posted = append(posted, m)
+		mu.Unlock()
+	})
+	router := chi.NewRouter()
+	router.Post("/hooks/{token}", func(w http.ResponseWriter, r *http.Request) { handleIncomingHook(w, r, h) })
+
+	for _, tc := range []struct {
+		name        string
+		token       string
+		contentType string
+		body        string
+		status      int
+		channel     string // where the line must land when status is 204
+		user        string
+		text        string
+	}{
+		{"unknown token", "nope-nope", "application/json", `{"text":"hi"}`, http.StatusNotFound, "", "", ""},
+		{"json", "ops-token", "application/json", `{"text":"deployed"}`, http.StatusNoContent, "ops", "deploybot", "deployed"},
+		{"json names a channel", "ops-token", "application/json", `{"text":"hi","channel":"#Dev"}`, http.StatusNoContent, "dev", "deploybot", "hi"},
+		{"text/plain", "ops-token", "text/plain; charset=utf-8", "plain line", http.StatusNoContent, "ops", "deploybot", "plain line"},
+		{"default channel", "any-token", "application/json", `{"text":"ping"}`, http.StatusNoContent, defaultChannel, "pager", "ping"},
+		{"too large", "ops-token", "text/plain", strings.Repeat("x", hookMaxBody+1), http.StatusRequestEntityTooLarge, "", "", ""},
+		{"bad json", "ops-token", "application/json", `{"text":`, http.StatusBadRequest, "", "", ""},
+		{"empty text", "ops-token", "application/json", `{"text":"  "}`, http.StatusBadRequest, "", "", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mu.Lock()
+			posted = nil
+			mu.Unlock()
+			req := httptest.NewRequest(http.MethodPost, "/hooks/"+tc.token, strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", tc.contentType)
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			if rec.Code != tc.status {
+				t.Fatalf("status %d, want %d (%s)", rec.Code, tc.status, rec.Body)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if tc.status != http.StatusNoContent {
+				if len(posted) != 0 {
+					t.Fatalf("rejected request posted %+v", posted)
+				}
+				return
+			}
+			if len(posted) != 1 {
+				t.Fatalf("posted %d messages, want 1", len(posted))
+			}
+			m := posted[0]
+			if m.Channel != tc.channel || m.User != tc.user || m.Text != tc.text || !m.Bot {
+				t.Fatalf("posted %+v, want bot %s saying %q in #%s", m, tc.user, tc.text, tc.channel)
+			}
+		})
+	}
+}